@@ -29,11 +29,16 @@ type CommonContext struct {
 	ImagePartitions []Partition
 	ImageMntDir     string
 	ImageFSTab      bytes.Buffer // Fstab as per partitioning
+	ImageCrypttab   bytes.Buffer // Crypttab of the encrypted partitions
 	ImageKernelRoot string       // Kernel cmdline root= snippet for the / of the image
 	DebugShell      string
 	Origins         map[string]string
 	State           State
 	EnvironVars     map[string]string
+	ServicesMethod  ServicesMethod
+	Network         NetworkConfig
+	Download        DownloadConfig
+	URLRewrites     []URLRewrite
 	PrintRecipe     bool
 	Verbose         bool
 }
@@ -28,6 +28,8 @@ Optional properties:
 
   - mirror -- URL with Debian-compatible repository
     If no mirror is specified debos will use http://deb.debian.org/debian as default.
+    The mirror is rewritten according to the '--url-rewrite' command line options
+    for bootstrapping, the generated sources.list keeps the original mirror.
 
 - variant -- name of the bootstrap script variant to use
 
@@ -144,6 +146,10 @@ func (d *DebootstrapAction) RunSecondStage(context debos.Context) error {
 		"--no-check-gpg",
 		"--second-stage"}
 
+	if debos.KeepLogs() {
+		cmdline = append(cmdline, "--keep-debootstrap-dir")
+	}
+
 	if d.Components != nil {
 		s := strings.Join(d.Components, ",")
 		cmdline = append(cmdline, fmt.Sprintf("--components=%s", s))
@@ -155,12 +161,22 @@ func (d *DebootstrapAction) RunSecondStage(context debos.Context) error {
 
 	err := c.Run("Debootstrap (stage 2)", cmdline...)
 
+	logFile := path.Join(context.Rootdir, "debootstrap/debootstrap.log")
+	debos.SaveLog("debootstrap-stage2.log", logFile)
 	if err != nil {
-		log := path.Join(context.Rootdir, "debootstrap/debootstrap.log")
-		_ = debos.Command{}.Run("debootstrap.log", "cat", log)
+		_ = debos.Command{}.Run("debootstrap.log", "cat", logFile)
+		return err
 	}
 
-	return err
+	return d.removeDebootstrapDir(context)
+}
+
+// Remove the directory kept by debootstrap to save its log
+func (d *DebootstrapAction) removeDebootstrapDir(context debos.Context) error {
+	if !debos.KeepLogs() {
+		return nil
+	}
+	return os.RemoveAll(path.Join(context.Rootdir, "debootstrap"))
 }
 
 // Guess if suite is something before usr-is-merged was introduced
@@ -225,6 +241,11 @@ func (d *DebootstrapAction) Run(context *debos.Context) error {
 		cmdline = append(cmdline, fmt.Sprintf("--variant=%s", d.Variant))
 	}
 
+	// debootstrap removes its log once successfully done
+	if debos.KeepLogs() {
+		cmdline = append(cmdline, "--keep-debootstrap-dir")
+	}
+
 	// workaround for https://github.com/go-debos/debos/issues/361
 	if d.isLikelyOldSuite() {
 		log.Println("excluding usr-is-merged as package is not in suite")
@@ -233,7 +254,7 @@ func (d *DebootstrapAction) Run(context *debos.Context) error {
 
 	cmdline = append(cmdline, d.Suite)
 	cmdline = append(cmdline, context.Rootdir)
-	cmdline = append(cmdline, d.Mirror)
+	cmdline = append(cmdline, context.RewriteURL(d.Mirror))
 	cmdline = append(cmdline, "/usr/share/debootstrap/scripts/unstable")
 
 	/* Make sure /etc/apt/apt.conf.d exists inside the fakemachine otherwise
@@ -246,9 +267,10 @@ func (d *DebootstrapAction) Run(context *debos.Context) error {
 
 	err := debos.Command{}.Run("Debootstrap", cmdline...)
 
+	logFile := path.Join(context.Rootdir, "debootstrap/debootstrap.log")
+	debos.SaveLog("debootstrap.log", logFile)
 	if err != nil {
-		log := path.Join(context.Rootdir, "debootstrap/debootstrap.log")
-		_ = debos.Command{}.Run("debootstrap.log", "cat", log)
+		_ = debos.Command{}.Run("debootstrap.log", "cat", logFile)
 		return err
 	}
 
@@ -257,6 +279,8 @@ func (d *DebootstrapAction) Run(context *debos.Context) error {
 		if err != nil {
 			return err
 		}
+	} else if err := d.removeDebootstrapDir(*context); err != nil {
+		return err
 	}
 
 	/* HACK */
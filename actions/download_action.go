@@ -2,18 +2,45 @@
 Download Action
 
 Download a single file from Internet and unpack it in place if needed.
+Source trees may also be fetched from git repositories and root filesystems
+extracted from container images.
 
 	# Yaml syntax:
 	- action: download
 	  url: http://example.domain/path/filename.ext
+	  urls:
+	    - http://mirror.example.domain/path/filename.ext
 	  name: firmware
 	  filename: output_name
 	  unpack: bool
 	  compression: gz
+	  checksum-url: http://example.domain/path/SHA256SUMS
+	  signature-url: http://example.domain/path/SHA256SUMS.gpg
+	  keyring: vendor-keyring.gpg
+	  certificate: client.pem
+	  private-key: client.key
 
 Mandatory properties:
 
-- url -- URL to an object for download
+- url -- URL to an object for download. Supported schemes are:
+
+  - 'http://' and 'https://'
+
+  - 'file:///absolute/path' or 'file:relative/path', relative to the recipe directory,
+    for local files
+
+  - 'git+https://', 'git+http://' and 'git+file://' to clone a git repository.
+    The branch, tag or commit to check out is set as fragment, e.g.
+    'git+https://example.org/repo.git#v1.0'; the default branch is used without it.
+    The name refers to the checked out tree.
+
+  - 'oci-layout://path:tag' to extract the flattened root filesystem of a container
+    image stored in an OCI image layout directory. The path is relative to the recipe
+    directory if not absolute. Without tag the layout must contain a single image;
+    for multi-platform images the recipe architecture is used. The name refers to
+    the extracted tree.
+
+The URL is rewritten according to the '--url-rewrite' command line options.
 
 - name -- string which allow to use downloaded object in other actions
 via 'origin' property. If 'unpack' property is set to 'true' name will
@@ -21,39 +48,94 @@ refer to temporary directory with extracted content.
 
 Optional properties:
 
+- urls -- list of fallback URLs for the same object, tried in order if
+fetching from 'url' fails. Only the failure of the last URL fails the action.
+Fallbacks of git URLs must be git URLs too, and fallbacks of files must be
+files as well.
+
 - filename -- use this property as the name for saved file. Useful if URL does not
-contain file name in path, for example it is possible to download files from URLs without path part.
+contain file name in path, the name is taken from 'url' otherwise. For example it is possible to download files from URLs without path part.
 
 - unpack -- hint for action to extract all files from downloaded archive.
 See the 'Unpack' action for more information.
 
 - compression -- optional hint for unpack allowing to use proper compression method.
-See the 'Unpack' action for more information.
+Not needed normally, as the archive type and the compression are detected from the
+downloaded content. See the 'Unpack' action for more information.
+
+- include, exclude, strip-components -- select the extracted entries if 'unpack'
+is set. See the 'Unpack' action for more information.
+
+- sha256sum -- optional expected SHA256 sum of the downloaded file; provided directly as a 64 characters hexadecimal string.
+Not supported for git and OCI sources, as for 'unpack'.
+
+- sha512sum -- optional expected SHA512 sum of the downloaded file, as a 128 characters hexadecimal string.
+
+- checksum-url -- URL of a SHA256SUMS or SHA512SUMS file listing the checksum of the
+downloaded file, which is looked up by the base name of 'url'. Both the format of
+sha256sum(1) and the BSD format are supported.
+
+- signature-url -- URL of a detached OpenPGP signature of the checksum file, or of the
+downloaded file itself if 'checksum-url' isn't set. Requires 'keyring'.
+
+- keyring -- OpenPGP keyring (binary format, e.g. exported with 'gpg --export') with the
+keys trusted for 'signature-url', relative to the recipe directory. The signature is
+checked with gpgv(1), no keyserver is contacted.
+
+- certificate -- TLS client certificate stored in file for downloading from the server,
+relative to the recipe directory.
 
-- sha256sum -- optional expected SHA256 sum of the downloaded file; provided directly as a 64 characters hexadecimal string
+- private-key -- the client's private key in a file separate from the certificate.
+
+The signature and the checksums are verified before the downloaded file is used, a
+mismatch fails the action (or moves on to the next fallback URL).
+
+Failed downloads are retried with an exponential backoff and resumed if the
+server supports range requests; the number of retries and the timeouts are set
+with the '--download-*' command line options. Proxies are used as configured
+by the 'http_proxy', 'https_proxy' and 'no_proxy' environment variables. The
+file is only visible under its final name once completely downloaded.
+
+Credentials for the servers are taken from the netrc file ('--netrc', by default
+$NETRC or ~/.netrc) and from the headers file set with '--download-credentials',
+whose lines have the form 'host Header-Name: value'. Environment variables like
+${TOKEN} are expanded in the values. Credentials are only sent to their host and
+never logged.
 */
 package actions
 
 import (
-	"crypto/sha256"
+	"crypto/tls"
 	"encoding/hex"
 	"fmt"
-	"io"
 	"log"
 	"net/url"
 	"os"
+	"os/exec"
 	"path"
+	"strings"
 
 	"github.com/go-debos/debos"
+	"github.com/go-debos/fakemachine"
 )
 
 type DownloadAction struct {
 	debos.BaseAction `yaml:",inline"`
-	URL              string `yaml:"url"` // URL for downloading
-	Filename         string // File name, overrides the name from URL.
-	Unpack           bool   // Unpack downloaded file to directory dedicated for download
-	Compression      string // compression type
+	URL              string   `yaml:"url"`  // URL for downloading
+	URLs             []string `yaml:"urls"` // Fallback URLs, tried in order
+	Filename         string   // File name, overrides the name from URL.
+	Unpack           bool     // Unpack downloaded file to directory dedicated for download
+	Compression      string   // compression type
+	Include          []string
+	Exclude          []string
+	StripComponents  int    `yaml:"strip-components"`
 	Sha256sum        string // Expected SHA256 sum of the downloaded file
+	Sha512sum        string // Expected SHA512 sum of the downloaded file
+	ChecksumURL      string `yaml:"checksum-url"`  // SHA256SUMS or SHA512SUMS file
+	SignatureURL     string `yaml:"signature-url"` // Detached signature of the checksum file
+	Keyring          string // Keyring to verify the signature
+	Certificate      string // TLS client certificate
+	PrivateKey       string `yaml:"private-key"` // Key of the client certificate
 	Name             string // exporting path to file or directory(in case of unpack)
 }
 
@@ -61,14 +143,26 @@ type DownloadAction struct {
 // Return:
 // - parsed URL
 // - nil in case of success
-func (d *DownloadAction) validateURL() (*url.URL, error) {
-	url, err := url.Parse(d.URL)
+func validateURL(rawURL string) (*url.URL, error) {
+	// 'path:tag' is not a valid URL host, the tag is kept as fragment
+	if rest, ok := strings.CutPrefix(rawURL, "oci-layout:"); ok {
+		dir, tag := debos.ParseOCILayoutRef(strings.TrimPrefix(rest, "//"))
+		return &url.URL{Scheme: "oci-layout", Path: dir, Fragment: tag}, nil
+	}
+
+	url, err := url.Parse(rawURL)
 	if err != nil {
 		return url, err
 	}
 
+	// Relative local path, e.g. 'file:firmware.bin'
+	if len(url.Opaque) > 0 {
+		url.Path = url.Opaque
+		url.Opaque = ""
+	}
+
 	switch url.Scheme {
-	case "http", "https":
+	case "http", "https", "file", "git+http", "git+https", "git+file", "oci-layout":
 		// Supported scheme
 	default:
 		return url, fmt.Errorf("unsupported URL provided: '%s'", url.String())
@@ -77,6 +171,57 @@ func (d *DownloadAction) validateURL() (*url.URL, error) {
 	return url, nil
 }
 
+/*
+validateURLs returns the URL followed by the fallback URLs, rewritten
+according to the '--url-rewrite' options and checked to be of the same kind.
+*/
+func (d *DownloadAction) validateURLs(context *debos.Context) ([]*url.URL, error) {
+	var urls []*url.URL
+	for _, u := range append([]string{d.URL}, d.URLs...) {
+		parsed, err := validateURL(context.RewriteURL(u))
+		if err != nil {
+			return nil, err
+		}
+		if len(urls) > 0 && kindOfURL(parsed) != kindOfURL(urls[0]) {
+			return nil, fmt.Errorf("fallback URL '%s' can't be used for '%s'", u, d.URL)
+		}
+		urls = append(urls, parsed)
+	}
+	return urls, nil
+}
+
+// Group the URL schemes by the way they are fetched
+func kindOfURL(url *url.URL) string {
+	switch {
+	case strings.HasPrefix(url.Scheme, "git+"):
+		return "git"
+	case url.Scheme == "oci-layout":
+		return url.Scheme
+	default:
+		return "file"
+	}
+}
+
+// Check if the URL refers to a directory tree rather than to a file
+func isTreeURL(url *url.URL) bool {
+	return strings.HasPrefix(url.Scheme, "git+") || url.Scheme == "oci-layout"
+}
+
+/*
+localPath returns the path on the host for the local URL schemes, relative
+paths (e.g. 'file:firmware.bin') are relative to the recipe directory.
+*/
+func (d *DownloadAction) localPath(context *debos.Context, url *url.URL) string {
+	var p string
+	switch url.Scheme {
+	case "file", "git+file", "oci-layout":
+		p = url.Path
+	default:
+		return ""
+	}
+	return debos.CleanPathAt(p, context.RecipeDir)
+}
+
 func (d *DownloadAction) validateFilename(context *debos.Context, url *url.URL) (filename string, err error) {
 	if len(d.Filename) == 0 {
 		// Trying to guess the name from URL Path
@@ -91,6 +236,49 @@ func (d *DownloadAction) validateFilename(context *debos.Context, url *url.URL)
 	return filename, nil
 }
 
+// Parse an URL of the checksum or signature files, which must be plain files
+func (d *DownloadAction) validateFileURL(context *debos.Context, property, rawURL string) (*url.URL, error) {
+	url, err := validateURL(context.RewriteURL(rawURL))
+	if err != nil {
+		return nil, err
+	}
+	if kindOfURL(url) != "file" {
+		return nil, fmt.Errorf("'%s' URLs can't be used for property '%s'", url.Scheme, property)
+	}
+	return url, nil
+}
+
+/*
+listOptionFiles returns the local files and the URLs of the checksum and
+signature files referred by the action properties.
+*/
+func (d *DownloadAction) listOptionFiles(context *debos.Context) ([]string, []*url.URL, error) {
+	var files []string
+	var urls []*url.URL
+
+	for _, file := range []string{d.Keyring, d.Certificate, d.PrivateKey} {
+		if file != "" {
+			files = append(files, debos.CleanPathAt(file, context.RecipeDir))
+		}
+	}
+
+	for _, p := range []struct{ property, url string }{
+		{"checksum-url", d.ChecksumURL},
+		{"signature-url", d.SignatureURL},
+	} {
+		if p.url == "" {
+			continue
+		}
+		url, err := d.validateFileURL(context, p.property, p.url)
+		if err != nil {
+			return nil, nil, err
+		}
+		urls = append(urls, url)
+	}
+
+	return files, urls, nil
+}
+
 func (d *DownloadAction) archive(filename string) (debos.Archive, error) {
 	archive, err := debos.NewArchive(filename)
 	if err != nil {
@@ -103,8 +291,17 @@ func (d *DownloadAction) archive(filename string) (debos.Archive, error) {
 				return archive, err
 			}
 		}
+	case debos.Cpio:
+		if len(d.Compression) > 0 {
+			if err := archive.AddOption("compression", d.Compression); err != nil {
+				return archive, err
+			}
+		}
 	default:
 	}
+	if err := addUnpackFilter(archive, d.Include, d.Exclude, d.StripComponents); err != nil {
+		return archive, err
+	}
 	return archive, nil
 }
 
@@ -115,73 +312,391 @@ func (d *DownloadAction) Verify(context *debos.Context) error {
 		return fmt.Errorf("property 'name' is mandatory for download action")
 	}
 
-	url, err := d.validateURL()
+	urls, err := d.validateURLs(context)
+	if err != nil {
+		return err
+	}
+	filename, err = d.validateFilename(context, urls[0])
 	if err != nil {
 		return err
 	}
-	filename, err = d.validateFilename(context, url)
+	if isTreeURL(urls[0]) && (d.Unpack || len(d.Sha256sum) > 0) {
+		return fmt.Errorf("properties 'unpack' and 'sha256sum' can't be used with '%s' URLs", urls[0].Scheme)
+	}
+	if isTreeURL(urls[0]) && (len(d.Sha512sum) > 0 || len(d.ChecksumURL) > 0 || len(d.SignatureURL) > 0) {
+		return fmt.Errorf("properties 'sha512sum', 'checksum-url' and 'signature-url' can't be used with '%s' URLs", urls[0].Scheme)
+	}
+	if len(d.SignatureURL) > 0 && len(d.Keyring) == 0 {
+		return fmt.Errorf("property 'keyring' is mandatory with 'signature-url'")
+	}
+	if len(d.PrivateKey) > 0 && len(d.Certificate) == 0 {
+		return fmt.Errorf("property 'private-key' requires 'certificate'")
+	}
+
+	files, optionURLs, err := d.listOptionFiles(context)
 	if err != nil {
 		return err
 	}
+	for _, f := range files {
+		if _, err := os.Stat(f); err != nil {
+			return err
+		}
+	}
+
+	for _, url := range append(urls, optionURLs...) {
+		if url.Scheme == "file" || url.Scheme == "git+file" {
+			if len(url.Host) > 0 && url.Host != "localhost" {
+				return fmt.Errorf("remote host in '%s' isn't supported", url.String())
+			}
+		}
+	}
 	if d.Unpack {
 		if _, err := d.archive(filename); err != nil {
 			return err
 		}
 	}
-	if len(d.Sha256sum) > 0 {
-		if len(d.Sha256sum) != 64 {
-			return fmt.Errorf("invalid length for property 'sha256sum'; expected 64 characters, got %d", len(d.Sha256sum))
+	for _, sum := range []struct {
+		property string
+		value    string
+		length   int
+	}{
+		{"sha256sum", d.Sha256sum, 64},
+		{"sha512sum", d.Sha512sum, 128},
+	} {
+		if len(sum.value) == 0 {
+			continue
+		}
+		if len(sum.value) != sum.length {
+			return fmt.Errorf("invalid length for property '%s'; expected %d characters, got %d", sum.property, sum.length, len(sum.value))
 		}
-		_, err := hex.DecodeString(d.Sha256sum)
+		_, err := hex.DecodeString(sum.value)
 		if err != nil {
-			return fmt.Errorf("invalid characters in 'sha256sum' property: %w", err)
+			return fmt.Errorf("invalid characters in '%s' property: %w", sum.property, err)
 		}
 	}
 	return nil
 }
 
-func (d *DownloadAction) Run(context *debos.Context) error {
-	var filename string
-
-	url, err := d.validateURL()
+func (d *DownloadAction) PreMachine(context *debos.Context, m *fakemachine.Machine, _ *[]string) error {
+	urls, err := d.validateURLs(context)
 	if err != nil {
 		return err
 	}
 
-	filename, err = d.validateFilename(context, url)
+	files, optionURLs, err := d.listOptionFiles(context)
 	if err != nil {
 		return err
 	}
-	originPath := filename
+	for _, f := range files {
+		m.AddVolume(path.Dir(f))
+	}
+
+	// Make local sources available in the fake machine
+	for _, url := range append(urls, optionURLs...) {
+		switch url.Scheme {
+		case "file":
+			m.AddVolume(path.Dir(d.localPath(context, url)))
+		case "git+file", "oci-layout":
+			m.AddVolume(d.localPath(context, url))
+		}
+	}
+	return nil
+}
+
+/*
+fetchGit clones the repository to dir and checks out the ref set as URL
+fragment, e.g. 'git+https://example.org/repo.git#v1.0'. The default
+branch is used without ref.
+*/
+func (d *DownloadAction) fetchGit(context *debos.Context, url *url.URL, dir string) error {
+	ref := url.Fragment
+	if len(ref) == 0 {
+		ref = "HEAD"
+	}
+
+	repo := *url
+	repo.Scheme = strings.TrimPrefix(url.Scheme, "git+")
+	repo.Fragment = ""
+	if repo.Scheme == "file" {
+		repo.Path = d.localPath(context, url)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := (debos.Command{}).Run("git clone", "git", "clone", "--quiet", "--no-checkout", repo.String(), dir); err != nil {
+		return err
+	}
+
+	// Branches only exist as remote branches after the clone
+	var commit string
+	for _, candidate := range []string{ref, "origin/" + ref} {
+		out, err := exec.Command("git", "-C", dir, "rev-parse", "--verify", "--quiet", candidate+"^{commit}").Output()
+		if err == nil {
+			commit = strings.TrimSpace(string(out))
+			break
+		}
+	}
+	if len(commit) == 0 {
+		return fmt.Errorf("ref '%s' not found in '%s'", ref, repo.String())
+	}
 
+	log.Printf("Checking out %s (%s) from '%s'", ref, commit, repo.String())
+	return debos.Command{}.Run("git checkout", "git", "-C", dir, "checkout", "--quiet", "--detach", commit)
+}
+
+// Settings of the downloader, with the client certificate of the action
+func (d *DownloadAction) downloadConfig(context *debos.Context) (debos.DownloadConfig, error) {
+	config := context.Download
+	if d.Certificate == "" {
+		return config, nil
+	}
+
+	certificate := debos.CleanPathAt(d.Certificate, context.RecipeDir)
+	key := certificate
+	if d.PrivateKey != "" {
+		key = debos.CleanPathAt(d.PrivateKey, context.RecipeDir)
+	}
+	pair, err := tls.LoadX509KeyPair(certificate, key)
+	if err != nil {
+		return config, fmt.Errorf("failed to load client certificate: %w", err)
+	}
+	config.Certificates = []tls.Certificate{pair}
+	return config, nil
+}
+
+// Fetch a plain file, either downloaded or copied from a local path
+func (d *DownloadAction) fetchFile(context *debos.Context, url *url.URL, filename string) error {
 	switch url.Scheme {
 	case "http", "https":
-		err := debos.DownloadHTTPURL(url.String(), filename)
+		config, err := d.downloadConfig(context)
 		if err != nil {
 			return err
 		}
+		return debos.NewDownloader(config).Download(url.String(), filename)
+	case "file":
+		source := d.localPath(context, url)
+		log.Printf("Copying '%s' -> '%s'\n", source, filename)
+		return debos.CopyFile(source, filename, 0644)
 	default:
 		return fmt.Errorf("unsupported URL provided: '%s'", url.String())
 	}
+}
+
+/*
+checksums returns the expected checksums of the downloaded file: the sums
+set in the recipe and the one listed in the checksum file, whose signature
+is verified first.
+*/
+func (d *DownloadAction) checksums(context *debos.Context, source *url.URL, filename string) ([]debos.Checksum, error) {
+	var checksums []debos.Checksum
+	if len(d.Sha256sum) > 0 {
+		checksums = append(checksums, debos.Checksum{Algorithm: "sha256", Sum: strings.ToLower(d.Sha256sum)})
+	}
+	if len(d.Sha512sum) > 0 {
+		checksums = append(checksums, debos.Checksum{Algorithm: "sha512", Sum: strings.ToLower(d.Sha512sum)})
+	}
+	if len(d.ChecksumURL) == 0 {
+		return checksums, nil
+	}
 
-	file, err := os.Open(filename)
+	url, err := d.validateFileURL(context, "checksum-url", d.ChecksumURL)
 	if err != nil {
-		return fmt.Errorf("failed to open downloaded file %s: %w", filename, err)
+		return nil, err
+	}
+	sumsFile := filename + ".sums"
+	if err := d.fetchFile(context, url, sumsFile); err != nil {
+		return nil, err
 	}
-	defer file.Close()
-	hasher := sha256.New()
-	_, err = io.Copy(hasher, file)
+	defer os.Remove(sumsFile)
+	if len(d.SignatureURL) > 0 {
+		if err := d.verifySignature(context, sumsFile); err != nil {
+			return nil, err
+		}
+	}
+
+	// The listed name is the upstream one, not the one set by 'filename'
+	checksum, err := debos.FindChecksum(sumsFile, path.Base(source.Path))
 	if err != nil {
-		return fmt.Errorf("failed to hash file %s: %w", filename, err)
+		return nil, err
 	}
+	return append(checksums, checksum), nil
+}
 
-	actualSha256sum := hex.EncodeToString(hasher.Sum(nil))
+// Fetch the detached signature of file and check it against the keyring
+func (d *DownloadAction) verifySignature(context *debos.Context, file string) error {
+	url, err := d.validateFileURL(context, "signature-url", d.SignatureURL)
+	if err != nil {
+		return err
+	}
+	signature := file + ".sig"
+	if err := d.fetchFile(context, url, signature); err != nil {
+		return err
+	}
+	defer os.Remove(signature)
+
+	keyring := debos.CleanPathAt(d.Keyring, context.RecipeDir)
+	if err := debos.VerifySignature(keyring, signature, file); err != nil {
+		return err
+	}
+	log.Printf("Verified signature of '%s'", path.Base(file))
+	return nil
+}
+
+// Download the file and check its checksums and signature
+func (d *DownloadAction) download(context *debos.Context, url *url.URL, filename string, checksums []debos.Checksum) error {
+	if err := d.fetchFile(context, url, filename); err != nil {
+		return err
+	}
+
+	actualSha256sum, err := debos.FileSha256(filename)
+	if err != nil {
+		return fmt.Errorf("failed to hash file %s: %w", filename, err)
+	}
 	log.Printf("Downloaded file '%s': sha256sum = %s", filename, actualSha256sum)
 
-	if len(d.Sha256sum) > 0 {
-		if actualSha256sum != d.Sha256sum {
+	for _, checksum := range checksums {
+		if err := checksum.Check(filename); err != nil {
 			os.Remove(filename)
-			return fmt.Errorf("SHA256 sum mismatch for %s. Expected %s but got %s", filename, d.Sha256sum, actualSha256sum)
+			return err
+		}
+	}
+
+	// Without checksum file the signature is for the file itself
+	if len(d.SignatureURL) > 0 && len(d.ChecksumURL) == 0 {
+		if err := d.verifySignature(context, filename); err != nil {
+			os.Remove(filename)
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+fetch tries the URLs in order until one succeeds, it returns the URL
+the object was fetched from.
+*/
+func (d *DownloadAction) fetch(urls []*url.URL, fetcher func(*url.URL) error) (*url.URL, error) {
+	var err error
+	for i, url := range urls {
+		err = fetcher(url)
+		if err == nil {
+			return url, nil
+		}
+		if i < len(urls)-1 {
+			log.Printf("Failed to fetch '%s': %v; trying '%s'\n", url.String(), err, urls[i+1].String())
+		}
+	}
+	return nil, err
+}
+
+func (d *DownloadAction) Run(context *debos.Context) error {
+	var filename string
+
+	urls, err := d.validateURLs(context)
+	if err != nil {
+		return err
+	}
+
+	filename, err = d.validateFilename(context, urls[0])
+	if err != nil {
+		return err
+	}
+	originPath := filename
+
+	switch kindOfURL(urls[0]) {
+	case "git":
+		_, err := d.fetch(urls, func(url *url.URL) error {
+			return d.fetchGit(context, url, filename)
+		})
+		if err != nil {
+			return err
+		}
+		context.Origins[d.Name] = filename
+		return nil
+	case "oci-layout":
+		_, err := d.fetch(urls, func(url *url.URL) error {
+			layout := d.localPath(context, url)
+			log.Printf("Extracting image '%s' from OCI layout %s\n", url.Fragment, layout)
+			if err := os.RemoveAll(filename); err != nil {
+				return err
+			}
+			return debos.UnpackOCILayout(layout, url.Fragment, context.Architecture, filename)
+		})
+		if err != nil {
+			return err
+		}
+		context.Origins[d.Name] = filename
+		return nil
+	}
+
+	var cache *debos.DownloadCache
+	if len(context.Downloaddir) > 0 {
+		cache, err = debos.NewDownloadCache(context.Downloaddir)
+		if err != nil {
+			return err
+		}
+	}
+
+	checksums, err := d.checksums(context, urls[0], filename)
+	if err != nil {
+		return err
+	}
+
+	cached := false
+	if urls[0].Scheme == "file" {
+		// Nothing to gain from caching local files
+		cache = nil
+	}
+	// Cached files are looked up by their sha256 sum, which may come from the checksum file
+	var sha256sum string
+	for _, c := range checksums {
+		if c.Algorithm == "sha256" {
+			sha256sum = c.Sum
+		}
+	}
+	// Otherwise the last download from the URLs is used if it matches the other sums
+	for _, url := range urls {
+		if cache == nil || len(sha256sum) > 0 || len(checksums) == 0 {
+			break
+		}
+		sha256sum = cache.Lookup(url.String())
+	}
+	if cache != nil && len(sha256sum) > 0 {
+		cached, err = cache.Fetch(sha256sum, filename)
+		if err != nil {
+			return fmt.Errorf("failed to use cached download: %w", err)
+		}
+		for _, c := range checksums {
+			if cached && c.Check(filename) != nil {
+				cached = false
+			}
+		}
+	}
+	if cached {
+		log.Printf("Using cached file for '%s' (sha256sum = %s)", d.URL, sha256sum)
+		if len(d.SignatureURL) > 0 && len(d.ChecksumURL) == 0 {
+			if err := d.verifySignature(context, filename); err != nil {
+				return err
+			}
+		}
+	} else {
+		url, err := d.fetch(urls, func(url *url.URL) error {
+			return d.download(context, url, filename, checksums)
+		})
+		if err != nil {
+			return err
+		}
+
+		if cache != nil {
+			sum, err := debos.FileSha256(filename)
+			if err != nil {
+				return err
+			}
+			if err := cache.Store(url.String(), filename, sum); err != nil {
+				return fmt.Errorf("failed to store download in cache: %w", err)
+			}
 		}
 	}
 
@@ -2,10 +2,13 @@ package actions_test
 
 import (
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"os/exec"
+	"path"
 	"testing"
 
 	"github.com/go-debos/debos"
@@ -113,3 +116,202 @@ func TestDownloadActionSha256sum(t *testing.T) {
 	_, err = os.Stat(downloadedPath5)
 	assert.NoError(t, err, "Downloaded file should exist")
 }
+
+func TestDownloadActionCache(t *testing.T) {
+	content := []byte("cached content")
+	hasher := sha256.New()
+	hasher.Write(content)
+	sha256sum := hex.EncodeToString(hasher.Sum(nil))
+
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		requests++
+		_, _ = w.Write(content)
+	}))
+	defer ts.Close()
+
+	cachedir := t.TempDir()
+	newContext := func() *debos.Context {
+		return &debos.Context{
+			CommonContext: &debos.CommonContext{
+				Origins:     make(map[string]string),
+				Scratchdir:  t.TempDir(),
+				Downloaddir: cachedir,
+			},
+		}
+	}
+
+	action := actions.DownloadAction{
+		URL:       ts.URL + "/file",
+		Name:      "file",
+		Sha256sum: sha256sum,
+	}
+	assert.NoError(t, action.Run(newContext()))
+	assert.Equal(t, 1, requests)
+
+	// Second build is served from the cache
+	ts.Close()
+	context := newContext()
+	assert.NoError(t, action.Run(context))
+	data, err := os.ReadFile(context.Origins["file"])
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+
+	cache, err := debos.NewDownloadCache(cachedir)
+	assert.NoError(t, err)
+	removed, freed, err := cache.Prune(0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	assert.Equal(t, int64(len(content)), freed)
+}
+
+func TestDownloadActionLocal(t *testing.T) {
+	recipedir := t.TempDir()
+	assert.NoError(t, os.WriteFile(path.Join(recipedir, "firmware.bin"), []byte("firmware"), 0644))
+
+	context := &debos.Context{
+		CommonContext: &debos.CommonContext{
+			Origins:    make(map[string]string),
+			Scratchdir: t.TempDir(),
+		},
+		RecipeDir: recipedir,
+	}
+
+	file := actions.DownloadAction{URL: "file:firmware.bin", Name: "firmware"}
+	assert.NoError(t, file.Verify(context))
+	assert.NoError(t, file.Run(context))
+	data, err := os.ReadFile(context.Origins["firmware"])
+	assert.NoError(t, err)
+	assert.Equal(t, "firmware", string(data))
+
+	// Git repository with two commits, the first one tagged
+	repo := path.Join(recipedir, "repo")
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-C", repo, "-c", "user.name=debos", "-c", "user.email=debos@example.org"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		assert.NoError(t, err, string(out))
+	}
+	assert.NoError(t, os.MkdirAll(repo, 0755))
+	git("init", "--quiet")
+	assert.NoError(t, os.WriteFile(path.Join(repo, "version"), []byte("1"), 0644))
+	git("add", "version")
+	git("commit", "--quiet", "-m", "v1")
+	git("tag", "v1")
+	assert.NoError(t, os.WriteFile(path.Join(repo, "version"), []byte("2"), 0644))
+	git("commit", "--quiet", "-a", "-m", "v2")
+
+	source := actions.DownloadAction{URL: "git+file://" + repo + "#v1", Name: "source"}
+	assert.NoError(t, source.Verify(context))
+	assert.NoError(t, source.Run(context))
+	data, err = os.ReadFile(path.Join(context.Origins["source"], "version"))
+	assert.NoError(t, err)
+	assert.Equal(t, "1", string(data))
+
+	source.URL = "git+file://" + repo + "#missing"
+	assert.ErrorContains(t, source.Run(context), "ref 'missing' not found")
+
+	source.Unpack = true
+	assert.EqualError(t, source.Verify(context), "properties 'unpack' and 'sha256sum' can't be used with 'git+file' URLs")
+}
+
+func TestDownloadActionFallback(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/mirror/file" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte("mirrored"))
+	}))
+	defer ts.Close()
+
+	context := &debos.Context{
+		CommonContext: &debos.CommonContext{
+			Origins:    make(map[string]string),
+			Scratchdir: t.TempDir(),
+			Download:   debos.DownloadConfig{Retries: -1},
+		},
+	}
+
+	action := actions.DownloadAction{
+		URL:  ts.URL + "/missing/file",
+		URLs: []string{ts.URL + "/mirror/file"},
+		Name: "file",
+	}
+	assert.NoError(t, action.Verify(context))
+	assert.NoError(t, action.Run(context))
+	data, err := os.ReadFile(context.Origins["file"])
+	assert.NoError(t, err)
+	assert.Equal(t, "mirrored", string(data))
+
+	// The primary URL is redirected to the mirror
+	context.URLRewrites = []debos.URLRewrite{
+		{From: "http://upstream.invalid/", To: ts.URL + "/missing/"},
+		{From: "http://upstream.invalid/pool/", To: ts.URL + "/mirror/"},
+	}
+	action = actions.DownloadAction{URL: "http://upstream.invalid/pool/file", Name: "rewritten"}
+	assert.NoError(t, action.Run(context))
+	data, err = os.ReadFile(context.Origins["rewritten"])
+	assert.NoError(t, err)
+	assert.Equal(t, "mirrored", string(data))
+
+	action = actions.DownloadAction{URL: ts.URL + "/file", URLs: []string{"git+https://example.org/repo.git"}, Name: "mixed"}
+	assert.ErrorContains(t, action.Verify(context), "can't be used for")
+}
+
+func TestDownloadActionSignature(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg not available")
+	}
+
+	recipedir := t.TempDir()
+	content := []byte("signed content")
+	assert.NoError(t, os.WriteFile(path.Join(recipedir, "artifact.bin"), content, 0644))
+	sum512 := sha512.Sum512(content)
+	sums := hex.EncodeToString(sum512[:]) + " *artifact.bin\n"
+	assert.NoError(t, os.WriteFile(path.Join(recipedir, "SHA512SUMS"), []byte(sums), 0644))
+
+	// Throwaway signing key
+	gnupghome := t.TempDir()
+	gpg := func(args ...string) {
+		cmd := exec.Command("gpg", append([]string{"--homedir", gnupghome, "--batch", "--quiet", "--pinentry-mode", "loopback", "--passphrase", ""}, args...)...)
+		out, err := cmd.CombinedOutput()
+		assert.NoError(t, err, string(out))
+	}
+	gpg("--quick-gen-key", "debos-test@example.org", "ed25519", "sign", "never")
+	gpg("--output", path.Join(recipedir, "keyring.gpg"), "--export", "debos-test@example.org")
+	gpg("--output", path.Join(recipedir, "SHA512SUMS.gpg"), "--detach-sign", path.Join(recipedir, "SHA512SUMS"))
+
+	context := &debos.Context{
+		CommonContext: &debos.CommonContext{
+			Origins:    make(map[string]string),
+			Scratchdir: t.TempDir(),
+		},
+		RecipeDir: recipedir,
+	}
+
+	action := actions.DownloadAction{
+		URL:          "file:artifact.bin",
+		Name:         "artifact",
+		ChecksumURL:  "file:SHA512SUMS",
+		SignatureURL: "file:SHA512SUMS.gpg",
+		Keyring:      "keyring.gpg",
+	}
+	assert.NoError(t, action.Verify(context))
+	assert.NoError(t, action.Run(context))
+	data, err := os.ReadFile(context.Origins["artifact"])
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+
+	// Checksum file modified after signing
+	assert.NoError(t, os.WriteFile(path.Join(recipedir, "SHA512SUMS"), []byte(sums+"\n"), 0644))
+	assert.ErrorContains(t, action.Run(context), "signature verification of artifact.bin.sums failed")
+
+	// Unsigned checksum not matching the file
+	action = actions.DownloadAction{URL: "file:artifact.bin", Name: "artifact", ChecksumURL: "file:SHA512SUMS"}
+	assert.NoError(t, os.WriteFile(path.Join(recipedir, "artifact.bin"), []byte("tampered"), 0644))
+	assert.ErrorContains(t, action.Run(context), "SHA512 sum mismatch")
+
+	action.SignatureURL = "file:SHA512SUMS.gpg"
+	action.Keyring = ""
+	assert.EqualError(t, action.Verify(context), "property 'keyring' is mandatory with 'signature-url'")
+}
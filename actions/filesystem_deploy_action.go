@@ -18,7 +18,8 @@ image.
 Optional properties:
 
 - setup-fstab -- generate '/etc/fstab' file according to information provided
-by 'image-partition' action. By default is 'true'.
+by 'image-partition' action, and '/etc/crypttab' if partitions are encrypted.
+By default is 'true'.
 
 - setup-kernel-cmdline -- add location of root partition to '/etc/kernel/cmdline'
 file on target image. By default is 'true'.
@@ -78,6 +79,15 @@ func (fd *FilesystemDeployAction) setupFSTab(context *debos.Context) error {
 		return fmt.Errorf("couldn't write /etc/fstab: %w", err)
 	}
 
+	if context.ImageCrypttab.Len() > 0 {
+		log.Print("Setting up /etc/crypttab")
+
+		crypttab := path.Join(context.Rootdir, "etc/crypttab")
+		if err := os.WriteFile(crypttab, context.ImageCrypttab.Bytes(), 0644); err != nil {
+			return fmt.Errorf("couldn't write /etc/crypttab: %w", err)
+		}
+	}
+
 	return nil
 }
 
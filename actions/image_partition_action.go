@@ -11,11 +11,20 @@ order in the recipe does not matter.
 	- action: image-partition
 	  imagename: image_name
 	  imagesize: size
+	  padding: size
+	  min: size
 	  partitiontype: gpt
 	  diskid: string
-	  gpt_gap: offset
+	  gpt_entries_offset: offset
+	  gpt_entries: number
+	  align: size
+	  rootless: bool
+	  discoverable: bool
+	  gpt_auto: bool
 	  partitions:
 	    <list of partitions>
+	  volumegroup:
+	    <volume group properties>
 	  mountpoints:
 	    <list of mount points>
 
@@ -24,16 +33,18 @@ Mandatory properties:
 - imagename -- the name of the image file, relative to the artifact directory.
 
 - imagesize -- generated image size in human-readable form, examples: 100MB, 1GB, etc.
+With 'auto', the image is just big enough for its partitions, the growing
+partition being sized from its content like partitions of 'auto' size. The
+partitions offsets can't then be relative to the end of the disk.
 
 - partitiontype -- partition table type. Currently only 'gpt' and 'msdos'
-partition tables are supported.
-
-- gpt_gap -- shifting GPT allow to use this gap for bootloaders, for example if
-U-Boot intersects with original GPT placement.
-Only works if parted supports an extra argument to mklabel to specify the gpt offset.
+partition tables are supported. For 'msdos' partition tables with more than 4
+partitions, the fourth and following partitions are created as logical
+partitions in an extended partition.
 
 - partitions -- list of partitions, at least one partition is needed.
-Partition properties are described below.
+Partition properties are described below. The computed layout of the partitions
+is shown with '--print-recipe'.
 
 - mountpoints -- list of mount points for partitions.
 Properties for mount points are described below.
@@ -45,14 +56,72 @@ should be in GUID format (e.g.: '00002222-4444-6666-AAAA-BBBBCCCCFFFF' where eac
 character is an hexadecimal digit). For 'msdos' partition table, 'diskid' should be
 a 32 bits hexadecimal number (e.g. '1234ABCD' without any dash separator).
 
+- gpt_entries_offset -- offset of the GPT partition entries from the start of
+the disk, in human readable form, right after the GPT header by default.
+Shifting the partition entries allows to use the space before them for
+bootloaders, for example if U-Boot intersects with original GPT placement. E.g.
+the partition entries start at sector 2048 for a '1MiB' offset with 512 bytes
+sectors. It replaces the former 'gpt_gap' property, which relied on a patched
+parted(8) and is rejected.
+
+- gpt_entries -- number of entries of the GPT partition entries array, 128 by
+default. Less entries leave the partitions more space at the start of the disk.
+
+- padding -- free space added to the partitions sized from their content, in
+human readable form.
+
+- min -- minimal size of an image of 'auto' size, in human readable form. The
+growing partition fills the image up to this size.
+
+- align -- alignment of the partitions without 'start' property, in human
+readable form. Defaults to 1MiB.
+
+- rootless -- assemble the image without loop devices nor mounting the
+partitions, so the image can be built without privileges, e.g. in a container or
+in CI without /dev/kvm. The mountpoints are plain directories until the end of
+the recipe, when each partition is formatted as a standalone file populated
+with the content of its mountpoint (using 'mke2fs -d', 'mkfs.vfat' and 'mcopy',
+'mkfs.btrfs --rootdir', 'mkfs.erofs' or 'mksquashfs') and written to the image.
+The ownership of the files is kept, so the recipe still needs to run as root
+(or e.g. under fakeroot) to get root owned files. Only the ext2, ext3, ext4,
+btrfs, fat, erofs, squashfs and swap filesystems are supported. Actions
+writing to a partition device (e.g. 'raw' with 'partition') write to the
+partition file, which for formatted partitions is overwritten at the end.
+Defaults to false.
+
+- discoverable -- set the GPT partition types following the Discoverable
+Partitions Specification, from the mountpoints of the partitions and the
+architecture of the recipe: root and '/usr' partitions of the architecture (for
+amd64, arm64, armel, armhf, i386 and riscv64), '/home', '/srv', '/var' and
+'/var/tmp' partitions, EFI system partition mounted as '/efi' or '/boot/efi',
+extended boot loader partition mounted as '/boot' (or EFI system partition, if
+it is a FAT one and neither '/efi' nor '/boot/efi' are mountpoints), and verity
+hash partitions of the root and '/usr' partitions (for amd64 and arm64).
+Partitions with a 'parttype' or a flag setting the type keep it. Only supported
+for 'gpt' partition tables. Defaults to false. See
+https://uapi-group.org/specifications/specs/discoverable_partitions_specification/
+
+- gpt_auto -- don't add to the fstab the partitions mounted at boot by
+systemd-gpt-auto-generator(8) from their type, i.e. the root, '/usr', '/home'
+and '/srv' partitions, the EFI system partition mounted as '/efi' or '/boot',
+the extended boot loader partition mounted as '/boot' and the swap partitions.
+Their mountpoint options are then not used. '/var' partitions are kept, as they
+are only discovered if their partition UUID is derived from the machine ID.
+Usually used with 'discoverable'. Only supported for 'gpt' partition tables.
+Defaults to false.
+
 	   # Yaml syntax for partitions:
 	   partitions:
 	     - name: partition name
 		   partlabel: partition label
 		   fs: filesystem
 		   fslabel: filesystem label
+		   source: path
+		   origin: name
 		   start: offset
 		   end: offset
+		   size: size
+		   grow: bool
 		   features: list of filesystem features
 		   extendedoptions: list of filesystem extended options
 		   flags: list of flags
@@ -60,6 +129,12 @@ a 32 bits hexadecimal number (e.g. '1234ABCD' without any dash separator).
 		   fsuuid: string
 		   partuuid: string
 		   partattrs: list of partition attribute bits to set
+		   encryption:
+		     <encryption properties>
+		   subvolumes:
+		     <list of btrfs subvolumes>
+		   verity:
+		     <verity properties>
 
 Mandatory properties:
 
@@ -67,19 +142,58 @@ Mandatory properties:
 configuration (below) and label the filesystem located on this partition. Must be
 unique.
 
-- fs -- filesystem type used for formatting.
+- fs -- filesystem type used for formatting. The read-only 'erofs' and
+'squashfs' filesystems are generated at the end of the recipe, once the root
+filesystem is complete, from the content of their mountpoint or of their
+'source'. The content of their mountpoint is then removed from the filesystem
+it is in, which needs room for it during the build. They are mounted read-only,
+and if mounted as '/' or '/usr', the 'rootfstype' or 'mount.usr' kernel command
+line arguments are set.
 
-'none' fs type should be used for partition without filesystem.
+'swap' fs type creates a swap partition with mkswap(8), which can't have a
+mountpoint and is added to the fstab.
 
-- start -- offset from beginning of the disk there the partition starts.
+'none' fs type should be used for partition without filesystem.
 
-- end -- offset from beginning of the disk there the partition ends.
+- end or size -- offset from beginning of the disk there the partition ends, or
+size of the partition. The last partition can instead grow up to the end of the
+disk.
 
 For 'start' and 'end' properties offset can be written in human readable
-form -- '32MB', '1GB' or as disk percentage -- '100%'.
+form -- '32MB', '1GB', in sectors -- '2048s' or as disk percentage -- '100%'.
+Negative offsets are counted from the end of the disk, e.g. '-1s' is the last
+sector. The partition table is written by debos itself, placing the partitions
+like parted(8) does: a partition ends right before an offset in binary units
+(e.g. '64MiB'), and at the sector of other offsets. A partition starting on the
+last sector of the previous one is moved right after it (and after the extended
+boot record for logical partitions). Partitions reaching the start or the end of
+the disk with a percentage or decimal offset (e.g. '0%' or '1GB') are shrunk to
+the sectors not used by the partition table, offsets in sectors or binary units
+have to be outside of it.
 
 Optional properties:
 
+- start -- offset from beginning of the disk there the partition starts. By
+default the partition starts after the previous one, at the next sector aligned
+on the 'align' property of the action.
+
+- size -- size of the partition, in human readable form, in sectors or as disk
+percentage, instead of its end. With 'auto', the size is estimated from the
+content of the mountpoints of the partition in the root filesystem, plus the
+'padding' of the action. The sizes are computed when the action runs, so
+content added to the partition by later actions must fit in the padding.
+
+- grow -- if set to true, the partition ends at the end of the disk. Only the
+last partition can grow, a size can be set as the minimal size of the partition.
+
+- source -- path of the content of a read-only 'erofs' or 'squashfs'
+filesystem, instead of the content of its mountpoint. The path is relative to
+the root filesystem, or to the path referenced by 'origin'. The content is
+copied, not removed from the root filesystem.
+
+- origin -- reference to a named file or directory holding the 'source' of a
+read-only filesystem, e.g. 'artifacts'.
+
 - partlabel -- label for the partition in the GPT partition table. Defaults
 to the `name` property of the partition. May only be used for GPT partitions.
 
@@ -93,7 +207,10 @@ long for xfs.
 be in a hexadecimal format (2-characters) for msdos partition tables and GUID format
 (36-characters) for GPT partition tables. For instance, "82" for msdos sets the
 partition type to Linux Swap. Whereas "0657fd6d-a4ab-43c4-84e5-0933c84b4f4f" for
-GPT sets the partition type to Linux Swap.
+GPT sets the partition type to Linux Swap. By default the type is chosen from
+the filesystem: Microsoft basic data (FAT LBA for msdos) for FAT filesystems,
+Apple HFS for HFS filesystems, Linux swap for swap and Linux filesystem
+otherwise, or from the mountpoint with the 'discoverable' property.
 For msdos partition types hex codes see: https://en.wikipedia.org/wiki/Partition_type
 For gpt partition type GUIDs see: https://systemd.io/DISCOVERABLE_PARTITIONS/
 
@@ -101,7 +218,13 @@ For gpt partition type GUIDs see: https://systemd.io/DISCOVERABLE_PARTITIONS/
 for partition.
 
 - flags -- list of additional flags for partition compatible with parted(8)
-'set' command.
+'set' command. For 'gpt' partition tables the supported flags are 'boot' and
+'esp' (EFI system partition), 'bios_grub', 'bls_boot', 'chromeos_kernel',
+'diag', 'hp-service', 'irst', 'linux-home', 'lvm', 'msftdata', 'msftres',
+'prep', 'raid' and 'swap', setting the partition type, and 'legacy_boot' and
+'no_automount', setting partition attributes. For 'msdos' partition tables the
+supported flags are 'boot', 'diag', 'esp', 'hidden', 'irst', 'lba', 'lvm',
+'palo', 'prep', 'raid' and 'swap'.
 
 - partattrs -- list of GPT partition attribute bits to set, as defined in
 https://uefi.org/specs/UEFI/2.10/05_GUID_Partition_Table_Format.html#defined-gpt-partition-entry-attributes.
@@ -117,7 +240,7 @@ be able to boot a ChromeOS Kernel partition on a Chromebook, like so:
 checks in boot time. By default is set to `true` allowing checks on boot.
 
 - fsuuid -- file system UUID string. This option is only supported for btrfs,
-ext2, ext3, ext4 and xfs.
+erofs, ext2, ext3, ext4, fat, swap and xfs.
 
 - partuuid -- GPT partition UUID string.
 A version 5 UUID can be easily generated using the uuid5 template function
@@ -128,6 +251,112 @@ and data.
 - extendedoptions -- list of additional filesystem extended options which need
 to be enabled for the partition.
 
+- encryption -- encrypt the partition with LUKS2 (using cryptsetup(8)). The
+filesystem is created on the opened encrypted device, which is used for the
+mountpoints during the build, and an '/etc/crypttab' entry is generated along
+the fstab. If the partition holds '/', directly or as an LVM physical volume,
+the kernel command line 'rd.luks.name' argument is added to open it at boot.
+Encryption isn't supported in rootless mode. Encryption properties are described
+below.
+
+	# Yaml syntax for encryption:
+	encryption:
+	  name: mapped device name
+	  keyfile: path
+	  key: key
+	  passphrase: passphrase
+	  cipher: cipher
+	  options: list of crypttab options
+
+Mandatory properties, one of:
+
+- keyfile -- file holding the key of the partition, relative to the recipe
+directory.
+
+- key -- key of the partition, meant to be passed as a secret variable with
+'--secret-var', e.g. 'key: {{ .datakey }}'.
+
+Optional properties:
+
+- name -- name of the opened device, under /dev/mapper. Defaults to the
+partition name followed by '_crypt'.
+
+- passphrase -- additional passphrase of the partition, e.g. to unlock it at
+boot. It is masked in the output like secret variables.
+
+- cipher -- cipher of the partition, defaults to the cryptsetup default.
+
+- options -- list of options of the crypttab entry. The key of the crypttab
+entry is 'none', so the passphrase is asked at boot unless the options say
+otherwise (e.g. 'tpm2-device=auto').
+
+- subvolumes -- list of subvolumes of a btrfs filesystem, created after
+formatting it. Subvolumes with a mountpoint are mounted during the build like
+the mountpoints of the action, and added to the fstab with the 'subvol' option.
+If '/' is a subvolume, the kernel command line 'rootflags' argument is set to
+mount it at boot. Subvolumes aren't supported in rootless mode. Subvolume
+properties are described below.
+
+	# Yaml syntax for subvolumes:
+	subvolumes:
+	  - name: path
+	    mountpoint: path
+	    options: list of options
+	    default: bool
+
+Mandatory properties:
+
+- name -- path of the subvolume in the filesystem, e.g. '@home'. Subvolumes
+can be nested, e.g. '@/var/log'.
+
+Optional properties:
+
+- mountpoint -- path in the target root filesystem where the subvolume should
+be mounted.
+
+- options -- list of options to be added to the fstab entry of the subvolume,
+e.g. 'compress=zstd'. Like for mountpoints, they are not used during the build.
+
+- default -- if set to true, the subvolume is set as the default subvolume of
+the filesystem, mounted when no subvolume is given. Only one subvolume can be
+the default one.
+
+- verity -- protect the partition with dm-verity, computing its hash tree with
+veritysetup(8) once the partition is final, at the end of the recipe. Only
+read-only 'erofs' and 'squashfs' partitions, or partitions without filesystem
+(e.g. written by a 'raw' action) with a hash partition, are supported. As the
+root hash is only known at the end of the recipe, it is exported with the salt
+and the kernel command line arguments to use the partition in the
+'<imagename>.verity' artifact, as shell variables prefixed by the partition name
+in upper case (e.g. 'USR_ROOTHASH', 'USR_SALT', 'USR_CMDLINE'). The artifact
+is registered as the '<imagename>-verity' origin once the image is complete,
+and can be sourced by post-processing 'run' actions, e.g. to sign the root hash.
+Verity properties are described below.
+
+	# Yaml syntax for verity:
+	verity:
+	  hashpartition: partition name
+	  salt: hexadecimal salt
+	  uuid: string
+	  cmdline: bool
+
+Optional properties:
+
+- hashpartition -- name of the partition holding the hash tree, which must have
+the 'none' filesystem. By default the hash tree is appended to the filesystem,
+in the same partition.
+
+- salt -- salt of the hash tree, in hexadecimal, for reproducible root hashes.
+Defaults to a random salt.
+
+- uuid -- UUID of the verity superblock. Defaults to a random UUID.
+
+- cmdline -- if set to true, the 'usrhash' and 'systemd.verity_usr_*' kernel
+command line arguments are appended to '/etc/kernel/cmdline' in the image for
+a partition mounted as '/usr'. The kernel command line can't be updated for a
+partition mounted as '/', as it is part of the verified content, but the
+'roothash' and 'systemd.verity_root_*' arguments are in the artifact.
+
 	   # Yaml syntax for mount points:
 	   mountpoints:
 	     - mountpoint: path
@@ -137,7 +366,8 @@ to be enabled for the partition.
 
 Mandatory properties:
 
-- partition -- partition name for mounting. The partion must exist under `partitions`.
+- partition -- partition name for mounting. The partion must exist under
+`partitions`, or be a logical volume of the `volumegroup`.
 
 - mountpoint -- path in the target root filesystem where the named partition
 should be mounted. Must be unique, only one partition can be mounted per
@@ -154,6 +384,34 @@ to define a `mountpoint` path which is temporary and unique for the image,
 for example: `/mnt/temporary_mount`.
 Defaults to false.
 
+	# Yaml syntax for the volume group:
+	volumegroup:
+	  name: volume group name
+	  physicalvolumes: list of partition names
+	  logicalvolumes:
+	    <list of logical volumes>
+
+Partitions can be used as LVM physical volumes of a volume group, split in
+logical volumes formatted like partitions. The volume group is activated during
+the build, and deactivated at the end of the action.
+
+Mandatory properties:
+
+- name -- name of the volume group. It must not be used by the build host.
+
+- physicalvolumes -- names of the partitions used as physical volumes. They
+must have the 'none' filesystem, and get the 'lvm' partition type by default.
+Encrypted partitions can be used, the physical volume is then created on the
+opened device.
+
+- logicalvolumes -- list of logical volumes. They support the 'name', 'fs',
+'fslabel', 'fsuuid', 'size', 'grow', 'features', 'extendedoptions' and 'fsck'
+properties of the partitions, and are used in mountpoints by their name. The
+size of a logical volume can also be a percentage of the volume group. Like for
+partitions, the last logical volume can grow to the end of the volume group. If
+'/' is on a logical volume, the kernel command line 'rd.lvm.lv' argument is
+added to activate it at boot.
+
 	# Layout example for Raspberry PI 3:
 	- action: image-partition
 	  imagename: "debian-rpi3.img"
@@ -175,6 +433,25 @@ Defaults to false.
 	      start: 64MB
 	      end: 100%
 	      flags: [ boot ]
+
+	# Layout example using partition sizes:
+	- action: image-partition
+	  imagename: "debian-efi.img"
+	  imagesize: 4GiB
+	  partitiontype: gpt
+	  mountpoints:
+	    - mountpoint: /
+	      partition: root
+	    - mountpoint: /boot/efi
+	      partition: efi
+	  partitions:
+	    - name: efi
+	      fs: vfat
+	      size: 256MiB
+	      flags: [ esp ]
+	    - name: root
+	      fs: ext4
+	      grow: true
 */
 package actions
 
@@ -187,11 +464,13 @@ import (
 	"github.com/go-debos/fakemachine"
 	"github.com/google/uuid"
 	"log"
+	"math"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -217,6 +496,18 @@ type Partition struct {
 	ExtendedOptions []string
 	Fsck            bool `yaml:"fsck"`
 	FSUUID          string
+	Size            string
+	Grow            bool
+	Source          string
+	Origin          string
+	Encryption      *Encryption
+	Subvolumes      []Subvolume
+	Verity          *Verity
+	volumeGroup     *VolumeGroup // Volume group of a logical volume
+	extended        bool
+	autoSize        int64 // Size computed from the content, in sectors
+	start           int64 // First sector
+	end             int64 // Last sector
 }
 
 type Mountpoint struct {
@@ -225,6 +516,7 @@ type Mountpoint struct {
 	Options    []string
 	Buildtime  bool
 	part       *Partition
+	subvolume  string
 }
 
 type imageLocker struct {
@@ -251,10 +543,19 @@ type ImagePartitionAction struct {
 	debos.BaseAction `yaml:",inline"`
 	ImageName        string
 	ImageSize        string
+	Padding          string
+	MinSize          string `yaml:"min"`
 	PartitionType    string
 	DiskID           string
 	GptGap           string `yaml:"gpt_gap"`
+	GptEntriesOffset string `yaml:"gpt_entries_offset"`
+	GptEntries       int    `yaml:"gpt_entries"`
+	Align            string
+	Rootless         bool
+	Discoverable     bool
+	GptAuto          bool `yaml:"gpt_auto"`
 	Partitions       []Partition
+	VolumeGroup      *VolumeGroup
 	Mountpoints      []Mountpoint
 	size             int64
 	loopDev          losetup.Device
@@ -276,18 +577,28 @@ func (i *ImagePartitionAction) generateFSTab(context *debos.Context) error {
 
 	for _, m := range i.Mountpoints {
 		options := []string{"defaults"}
+		if readOnlyFS(m.part.FS) {
+			options = append(options, "ro")
+		}
+		if m.subvolume != "" {
+			options = append(options, "subvol="+m.subvolume)
+		}
 		options = append(options, m.Options...)
 		if m.Buildtime {
 			/* Do not need to add mount point into fstab */
 			continue
 		}
-		if m.part.FSUUID == "" {
-			return fmt.Errorf("missing fs UUID for partition %s", m.part.Name)
+		if i.gptAutoMounted(m.part, &m, context.Architecture) {
+			continue
+		}
+		spec, err := i.fsSpec(m.part)
+		if err != nil {
+			return err
 		}
 
 		fsPassno := 0
 
-		if m.part.Fsck {
+		if m.part.Fsck && !readOnlyFS(m.part.FS) {
 			if m.Mountpoint == "/" {
 				fsPassno = 1
 			} else {
@@ -301,21 +612,101 @@ func (i *ImagePartitionAction) generateFSTab(context *debos.Context) error {
 			fsType = "vfat"
 		}
 
-		context.ImageFSTab.WriteString(fmt.Sprintf("UUID=%s\t%s\t%s\t%s\t0\t%d\n",
-			m.part.FSUUID, m.Mountpoint, fsType,
+		context.ImageFSTab.WriteString(fmt.Sprintf("%s\t%s\t%s\t%s\t0\t%d\n",
+			spec, m.Mountpoint, fsType,
 			strings.Join(options, ","), fsPassno))
 	}
 
+	for _, p := range i.volumes() {
+		if p.FS != "swap" || i.gptAutoMounted(p, nil, context.Architecture) {
+			continue
+		}
+		spec, err := i.fsSpec(p)
+		if err != nil {
+			return err
+		}
+		context.ImageFSTab.WriteString(fmt.Sprintf("%s\tnone\tswap\tdefaults\t0\t0\n", spec))
+	}
+
 	return nil
 }
 
+/* Identifier of the filesystem of a partition for fstab and the kernel
+ * command line. Filesystems without UUID, like squashfs, are identified by
+ * their partition */
+func (i ImagePartitionAction) fsSpec(p *Partition) (string, error) {
+	if p.FSUUID != "" {
+		switch p.FS {
+		case "fat", "fat12", "fat16", "fat32", "msdos", "vfat":
+			// Volume IDs are shown as XXXX-XXXX
+			if len(p.FSUUID) == 8 {
+				return fmt.Sprintf("UUID=%s-%s", strings.ToUpper(p.FSUUID[:4]), strings.ToUpper(p.FSUUID[4:])), nil
+			}
+		}
+		return "UUID=" + p.FSUUID, nil
+	}
+
+	if p.FS == "squashfs" {
+		if spec, err := i.partitionSpec(p); err == nil {
+			return spec, nil
+		}
+	}
+
+	return "", fmt.Errorf("missing fs UUID for partition %s", p.Name)
+}
+
+// Identifier of a partition, or path of a logical volume
+func (i ImagePartitionAction) partitionSpec(p *Partition) (string, error) {
+	if p.volumeGroup != nil {
+		return path.Join("/dev", p.volumeGroup.Name, p.Name), nil
+	}
+	if i.PartitionType == "gpt" && p.PartUUID != "" {
+		return "PARTUUID=" + p.PartUUID, nil
+	}
+	if i.PartitionType == "msdos" && i.DiskID != "" {
+		return fmt.Sprintf("PARTUUID=%s-%02x", strings.ToLower(strings.TrimPrefix(i.DiskID, "0x")), p.number), nil
+	}
+	return "", fmt.Errorf("missing partition UUID for partition %s", p.Name)
+}
+
 func (i *ImagePartitionAction) generateKernelRoot(context *debos.Context) error {
+	var usr []string
+	for _, m := range i.Mountpoints {
+		if m.Mountpoint == "/usr" && readOnlyFS(m.part.FS) {
+			spec, err := i.fsSpec(m.part)
+			if err != nil {
+				return err
+			}
+			usr = []string{"mount.usr=" + spec, "mount.usrfstype=" + m.part.FS}
+		}
+	}
+
 	for _, m := range i.Mountpoints {
 		if m.Mountpoint == "/" {
-			if m.part.FSUUID == "" {
-				return errors.New("no fs UUID for root partition")
+			spec, err := i.fsSpec(m.part)
+			if err != nil {
+				return fmt.Errorf("root partition: %w", err)
+			}
+			args := []string{"root=" + spec}
+			if readOnlyFS(m.part.FS) {
+				args = append(args, "rootfstype="+m.part.FS, "ro")
+			}
+			if m.subvolume != "" {
+				args = append(args, "rootflags=subvol="+m.subvolume)
+			}
+
+			encrypted := []*Partition{m.part}
+			if vg := m.part.volumeGroup; vg != nil {
+				args = append(args, fmt.Sprintf("rd.lvm.lv=%s/%s", vg.Name, m.part.Name))
+				encrypted = vg.pvs
+			}
+			for _, p := range encrypted {
+				if e := p.Encryption; e != nil {
+					args = append(args, fmt.Sprintf("rd.luks.name=%s=%s", e.uuid, e.Name))
+				}
 			}
-			context.ImageKernelRoot = fmt.Sprintf("root=UUID=%s", m.part.FSUUID)
+
+			context.ImageKernelRoot = strings.Join(append(args, usr...), " ")
 			break
 		}
 	}
@@ -353,6 +744,453 @@ func (i *ImagePartitionAction) triggerDeviceNodes(context *debos.Context) error
 	return nil
 }
 
+// GPT partition type GUIDs
+const (
+	gptTypeLinux     = "0FC63DAF-8483-4772-8E79-3D69D8477DE4"
+	gptTypeBasicData = "EBD0A0A2-B9E5-4433-87C0-68B6B72699C7"
+	gptTypeESP       = "C12A7328-F81F-11D2-BA4B-00A0C93EC93B"
+	gptTypeHFS       = "48465300-0000-11AA-AA11-00306543ECAC"
+	gptTypeXBootLdr  = "BC13C2FF-59E6-4262-A352-B275FD6F7172"
+	gptTypeSwap      = "0657FD6D-A4AB-43C4-84E5-0933C84B4F4F"
+	gptTypeHome      = "933AC7E1-2EB4-4F13-B844-0E14E2AEF915"
+	gptTypeSrv       = "3B8F8425-20E0-4F3B-907F-1A25A76F98E8"
+	gptTypeVar       = "4D21B016-B534-45C2-A9FB-5C16E091FD2D"
+	gptTypeVarTmp    = "7EC6F557-3BC5-4ACA-B293-16EF5DF639D1"
+)
+
+// Partition types set by the parted flags, for GPT partition tables
+var gptFlagTypes = map[string]string{
+	"boot":            gptTypeESP,
+	"esp":             gptTypeESP,
+	"bios_grub":       "21686148-6449-6E6F-744E-656564454649",
+	"bls_boot":        gptTypeXBootLdr,
+	"chromeos_kernel": "FE3A2A5D-4F32-41A7-B725-ACCC3285A309",
+	"diag":            "DE94BBA4-06D1-4D40-A16A-BFD50179D6AC",
+	"hp-service":      "E2A1E728-32E3-11D6-A682-7B03A0000000",
+	"irst":            "D3BFE2DE-3DAF-11DF-BA40-E3A556D89593",
+	"linux-home":      gptTypeHome,
+	"lvm":             "E6D6D379-F507-44C2-A23C-238F2A3DF928",
+	"msftdata":        gptTypeBasicData,
+	"msftres":         "E3C9E316-0B5C-4DB8-817D-F92DF00215AE",
+	"prep":            "9E1A2D38-C612-4316-AA26-8B49521E5A8B",
+	"raid":            "A19D880F-05FC-4D3B-A006-743F0F84911E",
+	"swap":            gptTypeSwap,
+}
+
+// Attribute bits set by the parted flags, for GPT partition tables
+var gptFlagAttributes = map[string]uint{
+	"legacy_boot":  2,
+	"no_automount": 63,
+}
+
+// Partition types set by the parted flags, for msdos partition tables
+var msdosFlagTypes = map[string]string{
+	"diag": "12",
+	"esp":  "ef",
+	"irst": "84",
+	"lvm":  "8e",
+	"palo": "f0",
+	"prep": "41",
+	"raid": "fd",
+	"swap": "82",
+}
+
+// Default partition type for the filesystem of a partition
+func (i ImagePartitionAction) defaultPartitionType(p *Partition) string {
+	if i.PartitionType == "gpt" {
+		switch p.FS {
+		case "fat", "fat12", "fat16", "fat32", "msdos", "vfat":
+			return gptTypeBasicData
+		case "hfs", "hfsplus", "hfsx":
+			return gptTypeHFS
+		case "swap":
+			return gptTypeSwap
+		}
+		return gptTypeLinux
+	}
+
+	switch p.FS {
+	case "fat16":
+		return "0e"
+	case "fat", "fat12", "fat32", "msdos", "vfat":
+		return "0c"
+	case "hfs", "hfsplus", "hfsx":
+		return "af"
+	case "swap":
+		return "82"
+	}
+	return "83"
+}
+
+// Partition table entry of a partition, with the positions already laid out
+func (i ImagePartitionAction) partitionTableEntry(p *Partition) (debos.PartitionTableEntry, error) {
+	entry := debos.PartitionTableEntry{
+		Start:    p.start,
+		End:      p.end,
+		UUID:     p.PartUUID,
+		Extended: p.extended,
+	}
+
+	if i.PartitionType == "gpt" {
+		entry.Name = p.PartLabel
+		if entry.Name == "" {
+			entry.Name = p.Name
+		}
+	}
+
+	if !p.extended {
+		entry.Type = i.defaultPartitionType(p)
+	}
+
+	for _, flag := range p.Flags {
+		switch i.PartitionType {
+		case "gpt":
+			if t, ok := gptFlagTypes[flag]; ok {
+				entry.Type = t
+			} else if bit, ok := gptFlagAttributes[flag]; ok {
+				entry.Attributes |= 1 << bit
+			} else {
+				return entry, fmt.Errorf("unsupported flag '%s' for partition %s", flag, p.Name)
+			}
+		case "msdos":
+			switch flag {
+			case "boot":
+				entry.Bootable = true
+			case "lba":
+				// The FAT partition types are LBA ones already
+			case "hidden":
+				// Hidden variants of the FAT and NTFS partition types
+				switch entry.Type {
+				case "01", "04", "06", "07", "0b", "0c", "0e":
+					entry.Type = "1" + entry.Type[1:]
+				default:
+					return entry, fmt.Errorf("flag 'hidden' is only supported for FAT and NTFS partitions")
+				}
+			default:
+				t, ok := msdosFlagTypes[flag]
+				if !ok {
+					return entry, fmt.Errorf("unsupported flag '%s' for partition %s", flag, p.Name)
+				}
+				entry.Type = t
+			}
+		}
+	}
+
+	if p.PartType != "" {
+		entry.Type = p.PartType
+	}
+
+	for _, attr := range p.PartAttrs {
+		bit, _ := strconv.ParseUint(attr, 0, 0)
+		entry.Attributes |= 1 << bit
+	}
+
+	return entry, nil
+}
+
+func (i ImagePartitionAction) partitionTable(context *debos.Context) (*debos.PartitionTable, error) {
+	table := &debos.PartitionTable{
+		Type:       i.PartitionType,
+		SectorSize: int64(context.SectorSize),
+		Sectors:    i.size / int64(context.SectorSize),
+		DiskID:     i.DiskID,
+		GPTEntries: i.GptEntries,
+	}
+
+	if i.GptEntriesOffset != "" {
+		offset, err := parseSize(i.GptEntriesOffset)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse gpt entries offset: %s", i.GptEntriesOffset)
+		}
+		table.GPTEntriesStart = (offset + table.SectorSize - 1) / table.SectorSize
+		if table.GPTEntriesStart < 2 {
+			return nil, fmt.Errorf("gpt entries offset %s overlaps the GPT header", i.GptEntriesOffset)
+		}
+	}
+
+	for idx := range i.Partitions {
+		entry, err := i.partitionTableEntry(&i.Partitions[idx])
+		if err != nil {
+			return nil, err
+		}
+		table.Partitions = append(table.Partitions, entry)
+	}
+
+	return table, nil
+}
+
+/* Sector of a partition start or end offset, interpreted like parted(8)
+ * does: a size in human readable form, a number of sectors with the 's'
+ * suffix or a percentage of the disk, counted from the end of the disk when
+ * negative. Partitions end right before binary sizes (e.g. 64MiB), at the
+ * sector of other offsets. Sectors and binary sizes are exact offsets,
+ * percentages and decimal sizes are approximate ones. */
+func partitionOffset(offset string, end bool, sectors, sectorSize int64) (int64, bool, error) {
+	value := strings.TrimSpace(offset)
+	negative := strings.HasPrefix(value, "-")
+	value = strings.TrimPrefix(value, "-")
+
+	var sector int64
+	exact, before := true, false
+	switch {
+	case strings.HasSuffix(value, "%"):
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return 0, false, fmt.Errorf("incorrect offset '%s'", offset)
+		}
+		sector = int64(math.Round(percent * float64(sectors) / 100))
+		exact = false
+	case strings.HasSuffix(value, "s"):
+		n, err := strconv.ParseInt(strings.TrimSuffix(value, "s"), 10, 64)
+		if err != nil || n < 0 {
+			return 0, false, fmt.Errorf("incorrect offset '%s'", offset)
+		}
+		sector = n
+	default:
+		size, err := parseSize(value)
+		if err != nil {
+			return 0, false, fmt.Errorf("incorrect offset '%s'", offset)
+		}
+		if isBinarySize(value) {
+			sector = size / sectorSize
+			before = end
+		} else {
+			sector = int64(math.Round(float64(size) / float64(sectorSize)))
+			exact = false
+		}
+	}
+
+	if negative {
+		sector = sectors - sector
+	}
+	if before {
+		sector--
+	}
+	return sector, exact, nil
+}
+
+// Number of sectors of a partition size, which can be a percentage of the disk
+func partitionSize(size string, sectors, sectorSize int64) (int64, error) {
+	value := strings.TrimSpace(size)
+
+	switch {
+	case strings.HasSuffix(value, "%"):
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			return 0, fmt.Errorf("incorrect size '%s'", size)
+		}
+		return int64(math.Round(percent * float64(sectors) / 100)), nil
+	case strings.HasSuffix(value, "s"):
+		n, err := strconv.ParseInt(strings.TrimSuffix(value, "s"), 10, 64)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("incorrect size '%s'", size)
+		}
+		return n, nil
+	}
+
+	bytes, err := parseSize(value)
+	if err != nil || bytes <= 0 {
+		return 0, fmt.Errorf("incorrect size '%s'", size)
+	}
+	return (bytes + sectorSize - 1) / sectorSize, nil
+}
+
+/* Compute the first and last sector of the partitions. Without start, a
+ * partition starts after the previous one (and after its extended boot
+ * record for logical partitions) at the next aligned sector. Its end is
+ * either given, computed from its size or the last usable sector when it
+ * grows. Approximate offsets are moved to the first usable sector and ended
+ * at the last usable one when they cover the partition table, and, like
+ * parted does, partitions are started right after the previous partition
+ * (or its extended boot record) when they start on its last sector. */
+func (i *ImagePartitionAction) layoutPartitions(context *debos.Context, fitContent bool) error {
+	table, err := i.partitionTable(context)
+	if err != nil {
+		return err
+	}
+	first, last := table.FirstUsableSector(), table.LastUsableSector()
+
+	align := int64(1024 * 1024)
+	if i.Align != "" {
+		align, err = parseSize(i.Align)
+		if err != nil || align <= 0 {
+			return fmt.Errorf("failed to parse alignment: %s", i.Align)
+		}
+	}
+	align = max(1, (align+table.SectorSize-1)/table.SectorSize)
+
+	var previous, extended *Partition
+	for idx := range i.Partitions {
+		p := &i.Partitions[idx]
+
+		// Minimal start after the previous partition
+		minStart := first
+		switch {
+		case extended == nil && previous != nil:
+			minStart = previous.end + 1
+		case extended != nil && previous == extended:
+			minStart = extended.start + 1
+		case extended != nil:
+			minStart = previous.end + 2
+		}
+
+		if p.Start != "" {
+			start, exact, err := partitionOffset(p.Start, false, table.Sectors, table.SectorSize)
+			if err != nil {
+				return fmt.Errorf("partition %s: %w", p.Name, err)
+			}
+			if start < first && !exact {
+				start = first
+			}
+			if start < minStart && start >= minStart-2 {
+				start = minStart
+			}
+			p.start = start
+		} else {
+			p.start = (max(minStart, first) + align - 1) / align * align
+		}
+
+		switch {
+		case p.extended:
+			// Ends with its last logical partition
+			p.end = last
+		case p.End != "":
+			end, exact, err := partitionOffset(p.End, true, table.Sectors, table.SectorSize)
+			if err != nil {
+				return fmt.Errorf("partition %s: %w", p.Name, err)
+			}
+			if end > last && end <= table.Sectors && !exact {
+				end = last
+			}
+			p.end = end
+		case p.Grow && fitContent:
+			p.end = p.start + p.autoSize - 1
+		case p.Grow:
+			p.end = last
+			if p.autoSize > 0 && p.end-p.start+1 < p.autoSize {
+				return fmt.Errorf("partition %s: not enough space left for its content", p.Name)
+			}
+			if p.Size != "" && p.Size != "auto" {
+				size, err := partitionSize(p.Size, table.Sectors, table.SectorSize)
+				if err != nil {
+					return fmt.Errorf("partition %s: %w", p.Name, err)
+				}
+				if p.end-p.start+1 < size {
+					return fmt.Errorf("partition %s: not enough space left for %s", p.Name, p.Size)
+				}
+			}
+		case p.Size == "auto":
+			p.end = p.start + p.autoSize - 1
+		default:
+			size, err := partitionSize(p.Size, table.Sectors, table.SectorSize)
+			if err != nil {
+				return fmt.Errorf("partition %s: %w", p.Name, err)
+			}
+			p.end = p.start + size - 1
+		}
+
+		if p.extended {
+			extended = p
+		}
+		previous = p
+	}
+
+	if extended != nil && previous != extended {
+		extended.end = previous.end
+	}
+
+	return nil
+}
+
+// Log the computed partition layout
+func (i ImagePartitionAction) printLayout(context *debos.Context) {
+	log.Printf("Partition layout of %s (%s, %d bytes sectors):", i.ImageName, i.PartitionType, context.SectorSize)
+	for _, p := range i.Partitions {
+		size := (p.end - p.start + 1) * int64(context.SectorSize)
+		log.Printf("\t%d %s: sectors %d-%d (%s)", p.number, p.Name, p.start, p.end, units.BytesSize(float64(size)))
+	}
+}
+
+func (i ImagePartitionAction) writePartitionTable(context *debos.Context) error {
+	table, err := i.partitionTable(context)
+	if err != nil {
+		return err
+	}
+
+	image, err := os.OpenFile(context.Image, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("couldn't open image: %w", err)
+	}
+	defer image.Close()
+
+	if err := table.Write(image); err != nil {
+		return fmt.Errorf("failed to write partition table: %w", err)
+	}
+
+	if err := image.Sync(); err != nil {
+		return fmt.Errorf("failed to write partition table: %w", err)
+	}
+
+	return image.Close()
+}
+
+/* Let the kernel know about the new partitions. Fall back to partx in case
+ * the kernel can't rescan the partitions of the device, as partx doesn't
+ * handle logical partitions starting right after their extended partition */
+func (i ImagePartitionAction) rereadPartitionTable(context *debos.Context) error {
+	image, err := os.Open(context.Image)
+	if err != nil {
+		return fmt.Errorf("couldn't open image: %w", err)
+	}
+	defer image.Close()
+
+	const BLKRRPART = 0x125f
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, image.Fd(), BLKRRPART, 0)
+	if errno != 0 {
+		log.Printf("Failed to re-read the partition table: %s, trying partx", errno)
+	} else if _, err := os.Stat(i.getPartitionDevice(1, *context)); err != nil {
+		log.Printf("Kernel didn't find the partitions, trying partx")
+	} else {
+		return nil
+	}
+
+	return debos.Command{}.Run("partx", "partx", "-u", context.Image)
+}
+
+// Binary units are multiples of 1024 - KiB, MiB, GiB, TiB, PiB
+// decimal units are multiples of 1000 - KB, MB, GB, TB, PB
+func isBinarySize(size string) bool {
+	return regexp.MustCompile(`^[0-9.]+[kmgtp]ib+$`).MatchString(strings.ToLower(size))
+}
+
+// Parse a size in human readable form, depending on the unit (binary or decimal)
+func parseSize(size string) (int64, error) {
+	if isBinarySize(size) {
+		return units.RAMInBytes(size)
+	}
+	return units.FromHumanSize(size)
+}
+
+// Depth of a mountpoint in the filesystem hierarchy
+func mountDepth(mountpoint string) int {
+	if mountpoint == "/" {
+		return 0
+	}
+	return strings.Count(mountpoint, "/")
+}
+
+// Mountpoint of a partition, the one highest in the hierarchy if several
+func (i ImagePartitionAction) partitionMountpoint(p *Partition) *Mountpoint {
+	var mountpoint *Mountpoint
+	for idx := range i.Mountpoints {
+		m := &i.Mountpoints[idx]
+		if m.part == p && (mountpoint == nil || mountDepth(m.Mountpoint) < mountDepth(mountpoint.Mountpoint)) {
+			mountpoint = m
+		}
+	}
+	return mountpoint
+}
+
 func (i ImagePartitionAction) PreMachine(context *debos.Context, m *fakemachine.Machine,
 	args *[]string) error {
 	imagePath := path.Join(context.Artifactdir, i.ImageName)
@@ -366,10 +1204,9 @@ func (i ImagePartitionAction) PreMachine(context *debos.Context, m *fakemachine.
 	return nil
 }
 
-func (i ImagePartitionAction) formatPartition(p *Partition, context debos.Context) error {
-	label := fmt.Sprintf("Formatting partition %d", p.number)
-	path := i.getPartitionDevice(p.number, context)
-
+/* Command line formatting the partition at path. In rootless mode the
+ * filesystem is populated with the files of the source directory */
+func (i ImagePartitionAction) mkfsCommand(p *Partition, path, source string) []string {
 	cmdline := []string{}
 	switch p.FS {
 	case "fat", "fat12", "fat16", "fat32", "msdos", "vfat":
@@ -399,6 +1236,17 @@ func (i ImagePartitionAction) formatPartition(p *Partition, context debos.Contex
 		if len(p.FSUUID) > 0 {
 			cmdline = append(cmdline, "-U", p.FSUUID)
 		}
+		if source != "" {
+			cmdline = append(cmdline, "--rootdir", source)
+		}
+	case "erofs":
+		cmdline = append(cmdline, "mkfs.erofs", "-L", p.FSLabel)
+		if len(p.FSUUID) > 0 {
+			cmdline = append(cmdline, "-U", p.FSUUID)
+		}
+		return append(cmdline, path, source)
+	case "squashfs":
+		return []string{"mksquashfs", source, path, "-noappend", "-no-progress"}
 	case "f2fs":
 		cmdline = append(cmdline, "mkfs.f2fs", "-l", p.FSLabel)
 		if len(p.Features) > 0 {
@@ -417,6 +1265,11 @@ func (i ImagePartitionAction) formatPartition(p *Partition, context debos.Contex
 		if len(p.FSUUID) > 0 {
 			cmdline = append(cmdline, "-m", "uuid="+p.FSUUID)
 		}
+	case "swap":
+		cmdline = append(cmdline, "mkswap", "-L", p.FSLabel)
+		if len(p.FSUUID) > 0 {
+			cmdline = append(cmdline, "-U", p.FSUUID)
+		}
 	case "none":
 	default:
 		cmdline = append(cmdline, fmt.Sprintf("mkfs.%s", p.FS), "-L", p.FSLabel)
@@ -431,11 +1284,19 @@ func (i ImagePartitionAction) formatPartition(p *Partition, context debos.Contex
 				cmdline = append(cmdline, "-U", p.FSUUID)
 			}
 		}
+		if source != "" {
+			cmdline = append(cmdline, "-d", source)
+		}
 	}
 
 	if len(cmdline) != 0 {
 		cmdline = append(cmdline, path)
+	}
+	return cmdline
+}
 
+func (i ImagePartitionAction) runMkfs(p *Partition, label string, cmdline []string) error {
+	if len(cmdline) != 0 {
 		cmd := debos.Command{}
 
 		/* Some underlying device driver, e.g. the UML UBD driver, may manage holes
@@ -450,9 +1311,57 @@ func (i ImagePartitionAction) formatPartition(p *Partition, context debos.Contex
 			cmd.AddEnv("UNIX_IO_NOZEROOUT=1")
 		}
 
-		if err := cmd.Run(label, cmdline...); err != nil {
-			return err
+		if err := cmd.Run(label, cmdline...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/* Device holding the filesystem of a partition, the opened one if encrypted,
+ * or of a logical volume */
+func (i ImagePartitionAction) filesystemDevice(p *Partition, context debos.Context) string {
+	if p.volumeGroup != nil {
+		return path.Join("/dev", p.volumeGroup.Name, p.Name)
+	}
+	if p.Encryption != nil {
+		return path.Join("/dev/mapper", p.Encryption.Name)
+	}
+	return i.getPartitionDevice(p.number, context)
+}
+
+// Partitions and logical volumes of the image
+func (i ImagePartitionAction) volumes() []*Partition {
+	var volumes []*Partition
+	for idx := range i.Partitions {
+		volumes = append(volumes, &i.Partitions[idx])
+	}
+	if i.VolumeGroup != nil {
+		for idx := range i.VolumeGroup.LogicalVolumes {
+			volumes = append(volumes, &i.VolumeGroup.LogicalVolumes[idx])
+		}
+	}
+	return volumes
+}
+
+func (i ImagePartitionAction) formatPartition(p *Partition, context debos.Context) error {
+	label := fmt.Sprintf("Formatting partition %d", p.number)
+	if p.volumeGroup != nil {
+		label = fmt.Sprintf("Formatting logical volume %s", p.Name)
+	}
+
+	// Generated once the root filesystem is complete
+	if readOnlyFS(p.FS) {
+		if p.FS == "erofs" && p.FSUUID == "" {
+			p.FSUUID = uuid.NewString()
 		}
+		return nil
+	}
+	path := i.filesystemDevice(p, context)
+
+	if err := i.runMkfs(p, label, i.mkfsCommand(p, path, "")); err != nil {
+		return err
 	}
 
 	if p.FS != "none" && p.FSUUID == "" {
@@ -463,6 +1372,10 @@ func (i ImagePartitionAction) formatPartition(p *Partition, context debos.Contex
 		p.FSUUID = strings.TrimSpace(string(uuid[:]))
 	}
 
+	if len(p.Subvolumes) > 0 {
+		return i.createSubvolumes(p, context)
+	}
+
 	return nil
 }
 
@@ -480,6 +1393,11 @@ func (i *ImagePartitionAction) PreNoMachine(context *debos.Context) error {
 
 	img.Close()
 
+	if i.Rootless {
+		context.Image = imagePath
+		return nil
+	}
+
 	// losetup.Attach() can fail due to concurrent attaches in other processes
 	retries := 60
 	for t := 1; t <= retries; t++ {
@@ -505,6 +1423,16 @@ func (i *ImagePartitionAction) PreNoMachine(context *debos.Context) error {
 		}
 	}
 
+	// Let the kernel scan the partitions once they are written
+	info, err := i.loopDev.GetInfo()
+	if err == nil {
+		info.Flags |= losetup.FlagsPartScan
+		err = i.loopDev.SetInfo(info)
+	}
+	if err != nil {
+		log.Printf("Failed to enable partition scanning on loop device: %v", err)
+	}
+
 	context.Image = i.loopDev.Path()
 	i.usingLoop = true
 
@@ -512,6 +1440,16 @@ func (i *ImagePartitionAction) PreNoMachine(context *debos.Context) error {
 }
 
 func (i ImagePartitionAction) Run(context *debos.Context) error {
+	if i.ImageSize == "auto" || i.hasAutoSize() {
+		if err := i.autoLayout(context); err != nil {
+			return err
+		}
+	}
+
+	if i.Rootless {
+		return i.runRootless(context)
+	}
+
 	/* On certain disk device events udev will call the BLKRRPART ioctl to
 	 * re-read the partition table. This will cause the partition devices
 	 * (e.g. vda3) to temporarily disappear while the rescanning happens.
@@ -519,129 +1457,73 @@ func (i ImagePartitionAction) Run(context *debos.Context) error {
 	 * devices disappearing while doing operations on them (e.g. formatting
 	 * and mounting) we need to do it while holding an exclusive lock
 	 */
-	command := []string{"parted", "-s", context.Image, "mklabel", i.PartitionType}
-	if len(i.GptGap) > 0 {
-		command = append(command, i.GptGap)
+	lock, err := lockImage(context)
+	if err != nil {
+		return err
 	}
-	err := debos.Command{}.Run("parted", command...)
+	defer lock.unlock()
+
+	err = i.writePartitionTable(context)
 	if err != nil {
 		return err
 	}
 
-	if len(i.DiskID) > 0 {
-		command := []string{"sfdisk", "--disk-id", context.Image, i.DiskID}
-		err = debos.Command{}.Run("sfdisk", command...)
-		if err != nil {
-			return err
-		}
+	err = i.rereadPartitionTable(context)
+	if err != nil {
+		return err
 	}
+	lock.unlock()
 
 	for idx := range i.Partitions {
 		p := &i.Partitions[idx]
 
-		if p.PartLabel == "" {
-			p.PartLabel = p.Name
-		}
-
-		var name string
-		if i.PartitionType == "msdos" {
-			if len(i.Partitions) <= 4 {
-				name = "primary"
-			} else {
-				if idx < 3 {
-					name = "primary"
-				} else if idx == 3 {
-					name = "extended"
-				} else {
-					name = "logical"
-				}
-			}
-		} else {
-			name = p.PartLabel
-		}
-
-		command := []string{"parted", "-a", "none", "-s", "--", context.Image, "mkpart", name}
-		switch p.FS {
-		case "fat16":
-			command = append(command, "fat16")
-		case "fat", "fat12", "fat32", "msdos", "vfat":
-			/* TODO: Not sure if this is correct. Perhaps
-			   fat12 should be treated the same as fat16 ? */
-			command = append(command, "fat32")
-		case "hfsplus":
-			command = append(command, "hfs+")
-		case "f2fs":
-		case "none":
-		default:
-			command = append(command, p.FS)
-		}
-		command = append(command, p.Start, p.End)
-
-		err = debos.Command{}.Run("parted", command...)
+		lock, err = lockImage(context)
 		if err != nil {
 			return err
 		}
+		defer lock.unlock()
 
-		if p.Flags != nil {
-			for _, flag := range p.Flags {
-				err = debos.Command{}.Run("parted", "parted", "-s", context.Image, "set",
-					fmt.Sprintf("%d", p.number), flag, "on")
-				if err != nil {
-					return err
-				}
-			}
-		}
-
-		if p.PartType != "" {
-			err = debos.Command{}.Run("sfdisk", "sfdisk", "--part-type", context.Image, fmt.Sprintf("%d", p.number), p.PartType)
+		if p.Encryption != nil {
+			err = i.encryptPartition(p, *context)
 			if err != nil {
 				return err
 			}
 		}
 
-		if len(p.PartAttrs) > 0 {
-			/* Convert bits numbers to bits names due to a libfdisk's limitation
-			 * https://github.com/util-linux/util-linux/issues/3353
-			 */
-			for idx, attr := range p.PartAttrs {
-				switch attr {
-				case "0":
-					p.PartAttrs[idx] = "RequiredPartition"
-				case "1":
-					p.PartAttrs[idx] = "NoBlockIOProtocol"
-				case "2":
-					p.PartAttrs[idx] = "LegacyBIOSBootable"
-				}
-			}
-			err = debos.Command{}.Run("sfdisk", "sfdisk", "--part-attrs", context.Image, fmt.Sprintf("%d", p.number), strings.Join(p.PartAttrs, ","))
-			if err != nil {
-				return err
-			}
+		err = i.formatPartition(p, *context)
+		if err != nil {
+			return err
 		}
+		lock.unlock()
 
-		/* PartUUID will only be set for gpt partitions */
-		if len(p.PartUUID) > 0 {
-			err = debos.Command{}.Run("sfdisk", "sfdisk", "--part-uuid", context.Image, fmt.Sprintf("%d", p.number), p.PartUUID)
-			if err != nil {
-				return err
-			}
-		}
+		devicePath := i.getPartitionDevice(p.number, *context)
+		context.ImagePartitions = append(context.ImagePartitions,
+			debos.Partition{Name: p.Name, DevicePath: devicePath})
+	}
 
-		lock, err := lockImage(context)
+	if vg := i.VolumeGroup; vg != nil {
+		lock, err = lockImage(context)
 		if err != nil {
 			return err
 		}
 		defer lock.unlock()
 
-		err = i.formatPartition(p, *context)
+		err = i.createVolumeGroup(context)
 		if err != nil {
 			return err
 		}
-		lock.unlock()
 
-		devicePath := i.getPartitionDevice(p.number, *context)
-		context.ImagePartitions = append(context.ImagePartitions,
-			debos.Partition{Name: p.Name, DevicePath: devicePath})
+		for idx := range vg.LogicalVolumes {
+			lv := &vg.LogicalVolumes[idx]
+			err = i.formatPartition(lv, *context)
+			if err != nil {
+				return err
+			}
+
+			context.ImagePartitions = append(context.ImagePartitions,
+				debos.Partition{Name: lv.Name, DevicePath: i.filesystemDevice(lv, *context)})
+		}
+		lock.unlock()
 	}
 
 	context.ImageMntDir = path.Join(context.Scratchdir, "mnt")
@@ -665,24 +1547,32 @@ func (i ImagePartitionAction) Run(context *debos.Context) error {
 		return strings.Count(mntA, "/") < strings.Count(mntB, "/")
 	})
 
-	lock, err := lockImage(context)
+	lock, err = lockImage(context)
 	if err != nil {
 		return err
 	}
 	defer lock.unlock()
 
 	for _, m := range i.Mountpoints {
-		dev := i.getPartitionDevice(m.part.number, *context)
+		dev := i.filesystemDevice(m.part, *context)
 		mntpath := path.Join(context.ImageMntDir, m.Mountpoint)
 		if err := os.MkdirAll(mntpath, 0755); err != nil {
 			return fmt.Errorf("failed to create mountpoint %s: %w", mntpath, err)
 		}
+		// Read-only filesystems are generated from the directory
+		if readOnlyFS(m.part.FS) {
+			continue
+		}
 		fsType := m.part.FS
 		switch m.part.FS {
 		case "fat", "fat12", "fat16", "fat32", "msdos":
 			fsType = "vfat"
 		}
-		err = syscall.Mount(dev, mntpath, fsType, 0, "")
+		var data string
+		if m.subvolume != "" {
+			data = "subvol=" + m.subvolume
+		}
+		err = syscall.Mount(dev, mntpath, fsType, 0, data)
 		if err != nil {
 			return fmt.Errorf("%s mount failed: %w", m.part.Name, err)
 		}
@@ -694,6 +1584,8 @@ func (i ImagePartitionAction) Run(context *debos.Context) error {
 		return err
 	}
 
+	i.generateCrypttab(context)
+
 	err = i.generateKernelRoot(context)
 	if err != nil {
 		return err
@@ -709,9 +1601,36 @@ func (i ImagePartitionAction) Run(context *debos.Context) error {
 }
 
 func (i ImagePartitionAction) Cleanup(context *debos.Context) error {
+	if i.Rootless {
+		if context.State != debos.Success {
+			return nil
+		}
+		err := i.assemble(context)
+		if err != nil {
+			log.Printf("Failed to assemble image: %s", err)
+			context.State = debos.Failed
+		}
+		return err
+	}
+
+	if context.State == debos.Success {
+		err := i.generateReadOnly(context)
+		if err == nil {
+			device := func(p *Partition) string { return i.filesystemDevice(p, *context) }
+			err = i.generateVerity(context, device, path.Join(context.ImageMntDir, "etc/kernel/cmdline"))
+		}
+		if err != nil {
+			log.Printf("Failed to generate read-only partitions: %s", err)
+			context.State = debos.Failed
+		}
+	}
+
 	for idx := len(i.Mountpoints) - 1; idx >= 0; idx-- {
 		m := i.Mountpoints[idx]
 		mntpath := path.Join(context.ImageMntDir, m.Mountpoint)
+		if readOnlyFS(m.part.FS) {
+			continue
+		}
 		err := syscall.Unmount(mntpath, 0)
 		if err != nil {
 			log.Printf("Warning: Failed to get unmount %s: %s", m.Mountpoint, err)
@@ -732,6 +1651,27 @@ func (i ImagePartitionAction) Cleanup(context *debos.Context) error {
 		}
 	}
 
+	if vg := i.VolumeGroup; vg != nil && vg.active {
+		err := debos.Command{}.Run("vgchange", "vgchange", "--activate", "n", vg.Name)
+		if err != nil {
+			log.Printf("Failed to deactivate volume group %s: %s", vg.Name, err)
+			return err
+		}
+		vg.active = false
+	}
+
+	for _, p := range i.Partitions {
+		if p.Encryption == nil || !p.Encryption.opened {
+			continue
+		}
+		err := debos.Command{}.Run("cryptsetup", "cryptsetup", "close", p.Encryption.Name)
+		if err != nil {
+			log.Printf("Failed to close encrypted partition %s: %s", p.Name, err)
+			return err
+		}
+		p.Encryption.opened = false
+	}
+
 	if i.usingLoop {
 		err := i.loopDev.Detach()
 		if err != nil {
@@ -756,7 +1696,38 @@ func (i ImagePartitionAction) Cleanup(context *debos.Context) error {
 	return nil
 }
 
+/* Register the verity metadata artifact, and shrink an image of automatic
+ * size, created larger as its size is only known once the root filesystem is
+ * built */
+func (i ImagePartitionAction) PostMachine(context *debos.Context) error {
+	// Written once the recipe is done, maybe in the fake machine
+	if slices.ContainsFunc(i.volumes(), func(p *Partition) bool { return p.Verity != nil }) {
+		context.Origins[i.ImageName+"-verity"] = i.verityArtifact(context)
+	}
+
+	if i.ImageSize != "auto" {
+		return nil
+	}
+
+	data, err := os.ReadFile(i.sizeFile(context))
+	if err != nil {
+		return fmt.Errorf("couldn't read image size: %w", err)
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return fmt.Errorf("couldn't read image size: %w", err)
+	}
+	os.Remove(i.sizeFile(context))
+
+	log.Printf("Resizing %s to %s", i.ImageName, units.BytesSize(float64(size)))
+	return os.Truncate(path.Join(context.Artifactdir, i.ImageName), size)
+}
+
 func (i ImagePartitionAction) PostMachineCleanup(context *debos.Context) error {
+	if i.ImageSize == "auto" {
+		os.Remove(i.sizeFile(context))
+	}
+
 	image := path.Join(context.Artifactdir, i.ImageName)
 	/* Remove the image in case of any action failure */
 	if context.State != debos.Success {
@@ -769,7 +1740,108 @@ func (i ImagePartitionAction) PostMachineCleanup(context *debos.Context) error {
 	return nil
 }
 
-func (i *ImagePartitionAction) Verify(_ *debos.Context) error {
+// Check the filesystem properties of a partition or logical volume
+func (i *ImagePartitionAction) verifyFilesystem(p *Partition) error {
+	var maxLength = 0
+
+	if p.FS == "" {
+		return fmt.Errorf("partition %s missing fs type", p.Name)
+	}
+
+	switch p.FS {
+	case "btrfs", "ext2", "ext3", "ext4", "fat", "fat12", "fat16", "fat32", "msdos", "vfat", "none":
+	case "erofs", "squashfs", "swap":
+	default:
+		if i.Rootless {
+			return fmt.Errorf("filesystem %s of partition %s is not supported in rootless mode", p.FS, p.Name)
+		}
+	}
+
+	if len(p.FSUUID) > 0 {
+		switch p.FS {
+		case "btrfs", "erofs", "ext2", "ext3", "ext4", "swap", "xfs":
+			_, err := uuid.Parse(p.FSUUID)
+			if err != nil {
+				return fmt.Errorf("incorrect UUID %s", p.FSUUID)
+			}
+		case "fat", "fat12", "fat16", "fat32", "msdos", "vfat":
+			_, err := hex.DecodeString(p.FSUUID)
+			if err != nil || len(p.FSUUID) != 8 {
+				return fmt.Errorf("incorrect UUID %s, should be 32-bit hexadecimal number", p.FSUUID)
+			}
+		default:
+			return fmt.Errorf("setting the UUID is not supported for filesystem %s", p.FS)
+		}
+	}
+
+	if p.FSLabel == "" {
+		p.FSLabel = p.Name
+	}
+
+	switch p.FS {
+	case "fat", "fat12", "fat16", "fat32", "msdos", "vfat":
+		maxLength = 11
+	case "ext2", "ext3", "ext4":
+		maxLength = 16
+	case "btrfs":
+		maxLength = 255
+	case "f2fs":
+		maxLength = 512
+	case "hfs", "hfsplus":
+		maxLength = 255
+	case "xfs":
+		maxLength = 12
+	case "erofs", "swap":
+		maxLength = 16
+	case "none", "squashfs":
+	default:
+		log.Printf("Warning: setting a fs label for %s is unsupported", p.FS)
+	}
+
+	if maxLength > 0 && len(p.FSLabel) > maxLength {
+		return fmt.Errorf("fs label for %s '%s' is too long", p.Name, p.FSLabel)
+	}
+
+	if (p.Source != "" || p.Origin != "") && !readOnlyFS(p.FS) {
+		return fmt.Errorf("only erofs and squashfs partitions can have a source, not %s", p.Name)
+	}
+
+	if len(p.Subvolumes) > 0 {
+		if p.FS != "btrfs" {
+			return fmt.Errorf("subvolumes of %s need a btrfs filesystem", p.Name)
+		}
+		if i.Rootless {
+			return fmt.Errorf("subvolumes of %s are not supported in rootless mode", p.Name)
+		}
+	}
+
+	defaults := 0
+	for idx := range p.Subvolumes {
+		sv := &p.Subvolumes[idx]
+		sv.Name = strings.Trim(path.Clean("/"+sv.Name), "/")
+		if sv.Name == "" {
+			return fmt.Errorf("subvolume of %s without a name", p.Name)
+		}
+		for _, other := range p.Subvolumes[:idx] {
+			if other.Name == sv.Name {
+				return fmt.Errorf("subvolume %s of %s already exists", sv.Name, p.Name)
+			}
+		}
+		if sv.Default {
+			defaults++
+		}
+		if sv.Mountpoint == "" && len(sv.Options) > 0 {
+			return fmt.Errorf("subvolume %s of %s has options but no mountpoint", sv.Name, p.Name)
+		}
+	}
+	if defaults > 1 {
+		return fmt.Errorf("only one subvolume of %s can be the default one", p.Name)
+	}
+
+	return nil
+}
+
+func (i *ImagePartitionAction) Verify(context *debos.Context) error {
 	if i.PartitionType == "msdos" {
 		for idx := range i.Partitions {
 			p := &i.Partitions[idx]
@@ -782,10 +1854,8 @@ func (i *ImagePartitionAction) Verify(_ *debos.Context) error {
 				part.number = idx + 1
 				part.Name = name
 				part.Start = p.Start
-				tmpN := len(i.Partitions) - 1
-				tmp := &i.Partitions[tmpN]
-				part.End = tmp.End
 				part.FS = "none"
+				part.extended = true
 
 				i.Partitions = append(i.Partitions[:idx+1], i.Partitions[idx:]...)
 				i.Partitions[idx] = part
@@ -801,14 +1871,36 @@ func (i *ImagePartitionAction) Verify(_ *debos.Context) error {
 	}
 
 	if len(i.GptGap) > 0 {
-		log.Println("WARNING: special version of parted is needed for 'gpt_gap' option")
+		return fmt.Errorf("gpt_gap property is not supported anymore, use gpt_entries_offset, counted from the start of the disk")
+	}
+
+	if len(i.GptEntriesOffset) > 0 || i.GptEntries != 0 {
 		if i.PartitionType != "gpt" {
-			return fmt.Errorf("gpt_gap property could be used only with 'gpt' label")
+			return fmt.Errorf("gpt_entries_offset and gpt_entries properties could be used only with 'gpt' label")
 		}
-		// Just check if it contains correct value
-		_, err := units.FromHumanSize(i.GptGap)
-		if err != nil {
-			return fmt.Errorf("failed to parse image size: %s", i.GptGap)
+	}
+
+	if len(i.GptEntriesOffset) > 0 {
+		if _, err := parseSize(i.GptEntriesOffset); err != nil {
+			return fmt.Errorf("failed to parse gpt entries offset: %s", i.GptEntriesOffset)
+		}
+	}
+
+	if (i.Discoverable || i.GptAuto) && i.PartitionType != "gpt" {
+		return fmt.Errorf("discoverable and gpt_auto properties could be used only with 'gpt' label")
+	}
+
+	// Partitions of filesystems without UUID are referred to by PARTUUID
+	byPartUUID := slices.ContainsFunc(i.Partitions, func(p Partition) bool {
+		return p.FS == "squashfs" || p.Verity != nil
+	})
+	if (i.Rootless || byPartUUID) && i.DiskID == "" {
+		switch i.PartitionType {
+		case "gpt":
+			i.DiskID = uuid.NewString()
+		case "msdos":
+			id := uuid.New()
+			i.DiskID = hex.EncodeToString(id[:4])
 		}
 	}
 
@@ -831,7 +1923,6 @@ func (i *ImagePartitionAction) Verify(_ *debos.Context) error {
 
 	num := 1
 	for idx := range i.Partitions {
-		var maxLength = 0
 		p := &i.Partitions[idx]
 		p.number = num
 		num++
@@ -846,23 +1937,31 @@ func (i *ImagePartitionAction) Verify(_ *debos.Context) error {
 			}
 		}
 
-		if len(p.FSUUID) > 0 {
-			switch p.FS {
-			case "btrfs", "ext2", "ext3", "ext4", "xfs":
-				_, err := uuid.Parse(p.FSUUID)
-				if err != nil {
-					return fmt.Errorf("incorrect UUID %s", p.FSUUID)
-				}
-			case "fat", "fat12", "fat16", "fat32", "msdos", "vfat":
-				_, err := hex.DecodeString(p.FSUUID)
-				if err != nil || len(p.FSUUID) != 8 {
-					return fmt.Errorf("incorrect UUID %s, should be 32-bit hexadecimal number", p.FSUUID)
+		if err := i.verifyFilesystem(p); err != nil {
+			return err
+		}
+
+		if e := p.Encryption; e != nil {
+			if i.Rootless {
+				return fmt.Errorf("encryption of partition %s is not supported in rootless mode", p.Name)
+			}
+			if (e.Keyfile == "") == (e.Key == "") {
+				return fmt.Errorf("encryption of partition %s needs either a keyfile or a key", p.Name)
+			}
+			if e.Name == "" {
+				e.Name = p.Name + "_crypt"
+			}
+			for _, secret := range []string{e.Key, e.Passphrase} {
+				if secret != "" {
+					debos.AddSecret(secret)
 				}
-			default:
-				return fmt.Errorf("setting the UUID is not supported for filesystem %s", p.FS)
 			}
 		}
 
+		if p.FS == "squashfs" && i.PartitionType == "gpt" && p.PartUUID == "" {
+			p.PartUUID = uuid.NewString()
+		}
+
 		if i.PartitionType != "gpt" && p.PartLabel != "" {
 			return fmt.Errorf("can only set partition partlabel on GPT filesystem")
 		}
@@ -899,41 +1998,31 @@ func (i *ImagePartitionAction) Verify(_ *debos.Context) error {
 			}
 		}
 
-		if p.Start == "" {
-			return fmt.Errorf("partition %s missing start", p.Name)
-		}
-		if p.End == "" {
-			return fmt.Errorf("partition %s missing end", p.Name)
-		}
-
-		if p.FS == "" {
-			return fmt.Errorf("partition %s missing fs type", p.Name)
-		}
-
-		if p.FSLabel == "" {
-			p.FSLabel = p.Name
+		if !p.extended {
+			switch {
+			case p.End != "" && (p.Size != "" || p.Grow):
+				return fmt.Errorf("partition %s can't have an end together with a size or growing", p.Name)
+			case p.End == "" && p.Size == "" && !p.Grow:
+				return fmt.Errorf("partition %s missing end or size", p.Name)
+			case p.Grow && idx != len(i.Partitions)-1:
+				return fmt.Errorf("only the last partition can grow, not %s", p.Name)
+			}
 		}
+	}
 
-		switch p.FS {
-		case "fat", "fat12", "fat16", "fat32", "msdos", "vfat":
-			maxLength = 11
-		case "ext2", "ext3", "ext4":
-			maxLength = 16
-		case "btrfs":
-			maxLength = 255
-		case "f2fs":
-			maxLength = 512
-		case "hfs", "hfsplus":
-			maxLength = 255
-		case "xfs":
-			maxLength = 12
-		case "none":
-		default:
-			log.Printf("Warning: setting a fs label for %s is unsupported", p.FS)
+	if i.VolumeGroup != nil {
+		if err := i.verifyVolumeGroup(); err != nil {
+			return err
 		}
+	}
 
-		if maxLength > 0 && len(p.FSLabel) > maxLength {
-			return fmt.Errorf("fs label for %s '%s' is too long", p.Name, p.FSLabel)
+	// Mounted subvolumes are handled like the other mountpoints
+	for _, p := range i.volumes() {
+		for _, sv := range p.Subvolumes {
+			if sv.Mountpoint != "" {
+				i.Mountpoints = append(i.Mountpoints, Mountpoint{Mountpoint: sv.Mountpoint,
+					Partition: p.Name, Options: sv.Options, subvolume: sv.Name})
+			}
 		}
 	}
 
@@ -962,6 +2051,15 @@ func (i *ImagePartitionAction) Verify(_ *debos.Context) error {
 				break
 			}
 		}
+		if m.part == nil && i.VolumeGroup != nil {
+			for lidx := range i.VolumeGroup.LogicalVolumes {
+				lv := &i.VolumeGroup.LogicalVolumes[lidx]
+				if m.Partition == lv.Name {
+					m.part = lv
+					break
+				}
+			}
+		}
 		if m.part == nil {
 			return fmt.Errorf("couldn't find partition for %s", m.Mountpoint)
 		}
@@ -969,23 +2067,80 @@ func (i *ImagePartitionAction) Verify(_ *debos.Context) error {
 		if strings.ToLower(m.part.FS) == "none" {
 			return fmt.Errorf("cannot mount %s: filesystem not present", m.Mountpoint)
 		}
+		if m.part.FS == "swap" {
+			return fmt.Errorf("cannot mount %s: %s is a swap partition", m.Mountpoint, m.part.Name)
+		}
 	}
 
-	// Calculate the size based on the unit (binary or decimal)
-	// binary units are multiples of 1024 - KiB, MiB, GiB, TiB, PiB
-	// decimal units are multiples of 1000 - KB, MB, GB, TB, PB
-	var getSizeValueFunc func(size string) (int64, error)
-	if regexp.MustCompile(`^[0-9.]+[kmgtp]ib+$`).MatchString(strings.ToLower(i.ImageSize)) {
-		getSizeValueFunc = units.RAMInBytes
-	} else {
-		getSizeValueFunc = units.FromHumanSize
+	for _, p := range i.volumes() {
+		if p.Verity != nil {
+			if err := i.verifyVerity(p); err != nil {
+				return err
+			}
+		}
 	}
 
-	size, err := getSizeValueFunc(i.ImageSize)
+	// Types set by the recipe, with the type or the flags, are kept
+	if i.Discoverable {
+		for idx := range i.Partitions {
+			p := &i.Partitions[idx]
+			if p.PartType != "" || slices.ContainsFunc(p.Flags, func(flag string) bool {
+				_, ok := gptFlagTypes[flag]
+				return ok
+			}) {
+				continue
+			}
+			p.PartType = i.discoverableType(p, context.Architecture)
+		}
+	}
+
+	for _, p := range i.volumes() {
+		if !readOnlyFS(p.FS) {
+			continue
+		}
+		m := i.partitionMountpoint(p)
+		if m == nil {
+			if p.Source == "" && p.Origin == "" {
+				return fmt.Errorf("partition %s needs a mountpoint or a source", p.Name)
+			}
+			continue
+		}
+		// Their content is only generated at the end of the recipe
+		if i.Rootless || m.Mountpoint == "/" {
+			continue
+		}
+		for _, other := range i.Mountpoints {
+			if other.part != p && strings.HasPrefix(other.Mountpoint, strings.TrimSuffix(m.Mountpoint, "/")+"/") {
+				return fmt.Errorf("mountpoint %s can't be in read-only partition %s", other.Mountpoint, p.Name)
+			}
+		}
+	}
+
+	if i.ImageSize == "auto" {
+		return i.verifyAutoSize(context)
+	}
+
+	size, err := parseSize(i.ImageSize)
 	if err != nil {
 		return fmt.Errorf("failed to parse image size: %s", i.ImageSize)
 	}
-
 	i.size = size
-	return nil
+
+	if i.hasAutoSize() {
+		return i.verifyAutoSize(context)
+	}
+
+	if err := i.layoutPartitions(context, false); err != nil {
+		return err
+	}
+
+	if context.PrintRecipe {
+		i.printLayout(context)
+	}
+
+	table, err := i.partitionTable(context)
+	if err != nil {
+		return err
+	}
+	return table.Validate()
 }
@@ -0,0 +1,200 @@
+package actions
+
+import (
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGptEntriesOffset(t *testing.T) {
+	context := &debos.Context{SectorSize: 512}
+
+	for _, tc := range []struct {
+		offset string
+		start  int64
+		err    string
+	}{
+		{offset: "", start: 0},
+		{offset: "1MiB", start: 2048},
+		{offset: "1025", start: 3},
+		{offset: "1024", start: 2},
+		{offset: "512", err: "gpt entries offset 512 overlaps the GPT header"},
+		{offset: "foo", err: "failed to parse gpt entries offset: foo"},
+	} {
+		i := ImagePartitionAction{PartitionType: "gpt", GptEntriesOffset: tc.offset, size: 64 << 20}
+		table, err := i.partitionTable(context)
+		if tc.err != "" {
+			assert.EqualError(t, err, tc.err, tc.offset)
+			continue
+		}
+		assert.NoError(t, err, tc.offset)
+		assert.Equal(t, tc.start, table.GPTEntriesStart, tc.offset)
+	}
+}
+
+func TestPartitionOffset(t *testing.T) {
+	// 64MiB disk
+	const sectors, sectorSize = 131072, 512
+
+	for _, tc := range []struct {
+		offset string
+		end    bool
+		sector int64
+		exact  bool
+		err    string
+	}{
+		{offset: "1MiB", sector: 2048, exact: true},
+		{offset: "1MiB", end: true, sector: 2047, exact: true},
+		{offset: "1MB", sector: 1953},
+		{offset: "2048s", end: true, sector: 2048, exact: true},
+		{offset: "50%", sector: 65536},
+		{offset: "100%", end: true, sector: 131072},
+		{offset: "-1s", end: true, sector: 131071, exact: true},
+		{offset: "-1MiB", sector: 129024, exact: true},
+		{offset: "-1MiB", end: true, sector: 129023, exact: true},
+		{offset: "-10%", end: true, sector: 117965},
+		{offset: "101%", err: "incorrect offset '101%'"},
+		{offset: "-5.5s", err: "incorrect offset '-5.5s'"},
+		{offset: "foo", err: "incorrect offset 'foo'"},
+	} {
+		sector, exact, err := partitionOffset(tc.offset, tc.end, sectors, sectorSize)
+		if tc.err != "" {
+			assert.EqualError(t, err, tc.err, tc.offset)
+			continue
+		}
+		assert.NoError(t, err, tc.offset)
+		assert.Equal(t, tc.sector, sector, tc.offset)
+		assert.Equal(t, tc.exact, exact, tc.offset)
+	}
+}
+
+func TestPartitionSize(t *testing.T) {
+	const sectors, sectorSize = 131072, 512
+
+	for _, tc := range []struct {
+		size    string
+		sectors int64
+		err     string
+	}{
+		{size: "1MiB", sectors: 2048},
+		{size: "1MB", sectors: 1954},
+		{size: "1000", sectors: 2},
+		{size: "100s", sectors: 100},
+		{size: "10%", sectors: 13107},
+		{size: "0", err: "incorrect size '0'"},
+		{size: "0%", err: "incorrect size '0%'"},
+		{size: "0s", err: "incorrect size '0s'"},
+		{size: "foo", err: "incorrect size 'foo'"},
+	} {
+		n, err := partitionSize(tc.size, sectors, sectorSize)
+		if tc.err != "" {
+			assert.EqualError(t, err, tc.err, tc.size)
+			continue
+		}
+		assert.NoError(t, err, tc.size)
+		assert.Equal(t, tc.sectors, n, tc.size)
+	}
+}
+
+func TestLayoutPartitions(t *testing.T) {
+	context := &debos.Context{SectorSize: 512}
+
+	for _, tc := range []struct {
+		name          string
+		partitionType string
+		align         string
+		partitions    []Partition
+		layout        [][2]int64
+		err           string
+	}{
+		{
+			name:          "percentages",
+			partitionType: "gpt",
+			partitions: []Partition{
+				{Name: "a", Start: "0%", End: "50%"},
+				{Name: "b", Start: "50%", End: "100%"},
+			},
+			// Moved out of the partition table and after the previous partition, like parted does
+			layout: [][2]int64{{34, 65536}, {65537, 131038}},
+		},
+		{
+			name:          "size and grow",
+			partitionType: "gpt",
+			partitions: []Partition{
+				{Name: "a", Size: "16MiB"},
+				{Name: "b", Size: "16MiB", Grow: true},
+			},
+			layout: [][2]int64{{2048, 34815}, {34816, 131038}},
+		},
+		{
+			name:          "grow too small",
+			partitionType: "gpt",
+			partitions: []Partition{
+				{Name: "a", Size: "16MiB"},
+				{Name: "b", Size: "60MiB", Grow: true},
+			},
+			err: "partition b: not enough space left for 60MiB",
+		},
+		{
+			name:          "alignment",
+			partitionType: "gpt",
+			align:         "4KiB",
+			partitions: []Partition{
+				{Name: "a", Size: "1000KiB"},
+				{Name: "b", Size: "1MB"},
+				{Name: "c", Size: "1s"},
+				{Name: "d", Start: "3MiB", End: "-1MiB"},
+			},
+			layout: [][2]int64{{40, 2039}, {2040, 3993}, {4000, 4000}, {6144, 129023}},
+		},
+		{
+			name:          "logical partitions",
+			partitionType: "msdos",
+			partitions: []Partition{
+				{Name: "a", Start: "1MiB", End: "8MiB"},
+				{Name: "b", Start: "8MiB", End: "16MiB"},
+				{Name: "c", Start: "16MiB", End: "24MiB"},
+				{Name: "extended", Start: "24MiB", extended: true},
+				// After the extended boot record of each logical partition
+				{Name: "d", Start: "24MiB", End: "32MiB"},
+				{Name: "e", Size: "8MiB"},
+				{Name: "f", Start: "41MiB", End: "100%"},
+			},
+			layout: [][2]int64{
+				{2048, 16383}, {16384, 32767}, {32768, 49151},
+				{49152, 131071}, {49153, 65535}, {67584, 83967}, {83969, 131071},
+			},
+		},
+		{
+			name:          "incorrect offset",
+			partitionType: "gpt",
+			partitions:    []Partition{{Name: "a", Start: "foo", End: "100%"}},
+			err:           "partition a: incorrect offset 'foo'",
+		},
+		{
+			name:          "incorrect alignment",
+			partitionType: "gpt",
+			align:         "foo",
+			err:           "failed to parse alignment: foo",
+		},
+	} {
+		i := ImagePartitionAction{
+			PartitionType: tc.partitionType,
+			Align:         tc.align,
+			Partitions:    tc.partitions,
+			size:          64 << 20,
+		}
+		err := i.layoutPartitions(context, false)
+		if tc.err != "" {
+			assert.EqualError(t, err, tc.err, tc.name)
+			continue
+		}
+		assert.NoError(t, err, tc.name)
+		var layout [][2]int64
+		for _, p := range i.Partitions {
+			layout = append(layout, [2]int64{p.start, p.end})
+		}
+		assert.Equal(t, tc.layout, layout, tc.name)
+	}
+}
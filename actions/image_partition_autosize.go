@@ -0,0 +1,237 @@
+package actions
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/docker/go-units"
+	"github.com/go-debos/debos"
+)
+
+// Size of the sparse image created when its size is automatic, shrunk at the end
+const autoImageMaxSize = 1 << 40
+
+func (i ImagePartitionAction) hasAutoSize() bool {
+	for _, p := range i.Partitions {
+		if p.Size == "auto" {
+			return true
+		}
+	}
+	return false
+}
+
+/* File passing the computed image size from the fake machine to the host,
+ * where the image is shrunk */
+func (i ImagePartitionAction) sizeFile(context *debos.Context) string {
+	return path.Join(context.Artifactdir, "."+i.ImageName+".size")
+}
+
+/* Check a sparse file of the given size can be created in a directory,
+ * rather than failing once the root filesystem is built */
+func checkSparseSize(dir string, size int64) error {
+	file, err := os.CreateTemp(dir, ".debos-sparse-")
+	if err != nil {
+		return fmt.Errorf("couldn't check the artifact directory: %w", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if err := file.Truncate(size); err != nil {
+		return fmt.Errorf("imagesize auto needs a %s sparse file in the artifact directory: %w",
+			units.BytesSize(float64(size)), err)
+	}
+	return nil
+}
+
+/* The layout of images with partitions sized from their content is only
+ * computed when running, so only check the properties of the sizes */
+func (i *ImagePartitionAction) verifyAutoSize(context *debos.Context) error {
+	if i.ImageSize == "auto" {
+		i.size = autoImageMaxSize
+		if i.MinSize != "" {
+			size, err := parseSize(i.MinSize)
+			if err != nil {
+				return fmt.Errorf("failed to parse minimal image size: %s", i.MinSize)
+			}
+			i.size = max(i.size, size)
+		}
+		if err := checkSparseSize(context.Artifactdir, i.size); err != nil {
+			return err
+		}
+	} else if i.MinSize != "" {
+		return fmt.Errorf("min property could be used only with imagesize auto")
+	}
+
+	if i.Padding != "" {
+		if _, err := parseSize(i.Padding); err != nil {
+			return fmt.Errorf("failed to parse padding: %s", i.Padding)
+		}
+	}
+
+	for idx := range i.Partitions {
+		p := &i.Partitions[idx]
+
+		// With an automatic image size the growing partition is sized from its content
+		auto := p.Size == "auto" || p.Grow && i.ImageSize == "auto"
+		if auto && i.partitionMountpoint(p) == nil {
+			return fmt.Errorf("partition %s sized from its content needs a mountpoint", p.Name)
+		}
+
+		if i.ImageSize == "auto" {
+			for _, offset := range []string{p.Start, p.End, p.Size} {
+				if strings.HasPrefix(offset, "-") || strings.HasSuffix(offset, "%") {
+					return fmt.Errorf("partition %s: offsets relative to the end of the disk can't be used with imagesize auto", p.Name)
+				}
+			}
+		}
+	}
+
+	if context.PrintRecipe {
+		log.Printf("Partition layout of %s computed from the content of the root filesystem", i.ImageName)
+	}
+
+	return nil
+}
+
+/* Disk usage of the files under a directory, except the excluded
+ * directories. Files are counted in blocks of 4KiB and hard links once */
+func contentSize(dir string, exclude []string) (int64, int64, error) {
+	const block = 4096
+	var size, inodes int64
+	seen := map[uint64]bool{}
+
+	err := filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() && slices.Contains(exclude, p) {
+			return filepath.SkipDir
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 && !d.IsDir() {
+			if seen[st.Ino] {
+				return nil
+			}
+			seen[st.Ino] = true
+		}
+
+		inodes++
+		if info.Mode().IsRegular() || d.IsDir() {
+			size += (info.Size() + block - 1) / block * block
+		}
+		return nil
+	})
+
+	return size, inodes, err
+}
+
+/* Estimated size of a filesystem holding the given content, including the
+ * metadata, journal and reserved blocks */
+func filesystemSize(fs string, content, inodes int64) int64 {
+	const MiB = 1024 * 1024
+	content += inodes * 256
+
+	switch fs {
+	case "ext2", "ext3", "ext4":
+		return content*100/85 + 16*MiB
+	case "btrfs":
+		return content*120/100 + 128*MiB
+	case "fat", "fat12", "fat16":
+		return content*110/100 + 2*MiB
+	case "fat32", "msdos", "vfat":
+		// FAT32 needs at least 65525 clusters
+		return max(content*110/100+2*MiB, 40*MiB)
+	case "erofs", "squashfs":
+		return content*105/100 + MiB
+	case "xfs":
+		return content*120/100 + 300*MiB
+	}
+	return content*120/100 + 64*MiB
+}
+
+/* Size the partitions from the content of their mountpoints in the root
+ * filesystem and, for an image of automatic size, compute its size: the end
+ * of the last partition, at least the minimal size. The growing partition
+ * then fills the image */
+func (i *ImagePartitionAction) autoLayout(context *debos.Context) error {
+	var padding int64
+	if i.Padding != "" {
+		padding, _ = parseSize(i.Padding)
+	}
+
+	for idx := range i.Partitions {
+		p := &i.Partitions[idx]
+		if p.Size != "auto" && !(p.Grow && i.ImageSize == "auto") {
+			continue
+		}
+
+		m := i.partitionMountpoint(p)
+		var exclude []string
+		for _, other := range i.Mountpoints {
+			if other.part != p && strings.HasPrefix(other.Mountpoint, strings.TrimSuffix(m.Mountpoint, "/")+"/") {
+				exclude = append(exclude, path.Join(context.Rootdir, other.Mountpoint))
+			}
+		}
+
+		content, inodes, err := contentSize(path.Join(context.Rootdir, m.Mountpoint), exclude)
+		if err != nil {
+			return fmt.Errorf("failed to compute size of %s: %w", m.Mountpoint, err)
+		}
+		size := filesystemSize(p.FS, content, inodes) + padding
+		p.autoSize = (size + int64(context.SectorSize) - 1) / int64(context.SectorSize)
+	}
+
+	if i.ImageSize == "auto" {
+		if err := i.layoutPartitions(context, true); err != nil {
+			return err
+		}
+
+		table, err := i.partitionTable(context)
+		if err != nil {
+			return err
+		}
+		// The backup GPT follows the partitions
+		trailing := table.Sectors - 1 - table.LastUsableSector()
+		var size int64
+		for _, p := range i.Partitions {
+			size = max(size, (p.end+1+trailing)*table.SectorSize)
+		}
+
+		// Round up to a MiB
+		size = (size + 1024*1024 - 1) / (1024 * 1024) * (1024 * 1024)
+		if i.MinSize != "" {
+			minSize, _ := parseSize(i.MinSize)
+			size = max(size, minSize)
+		}
+		i.size = size
+
+		if err := os.WriteFile(i.sizeFile(context), []byte(strconv.FormatInt(size, 10)), 0644); err != nil {
+			return fmt.Errorf("couldn't save image size: %w", err)
+		}
+	}
+
+	if err := i.layoutPartitions(context, false); err != nil {
+		return err
+	}
+	i.printLayout(context)
+
+	table, err := i.partitionTable(context)
+	if err != nil {
+		return err
+	}
+	return table.Validate()
+}
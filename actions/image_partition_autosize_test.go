@@ -0,0 +1,130 @@
+package actions
+
+import (
+	"os"
+	"path"
+	"strconv"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+const MiB = 1024 * 1024
+
+// Size of directories in blocks of 4KiB, which depends on the filesystem
+func dirBlocks(t *testing.T, dirs ...string) int64 {
+	var size int64
+	for _, dir := range dirs {
+		info, err := os.Stat(dir)
+		assert.NoError(t, err)
+		size += (info.Size() + 4095) / 4096 * 4096
+	}
+	return size
+}
+
+func TestContentSize(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(path.Join(dir, "a"), make([]byte, 5000), 0644))
+	// Hard links are only counted once
+	assert.NoError(t, os.Link(path.Join(dir, "a"), path.Join(dir, "b")))
+	assert.NoError(t, os.Mkdir(path.Join(dir, "sub"), 0755))
+	assert.NoError(t, os.WriteFile(path.Join(dir, "sub", "c"), nil, 0644))
+	assert.NoError(t, os.Symlink("c", path.Join(dir, "sub", "link")))
+	assert.NoError(t, os.Mkdir(path.Join(dir, "skip"), 0755))
+	assert.NoError(t, os.WriteFile(path.Join(dir, "skip", "d"), make([]byte, 5000), 0644))
+
+	size, inodes, err := contentSize(dir, []string{path.Join(dir, "skip")})
+	assert.NoError(t, err)
+	assert.Equal(t, 8192+dirBlocks(t, dir, path.Join(dir, "sub")), size)
+	assert.Equal(t, int64(5), inodes)
+
+	size, inodes, err = contentSize(path.Join(dir, "missing"), nil)
+	assert.NoError(t, err)
+	assert.Zero(t, size)
+	assert.Zero(t, inodes)
+}
+
+func TestFilesystemSize(t *testing.T) {
+	for _, tc := range []struct {
+		fs      string
+		content int64
+		inodes  int64
+		size    int64
+	}{
+		{"ext4", 85 * MiB, 0, 116 * MiB},
+		{"ext4", 84 * MiB, 4096, 116 * MiB},
+		{"btrfs", 100 * MiB, 0, 248 * MiB},
+		{"fat16", 0, 0, 2 * MiB},
+		{"vfat", 0, 0, 40 * MiB},
+		{"vfat", 100 * MiB, 0, 112 * MiB},
+		{"squashfs", 100 * MiB, 0, 106 * MiB},
+		{"xfs", 100 * MiB, 0, 420 * MiB},
+		{"f2fs", 100 * MiB, 0, 184 * MiB},
+	} {
+		assert.Equal(t, tc.size, filesystemSize(tc.fs, tc.content, tc.inodes), tc.fs)
+	}
+}
+
+func TestAutoLayout(t *testing.T) {
+	rootdir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(path.Join(rootdir, "boot/efi"), 0755))
+	file, err := os.Create(path.Join(rootdir, "data"))
+	assert.NoError(t, err)
+	assert.NoError(t, file.Truncate(85*MiB-400*1024))
+	assert.NoError(t, file.Close())
+
+	for _, tc := range []struct {
+		name   string
+		min    string
+		size   int64
+		layout [][2]int64
+	}{
+		{
+			// The partitions are sized from the content, with the padding
+			name:   "auto",
+			size:   159 * MiB,
+			layout: [][2]int64{{2048, 86015}, {86016, 325598}},
+		},
+		{
+			// The growing partition fills the image up to the minimal size
+			name:   "min",
+			min:    "200MiB",
+			size:   200 * MiB,
+			layout: [][2]int64{{2048, 86015}, {86016, 409566}},
+		},
+	} {
+		context := &debos.Context{
+			CommonContext: &debos.CommonContext{Artifactdir: t.TempDir(), Rootdir: rootdir},
+			SectorSize:    512,
+		}
+		i := ImagePartitionAction{
+			ImageName:     "test.img",
+			ImageSize:     "auto",
+			MinSize:       tc.min,
+			Padding:       "1MiB",
+			PartitionType: "gpt",
+			Partitions: []Partition{
+				{Name: "efi", FS: "vfat", Size: "auto"},
+				{Name: "root", FS: "ext4", Grow: true},
+			},
+		}
+		i.Mountpoints = []Mountpoint{
+			{Mountpoint: "/", part: &i.Partitions[1]},
+			{Mountpoint: "/boot/efi", part: &i.Partitions[0]},
+		}
+
+		assert.NoError(t, i.autoLayout(context), tc.name)
+		assert.Equal(t, tc.size, i.size, tc.name)
+
+		data, err := os.ReadFile(i.sizeFile(context))
+		assert.NoError(t, err, tc.name)
+		assert.Equal(t, strconv.FormatInt(tc.size, 10), string(data), tc.name)
+
+		var layout [][2]int64
+		for _, p := range i.Partitions {
+			layout = append(layout, [2]int64{p.start, p.end})
+		}
+		assert.Equal(t, tc.layout, layout, tc.name)
+	}
+}
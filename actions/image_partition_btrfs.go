@@ -0,0 +1,58 @@
+package actions
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"syscall"
+
+	"github.com/go-debos/debos"
+)
+
+type Subvolume struct {
+	Name       string
+	Mountpoint string
+	Options    []string
+	Default    bool
+}
+
+/* Create the subvolumes of a btrfs filesystem from its top level, parents
+ * first */
+func (i ImagePartitionAction) createSubvolumes(p *Partition, context debos.Context) error {
+	label := fmt.Sprintf("Creating subvolumes of %s", p.Name)
+	mntpath := path.Join(context.Scratchdir, "subvolumes")
+	if err := os.MkdirAll(mntpath, 0755); err != nil {
+		return fmt.Errorf("failed to create mount directory: %w", err)
+	}
+
+	err := syscall.Mount(i.filesystemDevice(p, context), mntpath, "btrfs", 0, "subvolid=5")
+	if err != nil {
+		return fmt.Errorf("%s mount failed: %w", p.Name, err)
+	}
+	defer syscall.Unmount(mntpath, 0)
+
+	subvolumes := slices.Clone(p.Subvolumes)
+	sort.SliceStable(subvolumes, func(a, b int) bool {
+		return mountDepth(subvolumes[a].Name) < mountDepth(subvolumes[b].Name)
+	})
+
+	cmd := debos.Command{}
+	for _, sv := range subvolumes {
+		svpath := path.Join(mntpath, sv.Name)
+		if err := os.MkdirAll(path.Dir(svpath), 0755); err != nil {
+			return fmt.Errorf("failed to create parent of subvolume %s: %w", sv.Name, err)
+		}
+		if err := cmd.Run(label, "btrfs", "subvolume", "create", svpath); err != nil {
+			return err
+		}
+		if sv.Default {
+			if err := cmd.Run(label, "btrfs", "subvolume", "set-default", svpath); err != nil {
+				return err
+			}
+		}
+	}
+
+	return syscall.Unmount(mntpath, 0)
+}
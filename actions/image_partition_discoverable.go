@@ -0,0 +1,121 @@
+package actions
+
+import (
+	"slices"
+	"strings"
+)
+
+// Root partition types of the Discoverable Partitions Specification, by architecture
+var gptRootTypes = map[string]string{
+	"amd64":   "4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709",
+	"arm64":   "B921B045-1DF0-41C3-AF44-4C6F280D3FAE",
+	"armel":   "69DAD710-2CE4-4E3C-B16C-21A1D49ABED3",
+	"armhf":   "69DAD710-2CE4-4E3C-B16C-21A1D49ABED3",
+	"i386":    "44479540-F297-41B2-9AF7-D131D5F0458A",
+	"riscv64": "72EC70A6-CF74-40E6-BD49-4BDA08E8F224",
+}
+
+// /usr partition types of the Discoverable Partitions Specification, by architecture
+var gptUsrTypes = map[string]string{
+	"amd64":   "8484680C-9521-48C6-9C11-B0720656F69E",
+	"arm64":   "B0E01050-EE5F-4390-949A-9101B17104E9",
+	"armel":   "7D0359A3-02B3-4F0A-865C-654403E70625",
+	"armhf":   "7D0359A3-02B3-4F0A-865C-654403E70625",
+	"i386":    "75250D76-8CC6-458E-BD66-BD47CC81A812",
+	"riscv64": "BEAEC34B-8442-439B-A40B-984381ED097D",
+}
+
+// Verity hash partition types of the root and /usr partitions, by architecture
+var gptRootVerityTypes = map[string]string{
+	"amd64": "2C7357ED-EBD2-46D9-AEC1-23D437EC2BF5",
+	"arm64": "DF3300CE-D69F-4C92-978C-9BFB0F38D820",
+}
+
+var gptUsrVerityTypes = map[string]string{
+	"amd64": "77FF5F63-E7B6-4633-ACF4-1565B864C0E6",
+	"arm64": "6E11A4E7-FBCA-4DED-B9E9-E1A512BB664E",
+}
+
+/* Partition type of the Discoverable Partitions Specification for a
+ * mountpoint, empty if the mountpoint isn't a discoverable one */
+func (i ImagePartitionAction) mountpointType(p *Partition, mountpoint, arch string) string {
+	switch mountpoint {
+	case "/":
+		return gptRootTypes[arch]
+	case "/usr":
+		return gptUsrTypes[arch]
+	case "/home":
+		return gptTypeHome
+	case "/srv":
+		return gptTypeSrv
+	case "/var":
+		return gptTypeVar
+	case "/var/tmp":
+		return gptTypeVarTmp
+	case "/efi", "/boot/efi":
+		return gptTypeESP
+	case "/boot":
+		// /boot is the ESP itself unless there is another one
+		switch p.FS {
+		case "fat", "fat12", "fat16", "fat32", "msdos", "vfat":
+			if !slices.ContainsFunc(i.Mountpoints, func(m Mountpoint) bool {
+				return m.Mountpoint == "/efi" || m.Mountpoint == "/boot/efi"
+			}) {
+				return gptTypeESP
+			}
+		}
+		return gptTypeXBootLdr
+	}
+	return ""
+}
+
+/* Partition type of the Discoverable Partitions Specification for a
+ * partition, from its mountpoint or the one of the partition it holds the
+ * verity hash tree of */
+func (i ImagePartitionAction) discoverableType(p *Partition, arch string) string {
+	for _, data := range i.volumes() {
+		if data.Verity == nil || data.Verity.hashPart != p {
+			continue
+		}
+		if m := i.partitionMountpoint(data); m != nil {
+			switch m.Mountpoint {
+			case "/":
+				return gptRootVerityTypes[arch]
+			case "/usr":
+				return gptUsrVerityTypes[arch]
+			}
+		}
+		return ""
+	}
+
+	m := i.partitionMountpoint(p)
+	if m == nil || m.Buildtime {
+		return ""
+	}
+	return i.mountpointType(p, m.Mountpoint, arch)
+}
+
+/* Whether systemd-gpt-auto-generator mounts a partition by itself, from its
+ * type, so it doesn't need an fstab entry. Swap partitions have no mountpoint */
+func (i ImagePartitionAction) gptAutoMounted(p *Partition, m *Mountpoint, arch string) bool {
+	if !i.GptAuto || p.volumeGroup != nil {
+		return false
+	}
+
+	expected := gptTypeSwap
+	if m != nil {
+		switch m.Mountpoint {
+		case "/", "/usr", "/home", "/srv", "/efi", "/boot":
+		default:
+			return false
+		}
+		// The generator mounts the default subvolume
+		if m.subvolume != "" && m.Mountpoint != "/" {
+			return false
+		}
+		expected = i.mountpointType(p, m.Mountpoint, arch)
+	}
+
+	entry, err := i.partitionTableEntry(p)
+	return err == nil && expected != "" && strings.EqualFold(entry.Type, expected)
+}
@@ -0,0 +1,88 @@
+package actions
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/go-debos/debos"
+	"github.com/google/uuid"
+)
+
+type Encryption struct {
+	Name       string
+	Keyfile    string
+	Key        string
+	Passphrase string
+	Cipher     string
+	Options    []string
+	uuid       string
+	opened     bool
+}
+
+func (i *ImagePartitionAction) generateCrypttab(context *debos.Context) {
+	context.ImageCrypttab.Reset()
+
+	for _, p := range i.Partitions {
+		if p.Encryption == nil {
+			continue
+		}
+		options := append([]string{"luks"}, p.Encryption.Options...)
+		context.ImageCrypttab.WriteString(fmt.Sprintf("%s\tUUID=%s\tnone\t%s\n",
+			p.Encryption.Name, p.Encryption.uuid, strings.Join(options, ",")))
+	}
+}
+
+/* Format a partition as LUKS2 and open it. A key given in the recipe is only
+ * written to the scratch directory while it's needed */
+func (i ImagePartitionAction) encryptPartition(p *Partition, context debos.Context) error {
+	e := p.Encryption
+	label := fmt.Sprintf("Encrypting partition %d", p.number)
+	device := i.getPartitionDevice(p.number, context)
+
+	keyfile := e.Keyfile
+	if e.Key != "" {
+		keyfile = path.Join(context.Scratchdir, p.Name+".key")
+		if err := os.WriteFile(keyfile, []byte(e.Key), 0600); err != nil {
+			return fmt.Errorf("failed to write key of partition %s: %w", p.Name, err)
+		}
+		defer os.Remove(keyfile)
+	} else if !path.IsAbs(keyfile) {
+		keyfile = path.Join(context.RecipeDir, keyfile)
+	}
+
+	e.uuid = uuid.NewString()
+	cmdline := []string{"cryptsetup", "luksFormat", "--batch-mode", "--type", "luks2",
+		"--uuid", e.uuid, "--key-file", keyfile}
+	if e.Cipher != "" {
+		cmdline = append(cmdline, "--cipher", e.Cipher)
+	}
+	cmdline = append(cmdline, device)
+	err := debos.Command{}.Run(label, cmdline...)
+	if err != nil {
+		return err
+	}
+
+	if e.Passphrase != "" {
+		passfile := path.Join(context.Scratchdir, p.Name+".passphrase")
+		if err := os.WriteFile(passfile, []byte(e.Passphrase), 0600); err != nil {
+			return fmt.Errorf("failed to write passphrase of partition %s: %w", p.Name, err)
+		}
+		defer os.Remove(passfile)
+
+		err = debos.Command{}.Run(label, "cryptsetup", "luksAddKey", "--batch-mode",
+			"--key-file", keyfile, device, passfile)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = debos.Command{}.Run(label, "cryptsetup", "open", "--key-file", keyfile, device, e.Name)
+	if err != nil {
+		return err
+	}
+	e.opened = true
+
+	return nil
+}
@@ -0,0 +1,140 @@
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+type VolumeGroup struct {
+	Name            string
+	PhysicalVolumes []string    `yaml:"physicalvolumes"`
+	LogicalVolumes  []Partition `yaml:"logicalvolumes"`
+	pvs             []*Partition
+	active          bool
+}
+
+// lvcreate(8) arguments for the size of a logical volume
+func logicalVolumeSize(lv *Partition, sectorSize int) ([]string, error) {
+	if lv.Grow {
+		return []string{"--extents", "100%FREE"}, nil
+	}
+	if percent, ok := strings.CutSuffix(lv.Size, "%"); ok {
+		if _, err := strconv.ParseFloat(percent, 64); err != nil {
+			return nil, fmt.Errorf("invalid size %s", lv.Size)
+		}
+		return []string{"--extents", percent + "%VG"}, nil
+	}
+	sectors, err := partitionSize(lv.Size, 0, int64(sectorSize))
+	if err != nil {
+		return nil, err
+	}
+	return []string{"--size", fmt.Sprintf("%db", sectors*int64(sectorSize))}, nil
+}
+
+// Create and activate the volume group on its physical volumes
+func (i ImagePartitionAction) createVolumeGroup(context *debos.Context) error {
+	vg := i.VolumeGroup
+	label := fmt.Sprintf("Creating volume group %s", vg.Name)
+
+	var devices []string
+	for _, p := range vg.pvs {
+		devices = append(devices, i.filesystemDevice(p, *context))
+	}
+
+	cmd := debos.Command{}
+	err := cmd.Run(label, append([]string{"pvcreate", "--yes", "--force"}, devices...)...)
+	if err != nil {
+		return err
+	}
+
+	err = cmd.Run(label, append([]string{"vgcreate", "--yes", vg.Name}, devices...)...)
+	if err != nil {
+		return err
+	}
+	vg.active = true
+
+	for idx := range vg.LogicalVolumes {
+		lv := &vg.LogicalVolumes[idx]
+		size, err := logicalVolumeSize(lv, context.SectorSize)
+		if err != nil {
+			return fmt.Errorf("logical volume %s: %w", lv.Name, err)
+		}
+
+		cmdline := []string{"lvcreate", "--yes", "--wipesignatures", "y", "--name", lv.Name}
+		cmdline = append(cmdline, size...)
+		err = cmd.Run(label, append(cmdline, vg.Name)...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return cmd.Run(label, "vgchange", "--activate", "y", vg.Name)
+}
+
+func (i *ImagePartitionAction) verifyVolumeGroup() error {
+	vg := i.VolumeGroup
+
+	if i.Rootless {
+		return errors.New("volume groups are not supported in rootless mode")
+	}
+	if vg.Name == "" {
+		return errors.New("volume group without a name")
+	}
+
+	if len(vg.PhysicalVolumes) == 0 {
+		return fmt.Errorf("volume group %s without physical volumes", vg.Name)
+	}
+	for _, name := range vg.PhysicalVolumes {
+		idx := slices.IndexFunc(i.Partitions, func(p Partition) bool { return p.Name == name })
+		if idx < 0 {
+			return fmt.Errorf("couldn't find partition %s for volume group %s", name, vg.Name)
+		}
+		p := &i.Partitions[idx]
+		if p.FS != "none" {
+			return fmt.Errorf("physical volume %s can't have a filesystem", p.Name)
+		}
+		if p.PartType == "" && !slices.Contains(p.Flags, "lvm") {
+			p.Flags = append(p.Flags, "lvm")
+		}
+		vg.pvs = append(vg.pvs, p)
+	}
+
+	if len(vg.LogicalVolumes) == 0 {
+		return fmt.Errorf("volume group %s without logical volumes", vg.Name)
+	}
+	for idx := range vg.LogicalVolumes {
+		lv := &vg.LogicalVolumes[idx]
+		lv.volumeGroup = vg
+
+		if lv.Name == "" {
+			return fmt.Errorf("logical volume without a name")
+		}
+		if slices.ContainsFunc(i.Partitions, func(p Partition) bool { return p.Name == lv.Name }) ||
+			slices.ContainsFunc(vg.LogicalVolumes[idx+1:], func(p Partition) bool { return p.Name == lv.Name }) {
+			return fmt.Errorf("partition %s already exists", lv.Name)
+		}
+
+		if err := i.verifyFilesystem(lv); err != nil {
+			return err
+		}
+
+		switch {
+		case lv.Start != "" || lv.End != "" || lv.Encryption != nil:
+			return fmt.Errorf("logical volume %s can only have a size", lv.Name)
+		case lv.Grow && idx != len(vg.LogicalVolumes)-1:
+			return fmt.Errorf("only the last logical volume can grow, not %s", lv.Name)
+		case lv.Size == "" && !lv.Grow:
+			return fmt.Errorf("logical volume %s missing size", lv.Name)
+		}
+		if _, err := logicalVolumeSize(lv, 512); err != nil {
+			return fmt.Errorf("logical volume %s: %w", lv.Name, err)
+		}
+	}
+
+	return nil
+}
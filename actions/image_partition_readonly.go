@@ -0,0 +1,90 @@
+package actions
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/go-debos/debos"
+)
+
+// Filesystems generated at the end of the recipe rather than formatted
+func readOnlyFS(fs string) bool {
+	return fs == "erofs" || fs == "squashfs"
+}
+
+// Directory of the content of a read-only filesystem given by its source
+func (i ImagePartitionAction) sourceDir(p *Partition, context *debos.Context) (string, error) {
+	base := context.Rootdir
+	if p.Origin != "" {
+		origin, found := context.Origin(p.Origin)
+		if !found {
+			return "", fmt.Errorf("origin not found '%s'", p.Origin)
+		}
+		base = origin
+	}
+	return path.Join(base, p.Source), nil
+}
+
+/* Generate the read-only filesystems on their devices once the root
+ * filesystem is complete. The content of a mountpoint is taken from a
+ * non-recursive bind mount, leaving out the partitions mounted in a read-only
+ * root filesystem, and removed afterwards as it would be hidden in the
+ * filesystem it is in */
+func (i ImagePartitionAction) generateReadOnly(context *debos.Context) error {
+	for _, p := range i.volumes() {
+		if !readOnlyFS(p.FS) {
+			continue
+		}
+		label := fmt.Sprintf("Generating partition %s", p.Name)
+		device := i.filesystemDevice(p, *context)
+
+		if p.Source != "" || p.Origin != "" {
+			source, err := i.sourceDir(p, context)
+			if err != nil {
+				return err
+			}
+			if err := i.runMkfs(p, label, i.mkfsCommand(p, device, source)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := i.generateReadOnlyMountpoint(context, p, label, device); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/* Generate a read-only filesystem from the bind mounted content of its
+ * mountpoint, unmounted whatever happens so the next one can be mounted */
+func (i ImagePartitionAction) generateReadOnlyMountpoint(context *debos.Context, p *Partition, label, device string) error {
+	m := i.partitionMountpoint(p)
+	source := path.Join(context.Scratchdir, "readonly")
+	if err := os.MkdirAll(source, 0755); err != nil {
+		return fmt.Errorf("failed to create mount directory: %w", err)
+	}
+	err := syscall.Mount(path.Join(context.ImageMntDir, m.Mountpoint), source, "", syscall.MS_BIND, "")
+	if err != nil {
+		return fmt.Errorf("failed to bind mount %s: %w", m.Mountpoint, err)
+	}
+
+	err = i.runMkfs(p, label, i.mkfsCommand(p, device, source))
+	if err == nil && m.Mountpoint != "/" {
+		var entries []os.DirEntry
+		entries, err = os.ReadDir(source)
+		for _, e := range entries {
+			if err = os.RemoveAll(path.Join(source, e.Name())); err != nil {
+				break
+			}
+		}
+	}
+
+	if uerr := syscall.Unmount(source, 0); uerr != nil && err == nil {
+		err = fmt.Errorf("failed to unmount %s: %w", source, uerr)
+	}
+	return err
+}
@@ -0,0 +1,241 @@
+package actions
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/go-debos/debos"
+	"github.com/google/uuid"
+)
+
+// File holding the filesystem of a partition in rootless mode
+func partitionFile(context *debos.Context, p *Partition) string {
+	return path.Join(context.Scratchdir, "partitions", p.Name+".img")
+}
+
+// Directory with the content of the filesystem of a partition in rootless mode
+func partitionSource(context *debos.Context, p *Partition) string {
+	return path.Join(context.Scratchdir, "partitions", p.Name)
+}
+
+/* In rootless mode the partitions are files, only formatted once all the
+ * actions ran, and the mountpoints are plain directories until then. The
+ * filesystem UUIDs are generated beforehand for fstab */
+func (i ImagePartitionAction) runRootless(context *debos.Context) error {
+	err := i.writePartitionTable(context)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(path.Join(context.Scratchdir, "partitions"), 0755); err != nil {
+		return fmt.Errorf("failed to create partitions directory: %w", err)
+	}
+
+	for idx := range i.Partitions {
+		p := &i.Partitions[idx]
+
+		if p.FSUUID == "" {
+			switch p.FS {
+			case "btrfs", "ext2", "ext3", "ext4", "erofs", "swap":
+				p.FSUUID = uuid.NewString()
+			case "fat", "fat12", "fat16", "fat32", "msdos", "vfat":
+				id := uuid.New()
+				p.FSUUID = strings.ToUpper(hex.EncodeToString(id[:4]))
+			}
+		}
+
+		file := partitionFile(context, p)
+		f, err := os.Create(file)
+		if err != nil {
+			return fmt.Errorf("couldn't create partition file: %w", err)
+		}
+		err = f.Truncate((p.end - p.start + 1) * int64(context.SectorSize))
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("couldn't resize partition file: %w", err)
+		}
+
+		context.ImagePartitions = append(context.ImagePartitions,
+			debos.Partition{Name: p.Name, DevicePath: file})
+	}
+
+	context.ImageMntDir = path.Join(context.Scratchdir, "mnt")
+	for _, m := range i.Mountpoints {
+		mntpath := path.Join(context.ImageMntDir, m.Mountpoint)
+		if err := os.MkdirAll(mntpath, 0755); err != nil {
+			return fmt.Errorf("failed to create mountpoint %s: %w", mntpath, err)
+		}
+	}
+
+	err = i.generateFSTab(context)
+	if err != nil {
+		return err
+	}
+
+	return i.generateKernelRoot(context)
+}
+
+/* Create the filesystems of the partitions from the content of their
+ * mountpoints and write them to the image. The deepest mountpoints are
+ * moved out of the tree first, so their content doesn't end up in the
+ * filesystems they are nested in */
+func (i ImagePartitionAction) assemble(context *debos.Context) error {
+	// Sources in the root filesystem are used before it is split
+	for idx := range i.Partitions {
+		p := &i.Partitions[idx]
+		if p.Source == "" && p.Origin == "" {
+			continue
+		}
+		source, err := i.sourceDir(p, context)
+		if err != nil {
+			return err
+		}
+		label := fmt.Sprintf("Formatting partition %d", p.number)
+		if err := i.runMkfs(p, label, i.mkfsCommand(p, partitionFile(context, p), source)); err != nil {
+			return err
+		}
+	}
+
+	mountpoints := slices.Clone(i.Mountpoints)
+	sort.SliceStable(mountpoints, func(a, b int) bool {
+		return mountDepth(mountpoints[a].Mountpoint) > mountDepth(mountpoints[b].Mountpoint)
+	})
+
+	for _, m := range mountpoints {
+		mntpath := path.Join(context.ImageMntDir, m.Mountpoint)
+		err := os.Rename(mntpath, partitionSource(context, m.part))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to move content of %s: %w", m.Mountpoint, err)
+		}
+		if m.Mountpoint != "/" && !m.Buildtime {
+			if err := os.Mkdir(mntpath, 0755); err != nil {
+				return fmt.Errorf("failed to recreate mountpoint %s: %w", mntpath, err)
+			}
+		}
+	}
+
+	/* The verity partitions are final once formatted, the kernel command line
+	 * in the root filesystem can then be updated before it is formatted */
+	for _, verity := range []bool{true, false} {
+		for idx := range i.Partitions {
+			p := &i.Partitions[idx]
+			if (p.Verity != nil) != verity || p.FS == "none" || p.Source != "" || p.Origin != "" {
+				continue
+			}
+			if err := i.formatFile(context, p); err != nil {
+				return err
+			}
+		}
+
+		if verity {
+			cmdline := ""
+			if m := slices.IndexFunc(i.Mountpoints, func(m Mountpoint) bool { return m.Mountpoint == "/" }); m >= 0 {
+				cmdline = path.Join(partitionSource(context, i.Mountpoints[m].part), "etc/kernel/cmdline")
+			}
+			device := func(p *Partition) string { return partitionFile(context, p) }
+			if err := i.generateVerity(context, device, cmdline); err != nil {
+				return err
+			}
+		}
+	}
+
+	image, err := os.OpenFile(context.Image, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("couldn't open image: %w", err)
+	}
+	defer image.Close()
+
+	for idx := range i.Partitions {
+		p := &i.Partitions[idx]
+		file := partitionFile(context, p)
+		size := (p.end - p.start + 1) * int64(context.SectorSize)
+		err := splicePartition(image, file, p.start*int64(context.SectorSize), size)
+		if err != nil {
+			return fmt.Errorf("partition %s: %w", p.Name, err)
+		}
+	}
+
+	return image.Sync()
+}
+
+// Format a partition file with the content of its mountpoints
+func (i ImagePartitionAction) formatFile(context *debos.Context, p *Partition) error {
+	file := partitionFile(context, p)
+	source := partitionSource(context, p)
+	if err := os.MkdirAll(source, 0755); err != nil {
+		return err
+	}
+
+	label := fmt.Sprintf("Formatting partition %d", p.number)
+	switch p.FS {
+	case "fat", "fat12", "fat16", "fat32", "msdos", "vfat":
+		// mkfs.vfat can't populate the filesystem, mcopy does
+		if err := i.runMkfs(p, label, i.mkfsCommand(p, file, "")); err != nil {
+			return err
+		}
+		return copyToFAT(file, source)
+	}
+	return i.runMkfs(p, label, i.mkfsCommand(p, file, source))
+}
+
+// Copy the content of a directory to a FAT filesystem image
+func copyToFAT(image, source string) error {
+	entries, err := os.ReadDir(source)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	cmdline := []string{"mcopy", "-i", image, "-s", "-p", "-m", "-Q"}
+	for _, e := range entries {
+		cmdline = append(cmdline, path.Join(source, e.Name()))
+	}
+	cmdline = append(cmdline, "::/")
+
+	return debos.Command{}.Run("Populating FAT filesystem", cmdline...)
+}
+
+/* Write a partition file to the image at the given offset. The image is
+ * sparse, so blocks of zeroes are skipped */
+func splicePartition(image *os.File, file string, offset, size int64) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() > size {
+		return fmt.Errorf("filesystem of %d bytes doesn't fit in the partition of %d bytes", info.Size(), size)
+	}
+
+	buf := make([]byte, 1024*1024)
+	zero := make([]byte, len(buf))
+	for pos := int64(0); ; {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 && !bytes.Equal(buf[:n], zero[:n]) {
+			if _, err := image.WriteAt(buf[:n], offset+pos); err != nil {
+				return err
+			}
+		}
+		pos += int64(n)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package actions
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"al.essio.dev/pkg/shellescape"
+	"github.com/go-debos/debos"
+	"github.com/google/uuid"
+)
+
+type Verity struct {
+	HashPartition string `yaml:"hashpartition"`
+	Salt          string
+	UUID          string
+	Cmdline       bool
+	hashPart      *Partition
+	hashOffset    int64 // Offset of an appended hash tree, in bytes
+	rootHash      string
+}
+
+// Size of a read-only filesystem, read from its superblock
+func readOnlySize(device, fs string) (int64, error) {
+	f, err := os.Open(device)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	// Small squashfs filesystems can be shorter than the erofs superblock
+	sb := make([]byte, 2048)
+	n, err := f.ReadAt(sb, 0)
+	if err != nil && err != io.EOF {
+		return 0, fmt.Errorf("failed to read superblock of %s: %w", device, err)
+	}
+	sb = sb[:n]
+
+	switch fs {
+	case "squashfs":
+		if len(sb) < 48 || string(sb[0:4]) != "hsqs" {
+			return 0, fmt.Errorf("no squashfs filesystem on %s", device)
+		}
+		return int64(binary.LittleEndian.Uint64(sb[40:48])), nil
+	case "erofs":
+		if len(sb) < 1064 || binary.LittleEndian.Uint32(sb[1024:1028]) != 0xe0f5e1e2 {
+			return 0, fmt.Errorf("no erofs filesystem on %s", device)
+		}
+		erofs := sb[1024:]
+		return int64(binary.LittleEndian.Uint32(erofs[36:40])) << erofs[12], nil
+	}
+	return 0, fmt.Errorf("size of filesystem %s unknown", fs)
+}
+
+/* Compute the hash tree of a partition with veritysetup, on its hash
+ * partition or appended to its filesystem, on the devices or files of the
+ * partitions */
+func (i ImagePartitionAction) formatVerity(context *debos.Context, p *Partition, device func(*Partition) string, size int64) error {
+	const blockSize = 4096
+	v := p.Verity
+	data := device(p)
+
+	cmdline := []string{"veritysetup", "format"}
+	hash := data
+	if v.hashPart != nil {
+		hash = device(v.hashPart)
+	} else {
+		fsSize, err := readOnlySize(data, p.FS)
+		if err != nil {
+			return err
+		}
+		blocks := (fsSize + blockSize - 1) / blockSize
+		v.hashOffset = blocks * blockSize
+		if v.hashOffset >= size {
+			return fmt.Errorf("no room for the hash tree of partition %s", p.Name)
+		}
+		cmdline = append(cmdline, fmt.Sprintf("--data-blocks=%d", blocks),
+			fmt.Sprintf("--hash-offset=%d", v.hashOffset))
+	}
+
+	// Random defaults are generated here, rather than parsed from the output
+	if v.Salt == "" {
+		salt := make([]byte, 32)
+		if _, err := rand.Read(salt); err != nil {
+			return fmt.Errorf("failed to generate salt of partition %s: %w", p.Name, err)
+		}
+		v.Salt = hex.EncodeToString(salt)
+	}
+	if v.UUID == "" {
+		v.UUID = uuid.NewString()
+	}
+
+	roothashFile := path.Join(context.Scratchdir, p.Name+".roothash")
+	defer os.Remove(roothashFile)
+	cmdline = append(cmdline, "--salt", v.Salt, "--uuid", v.UUID,
+		"--root-hash-file", roothashFile, data, hash)
+
+	label := fmt.Sprintf("Computing hash tree of partition %s", p.Name)
+	err := debos.Command{}.Run(label, cmdline...)
+	if err != nil {
+		return fmt.Errorf("veritysetup failed: %w", err)
+	}
+
+	rootHash, err := os.ReadFile(roothashFile)
+	if err != nil {
+		return fmt.Errorf("no root hash for partition %s: %w", p.Name, err)
+	}
+	v.rootHash = strings.TrimSpace(string(rootHash))
+
+	// An appended hash tree must fit in the partition
+	if v.hashPart == nil {
+		if info, err := os.Stat(hash); err == nil && info.Mode().IsRegular() && info.Size() > size {
+			return fmt.Errorf("no room for the hash tree of partition %s", p.Name)
+		}
+	}
+
+	return nil
+}
+
+// Kernel command line arguments to verify a partition mounted as / or /usr
+func (i ImagePartitionAction) verityCmdline(p *Partition) ([]string, error) {
+	m := i.partitionMountpoint(p)
+	if m == nil || (m.Mountpoint != "/" && m.Mountpoint != "/usr") {
+		return nil, nil
+	}
+
+	name := "root"
+	args := []string{"roothash=" + p.Verity.rootHash}
+	if m.Mountpoint == "/usr" {
+		name = "usr"
+		args = []string{"usrhash=" + p.Verity.rootHash}
+	}
+
+	data, err := i.partitionSpec(p)
+	if err != nil {
+		return nil, err
+	}
+	hash := data
+	if p.Verity.hashPart != nil {
+		hash, err = i.partitionSpec(p.Verity.hashPart)
+		if err != nil {
+			return nil, err
+		}
+	}
+	args = append(args, fmt.Sprintf("systemd.verity_%s_data=%s", name, data),
+		fmt.Sprintf("systemd.verity_%s_hash=%s", name, hash))
+	if p.Verity.hashPart == nil {
+		args = append(args, fmt.Sprintf("systemd.verity_%s_options=hash-offset=%d", name, p.Verity.hashOffset))
+	}
+	return args, nil
+}
+
+// Characters of partition names not allowed in shell variable names
+var verityPrefixInvalid = regexp.MustCompile("[^A-Za-z0-9]")
+
+/* Compute the hash trees of the verity partitions, append the kernel command
+ * line arguments to the cmdline file if asked to and write the verity
+ * metadata artifact */
+func (i ImagePartitionAction) generateVerity(context *debos.Context, device func(*Partition) string, cmdlineFile string) error {
+	var metadata []string
+	var cmdline []string
+
+	for _, p := range i.volumes() {
+		if p.Verity == nil {
+			continue
+		}
+		size := (p.end - p.start + 1) * int64(context.SectorSize)
+		if err := i.formatVerity(context, p, device, size); err != nil {
+			return err
+		}
+
+		args, err := i.verityCmdline(p)
+		if err != nil {
+			return err
+		}
+		if p.Verity.Cmdline {
+			cmdline = append(cmdline, args...)
+		}
+
+		prefix := strings.ToUpper(verityPrefixInvalid.ReplaceAllString(p.Name, "_"))
+		metadata = append(metadata,
+			fmt.Sprintf("%s_ROOTHASH=%s", prefix, p.Verity.rootHash),
+			fmt.Sprintf("%s_SALT=%s", prefix, p.Verity.Salt),
+			fmt.Sprintf("%s_UUID=%s", prefix, p.Verity.UUID),
+			fmt.Sprintf("%s_HASH_OFFSET=%d", prefix, p.Verity.hashOffset),
+			fmt.Sprintf("%s_CMDLINE=%s", prefix, shellescape.Quote(strings.Join(args, " "))))
+	}
+
+	if len(metadata) == 0 {
+		return nil
+	}
+
+	if len(cmdline) > 0 {
+		current, err := os.ReadFile(cmdlineFile)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.MkdirAll(path.Dir(cmdlineFile), 0755); err != nil {
+			return err
+		}
+		args := append([]string{strings.TrimSpace(string(current))}, cmdline...)
+		if err := os.WriteFile(cmdlineFile, []byte(strings.TrimSpace(strings.Join(args, " "))+"\n"), 0644); err != nil {
+			return fmt.Errorf("couldn't write /etc/kernel/cmdline: %w", err)
+		}
+	}
+
+	return os.WriteFile(i.verityArtifact(context), []byte(strings.Join(metadata, "\n")+"\n"), 0644)
+}
+
+func (i ImagePartitionAction) verityArtifact(context *debos.Context) string {
+	return path.Join(context.Artifactdir, i.ImageName+".verity")
+}
+
+func (i *ImagePartitionAction) verifyVerity(p *Partition) error {
+	v := p.Verity
+
+	switch {
+	case p.volumeGroup != nil:
+		return fmt.Errorf("verity is not supported for logical volume %s", p.Name)
+	case readOnlyFS(p.FS):
+	case p.FS == "none" && v.HashPartition != "":
+	default:
+		return fmt.Errorf("verity of %s needs an erofs or squashfs filesystem, or a hash partition", p.Name)
+	}
+
+	if v.HashPartition != "" {
+		idx := slices.IndexFunc(i.Partitions, func(h Partition) bool { return h.Name == v.HashPartition })
+		if idx < 0 {
+			return fmt.Errorf("couldn't find hash partition %s of %s", v.HashPartition, p.Name)
+		}
+		v.hashPart = &i.Partitions[idx]
+		if v.hashPart == p || v.hashPart.FS != "none" || v.hashPart.Verity != nil {
+			return fmt.Errorf("hash partition %s of %s must be another partition without filesystem", v.HashPartition, p.Name)
+		}
+		for _, other := range i.volumes() {
+			if other != p && other.Verity != nil && other.Verity.HashPartition == v.HashPartition {
+				return fmt.Errorf("hash partition %s is already used by %s", v.HashPartition, other.Name)
+			}
+		}
+		if i.PartitionType == "gpt" && v.hashPart.PartUUID == "" {
+			v.hashPart.PartUUID = uuid.NewString()
+		}
+	}
+
+	if v.Salt != "" {
+		if _, err := hex.DecodeString(v.Salt); err != nil {
+			return fmt.Errorf("incorrect verity salt %s, should be hexadecimal", v.Salt)
+		}
+	}
+	if v.UUID != "" {
+		if _, err := uuid.Parse(v.UUID); err != nil {
+			return fmt.Errorf("incorrect verity UUID %s", v.UUID)
+		}
+	}
+
+	if v.Cmdline {
+		m := i.partitionMountpoint(p)
+		switch {
+		case m == nil || m.Mountpoint != "/" && m.Mountpoint != "/usr":
+			return fmt.Errorf("verity of %s can only be on the kernel command line if mounted as / or /usr", p.Name)
+		case m.Mountpoint == "/":
+			return fmt.Errorf("verity of %s can't be on the kernel command line, which is in the partition", p.Name)
+		}
+	}
+
+	if i.PartitionType == "gpt" && p.volumeGroup == nil && p.PartUUID == "" {
+		p.PartUUID = uuid.NewString()
+	}
+
+	return nil
+}
@@ -0,0 +1,91 @@
+package actions
+
+import (
+	"encoding/binary"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadOnlySize(t *testing.T) {
+	dir := t.TempDir()
+
+	// Small squashfs, shorter than the erofs superblock
+	squashfs := make([]byte, 96)
+	copy(squashfs, "hsqs")
+	binary.LittleEndian.PutUint64(squashfs[40:], 12345)
+	assert.NoError(t, os.WriteFile(path.Join(dir, "squashfs"), squashfs, 0644))
+
+	erofs := make([]byte, 4096)
+	binary.LittleEndian.PutUint32(erofs[1024:], 0xe0f5e1e2)
+	erofs[1024+12] = 12
+	binary.LittleEndian.PutUint32(erofs[1024+36:], 10)
+	assert.NoError(t, os.WriteFile(path.Join(dir, "erofs"), erofs, 0644))
+
+	size, err := readOnlySize(path.Join(dir, "squashfs"), "squashfs")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(12345), size)
+
+	size, err = readOnlySize(path.Join(dir, "erofs"), "erofs")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10<<12), size)
+
+	_, err = readOnlySize(path.Join(dir, "erofs"), "squashfs")
+	assert.EqualError(t, err, "no squashfs filesystem on "+path.Join(dir, "erofs"))
+
+	_, err = readOnlySize(path.Join(dir, "squashfs"), "erofs")
+	assert.EqualError(t, err, "no erofs filesystem on "+path.Join(dir, "squashfs"))
+
+	_, err = readOnlySize(path.Join(dir, "erofs"), "ext4")
+	assert.EqualError(t, err, "size of filesystem ext4 unknown")
+
+	_, err = readOnlySize(path.Join(dir, "missing"), "erofs")
+	assert.Error(t, err)
+}
+
+func TestVerityCmdline(t *testing.T) {
+	root := &Partition{Name: "root", FS: "erofs", PartUUID: "11111111-1111-1111-1111-111111111111",
+		Verity: &Verity{rootHash: "abcd", hashOffset: 8192}}
+	hash := &Partition{Name: "usr-verity", FS: "none", PartUUID: "33333333-3333-3333-3333-333333333333"}
+	usr := &Partition{Name: "usr", FS: "squashfs", PartUUID: "22222222-2222-2222-2222-222222222222",
+		Verity: &Verity{rootHash: "ef01", hashPart: hash}}
+	srv := &Partition{Name: "srv", FS: "erofs", PartUUID: "44444444-4444-4444-4444-444444444444",
+		Verity: &Verity{rootHash: "2345", hashOffset: 4096}}
+
+	i := ImagePartitionAction{
+		PartitionType: "gpt",
+		Mountpoints: []Mountpoint{
+			{Mountpoint: "/", part: root},
+			{Mountpoint: "/usr", part: usr},
+			{Mountpoint: "/srv", part: srv},
+		},
+	}
+
+	args, err := i.verityCmdline(root)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"roothash=abcd",
+		"systemd.verity_root_data=PARTUUID=11111111-1111-1111-1111-111111111111",
+		"systemd.verity_root_hash=PARTUUID=11111111-1111-1111-1111-111111111111",
+		"systemd.verity_root_options=hash-offset=8192",
+	}, args)
+
+	args, err = i.verityCmdline(usr)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"usrhash=ef01",
+		"systemd.verity_usr_data=PARTUUID=22222222-2222-2222-2222-222222222222",
+		"systemd.verity_usr_hash=PARTUUID=33333333-3333-3333-3333-333333333333",
+	}, args)
+
+	// Only partitions mounted as / or /usr are verified from the kernel command line
+	args, err = i.verityCmdline(srv)
+	assert.NoError(t, err)
+	assert.Nil(t, args)
+
+	hash.PartUUID = ""
+	_, err = i.verityCmdline(usr)
+	assert.EqualError(t, err, "missing partition UUID for partition usr-verity")
+}
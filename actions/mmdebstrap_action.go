@@ -27,6 +27,8 @@ Optional properties:
 
   - mirrors -- list of URLs with Debian-compatible repository
     If no mirror is specified debos will use http://deb.debian.org/debian as default.
+    The URLs are rewritten according to the '--url-rewrite' command line options
+    for bootstrapping, the apt sources of the image keep the original mirrors.
 
 - variant -- name of the bootstrap script variant to use
 
@@ -55,6 +57,8 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"path/filepath"
+	"regexp"
 	"strings"
 
 	"github.com/go-debos/debos"
@@ -176,9 +180,11 @@ func (d *MmdebstrapAction) Run(context *debos.Context) error {
 	cmdline = append(cmdline, d.Suite)
 	cmdline = append(cmdline, context.Rootdir)
 
-	if d.Mirrors != nil {
-		cmdline = append(cmdline, d.Mirrors...)
+	rewritten := []string{}
+	for _, mirror := range d.Mirrors {
+		rewritten = append(rewritten, context.RewriteURLsIn(mirror))
 	}
+	cmdline = append(cmdline, rewritten...)
 
 	/* Make sure files in /etc/apt/ exist inside the fakemachine otherwise
 	   mmdebstrap prints a warning about the path not existing. */
@@ -192,6 +198,11 @@ func (d *MmdebstrapAction) Run(context *debos.Context) error {
 	}
 
 	mmdebstrapErr := debos.Command{}.Run("mmdebstrap", cmdline...)
+	if mmdebstrapErr == nil {
+		if err := restoreMirrors(context.Rootdir, d.Mirrors, rewritten); err != nil {
+			return err
+		}
+	}
 
 	/* Cleanup resolv.conf after mmdebstrap */
 	resolvconf := path.Join(context.Rootdir, "/etc/resolv.conf")
@@ -203,3 +214,47 @@ func (d *MmdebstrapAction) Run(context *debos.Context) error {
 
 	return mmdebstrapErr
 }
+
+/* mmdebstrap writes the mirrors it was given to the apt sources of the
+ * rootfs, which keep the original mirrors instead of the rewritten ones */
+func restoreMirrors(rootdir string, mirrors, rewritten []string) error {
+	originals := map[string]string{}
+	for i, mirror := range mirrors {
+		fields := strings.Fields(rewritten[i])
+		for j, f := range strings.Fields(mirror) {
+			if fields[j] != f {
+				originals[fields[j]] = f
+			}
+		}
+	}
+	if len(originals) == 0 {
+		return nil
+	}
+
+	files, err := filepath.Glob(path.Join(rootdir, "etc/apt/sources.list.d/*"))
+	if err != nil {
+		return err
+	}
+	files = append(files, path.Join(rootdir, "etc/apt/sources.list"))
+
+	word := regexp.MustCompile(`\S+`)
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		restored := word.ReplaceAllStringFunc(string(data), func(w string) string {
+			if original, ok := originals[w]; ok {
+				return original
+			}
+			return w
+		})
+		if err := os.WriteFile(file, []byte(restored), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -15,9 +15,30 @@ Mandatory properties:
 
 Optional properties:
 
-- compression -- compression type to use. Currently 'bzip2', 'gz', 'lzip', lzma', 'lzop',
+- format -- archive format to create: 'tar' (the default), 'cpio' or 'zip'. The 'cpio'
+format creates a newc archive suitable as initramfs, with numeric owners and files
+sorted by name.
+
+- compression -- compression type to use for tarballs. Currently 'bzip2', 'gz', 'lzip', lzma', 'lzop',
 'xz' and 'zstd' compression types are supported. Use 'none' for uncompressed tarball.
 Use 'auto' to pick via file extension. The 'gz' compression type will be used by default.
+Cpio archives support the 'gz', 'xz', 'zstd', 'none' and 'auto' types only.
+
+- compression-level -- level passed to the compression tool, e.g. 1 to 9 for 'gz'
+or 1 to 19 for 'zstd'. The tool default is used if omitted.
+
+- threads -- number of threads used for compression. Supported by the 'gz' (with pigz),
+'xz' and 'zstd' compression types only, not by zip archives.
+
+- numeric-owner -- store numeric user and group IDs only, false by default. Not
+supported by zip archives, which don't store ownership.
+
+- sort -- store the files sorted by name, making the archive independent of the
+filesystem ordering. False by default, zip archives are always sorted.
+
+- mtime -- clamp the modification time of the files to this date, given either
+in RFC 3339 format (e.g. 2024-01-01T00:00:00Z) or as seconds since the epoch
+prefixed with '@'. Together with 'sort' this allows reproducible archives.
 
 - subdir -- path inside the target rootfs to include in the tarball. The path must
 already exist inside the target rootfs. If this property is omitted, the whole target
@@ -30,28 +51,30 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
 	"path"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-debos/debos"
 )
 
-var tarOpts = map[string]string{
-	"bzip2": "--bzip2",
-	"gz":    "--gzip",
-	"lzip":  "--lzip",
-	"lzma":  "--lzma",
-	"lzop":  "--lzop",
-	"xz":    "--xz",
-	"zstd":  "--zstd",
-	"auto":  "--auto-compress",
-	"none":  "",
+var packFormats = map[string]debos.ArchiveType{
+	"cpio": debos.Cpio,
+	"tar":  debos.Tar,
+	"zip":  debos.Zip,
 }
 
 type PackAction struct {
 	debos.BaseAction `yaml:",inline"`
+	Format           string
 	Compression      string
+	CompressionLevel int `yaml:"compression-level"`
+	Threads          int
+	NumericOwner     bool `yaml:"numeric-owner"`
+	Sort             bool
+	Mtime            string
 	File             string
 	Subdir           string
 }
@@ -60,45 +83,94 @@ func NewPackAction() *PackAction {
 	d := PackAction{}
 	// Use gz by default
 	d.Compression = "gz"
+	d.Format = "tar"
 
 	return &d
 }
 
-func (pf *PackAction) Verify(_ *debos.Context) error {
-	_, compressionAvailable := tarOpts[pf.Compression]
-	if compressionAvailable {
-		return nil
+// Parse the mtime property, either RFC 3339 or '@' followed by seconds since the epoch
+func parseMtime(mtime string) (time.Time, error) {
+	if seconds, found := strings.CutPrefix(mtime, "@"); found {
+		epoch, err := strconv.ParseInt(seconds, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("incorrect mtime '%s'", mtime)
+		}
+		return time.Unix(epoch, 0).UTC(), nil
 	}
 
-	possibleTypes := make([]string, 0, len(tarOpts))
-	for key := range tarOpts {
-		possibleTypes = append(possibleTypes, key)
+	t, err := time.Parse(time.RFC3339, mtime)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("incorrect mtime '%s'", mtime)
 	}
-
-	return fmt.Errorf("option 'compression' has an unsupported type: `%s`; possible types are %s",
-		pf.Compression, strings.Join(possibleTypes, ", "))
+	return t, nil
 }
 
-func (pf *PackAction) Run(context *debos.Context) error {
-	usePigz := false
-	if pf.Compression == "gz" {
-		if _, err := exec.LookPath("pigz"); err == nil {
-			usePigz = true
+// Create the archive object with all options set
+func (pf *PackAction) archive(outfile string) (debos.Archive, error) {
+	archive, err := debos.NewArchive(outfile, packFormats[pf.Format])
+	if err != nil {
+		return archive, err
+	}
+
+	options := map[string]interface{}{}
+	switch archive.Type() {
+	case debos.Tar:
+		options["tarcompression"] = pf.Compression
+	case debos.Cpio:
+		options["compression"] = pf.Compression
+	}
+	if pf.CompressionLevel != 0 {
+		options["compressionlevel"] = pf.CompressionLevel
+	}
+	if pf.Threads != 0 {
+		options["threads"] = pf.Threads
+	}
+	if pf.NumericOwner {
+		options["numericowner"] = true
+	}
+	if pf.Sort {
+		options["sort"] = true
+	}
+	if len(pf.Mtime) > 0 {
+		mtime, err := parseMtime(pf.Mtime)
+		if err != nil {
+			return archive, err
 		}
+		options["mtime"] = mtime
+	}
+
+	for key, value := range options {
+		if err := archive.AddOption(key, value); err != nil {
+			return archive, fmt.Errorf("option '%s': %w", key, err)
+		}
+	}
+
+	return archive, nil
+}
+
+func (pf *PackAction) Verify(_ *debos.Context) error {
+	if _, ok := packFormats[pf.Format]; !ok {
+		return fmt.Errorf("option 'format' has an unsupported type: `%s`; possible types are cpio, tar, zip",
+			pf.Format)
+	}
+
+	if pf.Format == "tar" && !slices.Contains(debos.TarCompressions(), pf.Compression) {
+		return fmt.Errorf("option 'compression' has an unsupported type: `%s`; possible types are %s",
+			pf.Compression, strings.Join(debos.TarCompressions(), ", "))
 	}
-	outfile := path.Join(context.Artifactdir, pf.File)
 
-	command := []string{"tar"}
-	command = append(command, "cf")
-	command = append(command, outfile)
-	command = append(command, "--xattrs")
-	command = append(command, "--xattrs-include=*.*")
-	if usePigz {
-		command = append(command, "--use-compress-program=pigz")
-	} else if tarOpts[pf.Compression] != "" {
-		command = append(command, tarOpts[pf.Compression])
+	if pf.Format == "cpio" && !slices.Contains(debos.CpioCompressions(), pf.Compression) {
+		return fmt.Errorf("option 'compression' has an unsupported type: `%s`; possible types are %s",
+			pf.Compression, strings.Join(debos.CpioCompressions(), ", "))
 	}
 
+	_, err := pf.archive(pf.File)
+	return err
+}
+
+func (pf *PackAction) Run(context *debos.Context) error {
+	outfile := path.Join(context.Artifactdir, pf.File)
+
 	var sourceDir = context.Rootdir
 	if len(pf.Subdir) > 0 {
 		var err error
@@ -112,9 +184,11 @@ func (pf *PackAction) Run(context *debos.Context) error {
 		}
 	}
 
-	command = append(command, "-C", sourceDir)
-	command = append(command, ".")
+	archive, err := pf.archive(outfile)
+	if err != nil {
+		return err
+	}
 
 	log.Printf("Compressing to %s\n", outfile)
-	return debos.Command{}.Run("Packing", command...)
+	return archive.Pack(sourceDir)
 }
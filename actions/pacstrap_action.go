@@ -136,9 +136,12 @@ func (d *PacstrapAction) Run(context *debos.Context) error {
 		cmdline = append(cmdline, d.Packages...)
 	}
 
-	if err := (debos.Command{}.Run("pacstrap", cmdline...)); err != nil {
-		log := path.Join(context.Rootdir, "var/log/pacman.log")
-		_ = debos.Command{}.Run("pacstrap.log", "cat", log)
+	err := debos.Command{}.Run("pacstrap", cmdline...)
+
+	logFile := path.Join(context.Rootdir, "var/log/pacman.log")
+	debos.SaveLog("pacman.log", logFile)
+	if err != nil {
+		_ = debos.Command{}.Run("pacstrap.log", "cat", logFile)
 		return err
 	}
 
@@ -59,6 +59,44 @@ Optional properties for recipe:
 
 - sectorsize: Overrides the default 512 bytes sectorsize, mandatory for device using 4k block size such as UFS or NVMe storage.
 
+- services: method used to prevent package maintainer scripts from starting
+services while running commands in the target rootfs. Possible values are:
+
+  - auto: (default) always install a Debian 'policy-rc.d' helper. If the
+    rootfs doesn't provide 'invoke-rc.d' (e.g. Arch Linux or
+    systemd-only rootfs), additionally run systemctl in offline mode if
+    available and divert 'systemctl' and 'start-stop-daemon'. Debian rootfs
+    get the 'policy-rc.d' helper only, use 'systemd-offline' to also run
+    systemctl in offline mode
+
+  - policy-rc.d: install the Debian '/usr/sbin/policy-rc.d' helper only
+
+  - systemd-offline: set 'SYSTEMD_OFFLINE=1' so systemctl never starts or stops units
+
+  - systemctl: divert 'systemctl' to a wrapper ignoring start/stop/restart/reload requests
+
+  - start-stop-daemon: divert 'start-stop-daemon' to a no-op
+
+  - none: do not prevent services from starting
+
+- network: DNS and network access policy for commands running in the target
+rootfs (chroot). Commands running in the build environment are not affected.
+Properties of 'network' are described below.
+
+	network:
+	  policy: host
+	  nameservers:
+	    - 192.0.2.53
+
+- policy -- 'host' (default) copies the host '/etc/resolv.conf' into the
+chroot for the time of the command, 'nameservers' generates the resolv.conf
+from the 'nameservers' list, 'bind' bind-mounts the host '/etc/resolv.conf'
+read-only and 'none' runs commands without any network access
+(systemd-nspawn '--private-network'), so build steps unexpectedly accessing
+the network fail loudly.
+
+- nameservers -- list of nameserver addresses, implies 'policy: nameservers'.
+
 # Supported actions
 
 - apt -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Apt_Action
@@ -120,9 +158,16 @@ type YamlAction struct {
 	debos.Action
 }
 
+type RecipeNetwork struct {
+	Policy      string
+	Nameservers []string
+}
+
 type Recipe struct {
 	Architecture string
 	SectorSize   int
+	Services     string
+	Network      RecipeNetwork
 	Actions      []YamlAction
 }
 
@@ -338,5 +383,13 @@ func (r *Recipe) Parse(file string, printRecipe bool, dump bool, templateVars ..
 		r.SectorSize = 512
 	}
 
+	if _, err := debos.ParseServicesMethod(r.Services); err != nil {
+		return err
+	}
+
+	if _, err := debos.ParseNetworkConfig(r.Network.Policy, r.Network.Nameservers); err != nil {
+		return err
+	}
+
 	return nil
 }
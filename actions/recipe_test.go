@@ -86,6 +86,39 @@ architecture: arm64
 `,
 			"Recipe file must have at least one action",
 		},
+		// Test of unsupported services method
+		{`
+architecture: arm64
+services: upstart
+
+actions:
+  - action: raw
+`,
+			"unsupported services method 'upstart'",
+		},
+		// Test of unsupported network policy
+		{`
+architecture: arm64
+network:
+  policy: wifi
+
+actions:
+  - action: raw
+`,
+			"unsupported network policy 'wifi'",
+		},
+		// Test of nameservers with incompatible network policy
+		{`
+architecture: arm64
+network:
+  policy: none
+  nameservers: [ 192.0.2.53 ]
+
+actions:
+  - action: raw
+`,
+			"nameservers can't be used with network policy 'none'",
+		},
 		// Test of wrong syntax in Yaml
 		{`wrong`,
 			"[1:1] string was used where mapping is expected\n>  1 | wrong\n       ^\n",
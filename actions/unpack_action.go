@@ -4,7 +4,8 @@ Unpack Action
 Unpack files from archive to the filesystem.
 Useful for creating target rootfs from saved tarball with prepared file structure.
 
-Only (compressed) tar archives are supported currently.
+(Compressed) tar, cpio (newc format, e.g. initramfs), zip, deb and squashfs archives
+are supported. Squashfs images are extracted with the 'unsquashfs' tool.
 
 	# Yaml syntax:
 	- action: unpack
@@ -12,6 +13,11 @@ Only (compressed) tar archives are supported currently.
 	  file: file.ext
 	  destdir: usr/
 	  compression: gz
+	  include:
+	    - lib/firmware
+	  exclude:
+	    - "*.bin"
+	  strip-components: 1
 
 Mandatory properties:
 
@@ -33,8 +39,27 @@ the target rootfs.
 
 - compression -- optional hint for unpack allowing to use proper compression method.
 
-Currently 'bzip2', 'gz', 'lzip', 'lzma', 'lzop', 'xz' and 'zstd' compression types are supported.
-If not provided an attempt to autodetect the compression type will be done.
+Currently 'bzip2', 'gz', 'lz4', 'lzip', 'lzma', 'lzop', 'xz' and 'zstd' compression types are supported.
+The archive type and the compression are detected from the file content, so
+this hint is normally not needed.
+
+- include -- list of patterns selecting the entries to extract, all entries are
+extracted if omitted. Shell wildcards are supported; a pattern matching a
+directory selects its whole content and a pattern without '/' matches any path
+component, e.g. '*.ko'.
+
+- exclude -- list of patterns of entries to skip, with the same syntax as 'include'.
+
+- strip-components -- number of leading path components to remove from the
+entries before extracting them; entries with less components are skipped.
+The 'include' and 'exclude' patterns apply to the stripped paths.
+
+Tar, cpio, zip and deb archives are extracted natively, preserving ownership, permissions,
+extended attributes, device nodes and hard links. Entries pointing outside of the
+destination directory are rejected. 'lzip', 'lzma' and 'lzop' compressed tarballs
+are extracted with the external 'tar' tool; cpio archives using them are not supported.
+The 'include', 'exclude' and 'strip-components' properties require the native
+extraction and are not available for squashfs images.
 */
 package actions
 
@@ -50,27 +75,66 @@ type UnpackAction struct {
 	Origin           string
 	File             string
 	Destdir          string
+	Include          []string
+	Exclude          []string
+	StripComponents  int `yaml:"strip-components"`
 }
 
-func (pf *UnpackAction) Verify(_ *debos.Context) error {
-	if len(pf.Origin) == 0 && len(pf.File) == 0 {
-		return fmt.Errorf("filename can't be empty. Please add 'file' and/or 'origin' property")
+// Set the compression hint of archive types supporting it
+func addCompression(archive debos.Archive, compression string) error {
+	switch archive.Type() {
+	case debos.Tar:
+		return archive.AddOption("tarcompression", compression)
+	case debos.Cpio:
+		return archive.AddOption("compression", compression)
+	default:
+		return fmt.Errorf("option 'compression' is supported for Tar and Cpio archives only")
 	}
+}
 
-	archive, err := debos.NewArchive(pf.File)
+// Set the entries selection of the unpack and download actions
+func addUnpackFilter(archive debos.Archive, include, exclude []string, stripComponents int) error {
+	if len(include) > 0 {
+		if err := archive.AddOption("include", include); err != nil {
+			return fmt.Errorf("option 'include': %w", err)
+		}
+	}
+	if len(exclude) > 0 {
+		if err := archive.AddOption("exclude", exclude); err != nil {
+			return fmt.Errorf("option 'exclude': %w", err)
+		}
+	}
+	if stripComponents != 0 {
+		if err := archive.AddOption("stripcomponents", stripComponents); err != nil {
+			return fmt.Errorf("option 'strip-components': %w", err)
+		}
+	}
+	return nil
+}
+
+func (pf *UnpackAction) archive(file string) (debos.Archive, error) {
+	archive, err := debos.NewArchive(file)
 	if err != nil {
-		return err
+		return archive, err
 	}
 	if len(pf.Compression) > 0 {
-		if archive.Type() != debos.Tar {
-			return fmt.Errorf("option 'compression' is supported for Tar archives only")
-		}
-		if err := archive.AddOption("tarcompression", pf.Compression); err != nil {
-			return fmt.Errorf("'%s': %w", pf.File, err)
+		if err := addCompression(archive, pf.Compression); err != nil {
+			return archive, fmt.Errorf("'%s': %w", pf.File, err)
 		}
 	}
+	if err := addUnpackFilter(archive, pf.Include, pf.Exclude, pf.StripComponents); err != nil {
+		return archive, fmt.Errorf("'%s': %w", pf.File, err)
+	}
+	return archive, nil
+}
 
-	return nil
+func (pf *UnpackAction) Verify(_ *debos.Context) error {
+	if len(pf.Origin) == 0 && len(pf.File) == 0 {
+		return fmt.Errorf("filename can't be empty. Please add 'file' and/or 'origin' property")
+	}
+
+	_, err := pf.archive(pf.File)
+	return err
 }
 
 func (pf *UnpackAction) Run(context *debos.Context) error {
@@ -92,15 +156,10 @@ func (pf *UnpackAction) Run(context *debos.Context) error {
 		return err
 	}
 
-	archive, err := debos.NewArchive(infile)
+	archive, err := pf.archive(infile)
 	if err != nil {
 		return err
 	}
-	if len(pf.Compression) > 0 {
-		if err := archive.AddOption("tarcompression", pf.Compression); err != nil {
-			return err
-		}
-	}
 
 	var destDir = context.Rootdir
 	if len(pf.Destdir) > 0 {
@@ -1,11 +1,11 @@
 package debos
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strings"
 )
 
 type ArchiveType int
@@ -16,6 +16,8 @@ const (
 	Tar
 	Zip
 	Deb
+	Cpio
+	Squashfs
 )
 
 type ArchiveBase struct {
@@ -32,16 +34,27 @@ type ArchiveZip struct {
 type ArchiveDeb struct {
 	ArchiveBase
 }
+type ArchiveCpio struct {
+	ArchiveBase
+}
+type ArchiveSquashfs struct {
+	ArchiveBase
+}
 
 type Unpacker interface {
 	Unpack(destination string) error
 	RelaxedUnpack(destination string) error
 }
 
+type Packer interface {
+	Pack(source string) error
+}
+
 type Archiver interface {
 	Type() ArchiveType
 	AddOption(key, value interface{}) error
 	Unpacker
+	Packer
 }
 
 type Archive struct {
@@ -71,6 +84,69 @@ func (arc *ArchiveBase) AddOption(key, value interface{}) error {
 
 func (arc *ArchiveBase) Type() ArchiveType { return arc.atype }
 
+// Check if the external tool is requested instead of the native unpacker
+func (arc *ArchiveBase) external() bool {
+	unpacker, _ := arc.options["unpacker"].(string)
+	return unpacker == "external"
+}
+
+// Helper function for options common to all unpackers
+func (arc *ArchiveBase) addUnpackOption(key, value interface{}) (bool, error) {
+	switch key {
+	case "include", "exclude":
+		patterns, ok := value.([]string)
+		if !ok {
+			return true, fmt.Errorf("wrong type for value")
+		}
+		for _, p := range patterns {
+			if _, err := filepath.Match(p, ""); err != nil {
+				return true, fmt.Errorf("incorrect pattern '%s': %w", p, err)
+			}
+		}
+	case "stripcomponents":
+		v, ok := value.(int)
+		if !ok {
+			return true, fmt.Errorf("wrong type for value")
+		}
+		if v < 0 {
+			return true, fmt.Errorf("option '%v' can't be negative", key)
+		}
+	default:
+		return false, nil
+	}
+
+	arc.options[key] = value
+	return true, nil
+}
+
+func (arc *ArchiveBase) unpackFilter() UnpackFilter {
+	include, _ := arc.options["include"].([]string)
+	exclude, _ := arc.options["exclude"].([]string)
+	return UnpackFilter{
+		Include:         include,
+		Exclude:         exclude,
+		StripComponents: arc.intOption("stripcomponents"),
+	}
+}
+
+// Create the native extractor with the filter set in options
+func (arc *ArchiveBase) extractor(destination string, relaxed bool) (*extractor, error) {
+	e, err := newExtractor(destination, relaxed)
+	if err != nil {
+		return nil, err
+	}
+	e.filter = arc.unpackFilter()
+	return e, nil
+}
+
+// Filters are applied by the native unpacker only
+func (arc *ArchiveBase) checkExternal() error {
+	if arc.unpackFilter().active() {
+		return fmt.Errorf("include, exclude and strip-components are not supported by the external unpacker for '%s'", arc.file)
+	}
+	return nil
+}
+
 // Helper function for unpacking with external tool
 func unpack(command []string, destination string) error {
 	if err := os.MkdirAll(destination, 0755); err != nil {
@@ -87,6 +163,7 @@ func tarOptions(compression string) string {
 		"gz":    "--gzip",
 		"lzip":  "--lzip",
 		"lzma":  "--lzma",
+		"lz4":   "--use-compress-program=lz4",
 		"lzop":  "--lzop",
 		"xz":    "--xz",
 		"zstd":  "--zstd",
@@ -95,7 +172,45 @@ func tarOptions(compression string) string {
 	return unpackTarOpts[compression]
 }
 
+/*
+unpackNative extracts the tarball without external tools. It returns
+errNotNative if the options or the compression type require to use
+the tar tool instead.
+*/
+func (tar *ArchiveTar) unpackNative(destination string, relaxed bool) error {
+	if _, ok := tar.options["taroptions"]; ok || tar.external() {
+		return errNotNative
+	}
+
+	e, err := tar.extractor(destination, relaxed)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(tar.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	compression, _ := tar.options["tarcompression"].(string)
+	r, err := decompressReader(f, compression)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return e.extractTar(r)
+}
+
 func (tar *ArchiveTar) Unpack(destination string) error {
+	if err := tar.unpackNative(destination, false); !errors.Is(err, errNotNative) {
+		return err
+	}
+	if err := tar.checkExternal(); err != nil {
+		return err
+	}
+
 	command := []string{"tar"}
 	usePigz := false
 	if compression, ok := tar.options["tarcompression"]; ok && compression == "gz" {
@@ -126,6 +241,10 @@ func (tar *ArchiveTar) Unpack(destination string) error {
 }
 
 func (tar *ArchiveTar) RelaxedUnpack(destination string) error {
+	if err := tar.unpackNative(destination, true); !errors.Is(err, errNotNative) {
+		return err
+	}
+
 	taroptions := []string{"--no-same-owner", "--no-same-permissions"}
 	options, ok := tar.options["taroptions"].([]string)
 	defer func() { tar.options["taroptions"] = options }()
@@ -154,27 +273,113 @@ func (tar *ArchiveTar) AddOption(key, value interface{}) error {
 			return fmt.Errorf("wrong type for value")
 		}
 		option := tarOptions(compression)
-		if len(option) == 0 {
+		if len(option) == 0 && compression != "none" && compression != "auto" {
 			return fmt.Errorf("compression '%s' is not supported", compression)
 		}
 		tar.options["tarcompression"] = compression
+		return tar.checkCompression()
+
+	case "unpacker":
+		if err := checkUnpacker(value); err != nil {
+			return err
+		}
+		tar.options["unpacker"] = value
 
 	default:
+		if ok, err := tar.addPackOption(key, value); ok {
+			if err != nil {
+				return err
+			}
+			return tar.checkCompression()
+		}
+		if ok, err := tar.addUnpackOption(key, value); ok {
+			return err
+		}
 		return fmt.Errorf("option '%v' is not supported for tar archive type", key)
 	}
 	return nil
 }
 
+// Helper function for checking the 'unpacker' option value
+func checkUnpacker(value interface{}) error {
+	unpacker, ok := value.(string)
+	if !ok {
+		return fmt.Errorf("wrong type for value")
+	}
+	if unpacker != "native" && unpacker != "external" {
+		return fmt.Errorf("unpacker '%s' is not supported", unpacker)
+	}
+	return nil
+}
+
 func (zip *ArchiveZip) Unpack(destination string) error {
+	return zip.unpack(destination, false)
+}
+
+func (zip *ArchiveZip) RelaxedUnpack(destination string) error {
+	return zip.unpack(destination, true)
+}
+
+func (zip *ArchiveZip) unpack(destination string, relaxed bool) error {
+	if !zip.external() {
+		e, err := zip.extractor(destination, relaxed)
+		if err != nil {
+			return err
+		}
+		return e.extractZip(zip.file)
+	}
+	if err := zip.checkExternal(); err != nil {
+		return err
+	}
+
+	// unzip doesn't restore the special permission bits without -K
 	command := []string{"unzip", zip.file, "-d", destination}
 	return unpack(command, destination)
 }
 
-func (zip *ArchiveZip) RelaxedUnpack(destination string) error {
-	return zip.Unpack(destination)
+func (zip *ArchiveZip) AddOption(key, value interface{}) error {
+	switch key {
+	case "unpacker":
+		if err := checkUnpacker(value); err != nil {
+			return err
+		}
+		zip.options["unpacker"] = value
+
+	case "threads", "numericowner":
+		return fmt.Errorf("option '%v' is not supported for zip archive type", key)
+
+	case "sort":
+		// Entries are always stored sorted by name
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("wrong type for value")
+		}
+
+	default:
+		if ok, err := zip.addPackOption(key, value); ok {
+			return err
+		}
+		if ok, err := zip.addUnpackOption(key, value); ok {
+			return err
+		}
+		return fmt.Errorf("option '%v' is not supported for zip archive type", key)
+	}
+	return nil
 }
 
 func (deb *ArchiveDeb) Unpack(destination string) error {
+	if !deb.external() {
+		e, err := deb.extractor(destination, false)
+		if err != nil {
+			return err
+		}
+		if err := e.extractDeb(deb.file); !errors.Is(err, errNotNative) {
+			return err
+		}
+	}
+	if err := deb.checkExternal(); err != nil {
+		return err
+	}
+
 	command := []string{"dpkg", "-x", deb.file, destination}
 	return unpack(command, destination)
 }
@@ -183,27 +388,60 @@ func (deb *ArchiveDeb) RelaxedUnpack(destination string) error {
 	return deb.Unpack(destination)
 }
 
+func (deb *ArchiveDeb) AddOption(key, value interface{}) error {
+	switch key {
+	case "unpacker":
+		if err := checkUnpacker(value); err != nil {
+			return err
+		}
+		deb.options["unpacker"] = value
+
+	default:
+		if ok, err := deb.addUnpackOption(key, value); ok {
+			return err
+		}
+		return fmt.Errorf("option '%v' is not supported for deb archive type", key)
+	}
+	return nil
+}
+
+func (sqfs *ArchiveSquashfs) Unpack(destination string) error {
+	if err := sqfs.checkExternal(); err != nil {
+		return err
+	}
+	command := []string{"unsquashfs", "-f", "-d", destination, sqfs.file}
+	return unpack(command, destination)
+}
+
+func (sqfs *ArchiveSquashfs) RelaxedUnpack(destination string) error {
+	if err := sqfs.checkExternal(); err != nil {
+		return err
+	}
+	command := []string{"unsquashfs", "-f", "-no-xattrs", "-d", destination, sqfs.file}
+	return unpack(command, destination)
+}
+
 /*
 NewArchive associate correct structure and methods according to
-archive type. If ArchiveType is omitted -- trying to guess the type.
+archive type. If ArchiveType is omitted -- trying to guess the type and
+the compression from the file content, or from the file extension if
+the file doesn't exist (yet).
 Return ArchiveType or nil in case of error.
 */
 func NewArchive(file string, arcType ...ArchiveType) (Archive, error) {
 	var archive Archive
 	var atype ArchiveType
 
+	var compression string
+
 	if len(arcType) == 0 {
-		ext := filepath.Ext(file)
-		ext = strings.ToLower(ext)
-
-		switch ext {
-		case ".deb":
-			atype = Deb
-		case ".zip":
-			atype = Zip
-		default:
-			//FIXME: guess Tar maybe?
-			atype = Tar
+		var err error
+		atype, compression, err = DetectArchive(file)
+		if errors.Is(err, os.ErrNotExist) {
+			// Not available yet, e.g. while verifying the recipe
+			atype = archiveTypeFromName(file)
+		} else if err != nil {
+			return archive, err
 		}
 	} else {
 		atype = arcType[0]
@@ -221,8 +459,21 @@ func NewArchive(file string, arcType ...ArchiveType) (Archive, error) {
 		archive = Archive{&ArchiveZip{ArchiveBase: common}}
 	case Deb:
 		archive = Archive{&ArchiveDeb{ArchiveBase: common}}
+	case Cpio:
+		archive = Archive{&ArchiveCpio{ArchiveBase: common}}
+	case Squashfs:
+		archive = Archive{&ArchiveSquashfs{ArchiveBase: common}}
 	default:
 		return archive, fmt.Errorf("unsupported archive '%s'", file)
 	}
+
+	if len(compression) > 0 {
+		switch atype {
+		case Tar:
+			common.options["tarcompression"] = compression
+		case Cpio:
+			common.options["compression"] = compression
+		}
+	}
 	return archive, nil
 }
@@ -1,12 +1,19 @@
 package debos_test
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
 	_ "fmt"
 	"github.com/go-debos/debos"
 	"github.com/stretchr/testify/assert"
+	"os"
+	"os/exec"
+	"path"
 	_ "reflect"
 	_ "strings"
 	"testing"
+	"time"
 )
 
 func TestBase(t *testing.T) {
@@ -28,6 +35,8 @@ func TestBase(t *testing.T) {
 	assert.EqualError(t, err, "Unpack is not supported for ''")
 	err = archive.RelaxedUnpack("/tmp/test")
 	assert.EqualError(t, err, "Unpack is not supported for ''")
+	err = archive.Pack("/tmp/test")
+	assert.EqualError(t, err, "Pack is not supported for ''")
 }
 
 func TestTar_default(t *testing.T) {
@@ -44,11 +53,19 @@ func TestTar_default(t *testing.T) {
 	// Test unpack
 	err = archive.Unpack("/tmp/test")
 	// Expect unpack failure
-	assert.EqualError(t, err, "exit status 2")
+	assert.EqualError(t, err, "open test.tar.gz: no such file or directory")
 
 	// Expect failure for RelaxedUnpack
 	err = archive.RelaxedUnpack("/tmp/test")
+	assert.EqualError(t, err, "open test.tar.gz: no such file or directory")
+
+	// Expect failure of the external tool
+	err = archive.AddOption("unpacker", "external")
+	assert.Empty(t, err)
+	err = archive.Unpack("/tmp/test")
 	assert.EqualError(t, err, "exit status 2")
+	err = archive.AddOption("unpacker", "magic")
+	assert.EqualError(t, err, "unpacker 'magic' is not supported")
 
 	// Check options
 	err = archive.AddOption("taroptions", []string{"--option1"})
@@ -85,7 +102,7 @@ func TestTar_compression(t *testing.T) {
 		err = archive.AddOption("tarcompression", compression)
 		assert.Empty(t, err)
 		err := archive.Unpack("test")
-		assert.EqualError(t, err, "exit status 2")
+		assert.EqualError(t, err, "open test.tar.gz: no such file or directory")
 	}
 	// Check of unsupported compression type
 	err = archive.AddOption("tarcompression", "fake")
@@ -119,11 +136,11 @@ func TestDeb(t *testing.T) {
 
 	// Expect unpack failure
 	err = archive.Unpack("/tmp/test")
-	assert.EqualError(t, err, "exit status 2")
+	assert.EqualError(t, err, "open test.deb: no such file or directory")
 	err = archive.Unpack("/proc/debostest")
 	assert.EqualError(t, err, "mkdir /proc/debostest: no such file or directory")
 	err = archive.RelaxedUnpack("/tmp/test")
-	assert.EqualError(t, err, "exit status 2")
+	assert.EqualError(t, err, "open test.deb: no such file or directory")
 }
 
 func TestZip(t *testing.T) {
@@ -146,9 +163,461 @@ func TestZip(t *testing.T) {
 
 	// Expect unpack failure
 	err = archive.Unpack("/tmp/test")
-	assert.EqualError(t, err, "exit status 9")
+	assert.EqualError(t, err, "open test.zip: no such file or directory")
 	err = archive.Unpack("/proc/debostest")
 	assert.EqualError(t, err, "mkdir /proc/debostest: no such file or directory")
 	err = archive.RelaxedUnpack("/tmp/test")
+	assert.EqualError(t, err, "open test.zip: no such file or directory")
+
+	// Expect failure of the external tool
+	err = archive.AddOption("unpacker", "external")
+	assert.Empty(t, err)
+	err = archive.Unpack("/tmp/test")
 	assert.EqualError(t, err, "exit status 9")
 }
+
+type testEntry struct {
+	name     string
+	typeflag byte
+	mode     int64
+	body     string
+	linkname string
+}
+
+// Modification time of the entries of the test archives
+var testMtime = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func writeTestTar(t *testing.T, file string, entries []testEntry) {
+	f, err := os.Create(file)
+	assert.NoError(t, err)
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	defer gz.Close()
+	tw := tar.NewWriter(gz)
+	defer tw.Close()
+
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Mode:     e.mode,
+			Size:     int64(len(e.body)),
+			Linkname: e.linkname,
+			ModTime:  testMtime,
+		}
+		assert.NoError(t, tw.WriteHeader(hdr))
+		_, err := tw.Write([]byte(e.body))
+		assert.NoError(t, err)
+	}
+}
+
+func TestTar_native(t *testing.T) {
+	dir := t.TempDir()
+	file := path.Join(dir, "test.tar.gz")
+	writeTestTar(t, file, []testEntry{
+		{"./", tar.TypeDir, 0755, "", ""},
+		{"./etc/", tar.TypeDir, 0755, "", ""},
+		{"./etc/hostname", tar.TypeReg, 0600, "debos\n", ""},
+		{"./etc/hostname.link", tar.TypeLink, 0, "", "./etc/hostname"},
+		{"./lib", tar.TypeSymlink, 0777, "", "/etc"},
+		{"./lib/motd", tar.TypeReg, 0644, "hello\n", ""},
+		{"./usr/bin/tool", tar.TypeReg, 0755, "#!/bin/sh\n", ""},
+	})
+
+	// Compression is detected from the content
+	archive, err := debos.NewArchive(file)
+	assert.NoError(t, err)
+	dest := path.Join(dir, "dest")
+	assert.NoError(t, archive.Unpack(dest))
+
+	data, err := os.ReadFile(path.Join(dest, "etc/hostname"))
+	assert.NoError(t, err)
+	assert.Equal(t, "debos\n", string(data))
+
+	fi, err := os.Stat(path.Join(dest, "etc/hostname"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	link, err := os.Stat(path.Join(dest, "etc/hostname.link"))
+	assert.NoError(t, err)
+	assert.True(t, os.SameFile(fi, link))
+
+	// Absolute symlink is resolved inside the destination
+	target, err := os.Readlink(path.Join(dest, "lib"))
+	assert.NoError(t, err)
+	assert.Equal(t, "/etc", target)
+	assert.FileExists(t, path.Join(dest, "etc/motd"))
+
+	fi, err = os.Stat(path.Join(dest, "usr/bin/tool"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), fi.Mode().Perm())
+}
+
+func TestTar_native_relaxed(t *testing.T) {
+	dir := t.TempDir()
+	file := path.Join(dir, "test.tar.gz")
+	writeTestTar(t, file, []testEntry{
+		{"./usr/", tar.TypeDir, 0555, "", ""},
+		{"./usr/bin/", tar.TypeDir, 0555, "", ""},
+		{"./usr/bin/su", tar.TypeReg, 04755, "#!/bin/sh\n", ""},
+	})
+
+	archive, err := debos.NewArchive(file)
+	assert.NoError(t, err)
+	dest := path.Join(dir, "dest")
+	assert.NoError(t, archive.RelaxedUnpack(dest))
+	defer os.Chmod(path.Join(dest, "usr/bin"), 0755)
+	defer os.Chmod(path.Join(dest, "usr"), 0755)
+
+	// Read-only directories get their metadata once populated
+	for _, name := range []string{"usr", "usr/bin"} {
+		fi, err := os.Stat(path.Join(dest, name))
+		assert.NoError(t, err)
+		assert.Equal(t, os.ModeDir|0555, fi.Mode())
+		assert.True(t, testMtime.Equal(fi.ModTime()), name)
+	}
+
+	// Special permission bits are dropped
+	fi, err := os.Stat(path.Join(dest, "usr/bin/su"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), fi.Mode())
+}
+
+func TestTar_native_traversal(t *testing.T) {
+	dir := t.TempDir()
+	file := path.Join(dir, "test.tar.gz")
+	writeTestTar(t, file, []testEntry{
+		{"../evil", tar.TypeReg, 0644, "evil\n", ""},
+	})
+
+	archive, err := debos.NewArchive(file)
+	assert.NoError(t, err)
+	err = archive.Unpack(path.Join(dir, "dest"))
+	assert.EqualError(t, err, "refusing to extract '../evil': path traversal")
+	assert.NoFileExists(t, path.Join(dir, "evil"))
+
+	writeTestTar(t, file, []testEntry{
+		{"passwd", tar.TypeLink, 0, "", "../../etc/passwd"},
+	})
+	err = archive.Unpack(path.Join(dir, "dest"))
+	assert.EqualError(t, err, "refusing to extract '../../etc/passwd': path traversal")
+}
+
+func TestZip_native(t *testing.T) {
+	dir := t.TempDir()
+	file := path.Join(dir, "test.zip")
+	f, err := os.Create(file)
+	assert.NoError(t, err)
+	zw := zip.NewWriter(f)
+	hdr := &zip.FileHeader{Name: "firmware/blob.bin", Method: zip.Deflate}
+	hdr.SetMode(0640)
+	w, err := zw.CreateHeader(hdr)
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("blob"))
+	assert.NoError(t, err)
+	_, err = zw.Create("../evil")
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+	f.Close()
+
+	archive, err := debos.NewArchive(file)
+	assert.NoError(t, err)
+	dest := path.Join(dir, "dest")
+	err = archive.Unpack(dest)
+	assert.EqualError(t, err, "refusing to extract '../evil': path traversal")
+
+	data, err := os.ReadFile(path.Join(dest, "firmware/blob.bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, "blob", string(data))
+	fi, err := os.Stat(path.Join(dest, "firmware/blob.bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), fi.Mode().Perm())
+}
+
+func TestZip_native_relaxed(t *testing.T) {
+	dir := t.TempDir()
+	file := path.Join(dir, "test.zip")
+	f, err := os.Create(file)
+	assert.NoError(t, err)
+	zw := zip.NewWriter(f)
+	for _, entry := range []struct {
+		name string
+		mode os.FileMode
+	}{
+		{"bin/", os.ModeDir | 0555},
+		{"bin/su", os.ModeSetuid | 0755},
+	} {
+		hdr := &zip.FileHeader{Name: entry.name, Modified: testMtime}
+		hdr.SetMode(entry.mode)
+		_, err := zw.CreateHeader(hdr)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, zw.Close())
+	f.Close()
+
+	archive, err := debos.NewArchive(file)
+	assert.NoError(t, err)
+	dest := path.Join(dir, "dest")
+	assert.NoError(t, archive.RelaxedUnpack(dest))
+	defer os.Chmod(path.Join(dest, "bin"), 0755)
+
+	fi, err := os.Stat(path.Join(dest, "bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.ModeDir|0555, fi.Mode())
+	assert.True(t, testMtime.Equal(fi.ModTime()))
+
+	fi, err = os.Stat(path.Join(dest, "bin/su"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), fi.Mode())
+
+	// Special permission bits are kept otherwise
+	dest = path.Join(dir, "strict")
+	assert.NoError(t, archive.Unpack(dest))
+	defer os.Chmod(path.Join(dest, "bin"), 0755)
+	fi, err = os.Stat(path.Join(dest, "bin/su"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.ModeSetuid|0755, fi.Mode())
+}
+
+func TestTar_packOptions(t *testing.T) {
+	archive, err := debos.NewArchive("test.tar")
+	assert.NoError(t, err)
+
+	for _, compression := range []string{"none", "auto"} {
+		assert.NoError(t, archive.AddOption("tarcompression", compression))
+	}
+	assert.EqualError(t, archive.AddOption("threads", -1), "option 'threads' can't be negative")
+	assert.EqualError(t, archive.AddOption("sort", "yes"), "wrong type for value")
+	assert.NoError(t, archive.AddOption("mtime", time.Unix(0, 0)))
+
+	// Level with compression guessed by tar, checked whatever the order of the options
+	assert.EqualError(t, archive.AddOption("compressionlevel", 9), "compression level and threads are not supported with 'auto' compression")
+	assert.EqualError(t, archive.Pack(t.TempDir()), "compression level and threads are not supported with 'auto' compression")
+
+	archive, err = debos.NewArchive("test.tar.bz2")
+	assert.NoError(t, err)
+	assert.NoError(t, archive.AddOption("threads", 2))
+	assert.EqualError(t, archive.AddOption("tarcompression", "bzip2"), "threads are not supported with compression 'bzip2'")
+	assert.NoError(t, archive.AddOption("tarcompression", "zstd"))
+
+	// Threads with gz are only supported by pigz
+	err = archive.AddOption("tarcompression", "gz")
+	if _, pigz := exec.LookPath("pigz"); pigz != nil {
+		assert.EqualError(t, err, "threads with compression 'gz' need pigz")
+	} else {
+		assert.NoError(t, err)
+	}
+}
+
+func TestZip_pack(t *testing.T) {
+	dir := t.TempDir()
+	source := path.Join(dir, "source")
+	assert.NoError(t, os.MkdirAll(path.Join(source, "b/c"), 0755))
+	assert.NoError(t, os.WriteFile(path.Join(source, "b/c/file"), []byte("content"), 0600))
+	assert.NoError(t, os.WriteFile(path.Join(source, "a"), []byte("a"), 0644))
+	assert.NoError(t, os.Symlink("b/c/file", path.Join(source, "link")))
+
+	file := path.Join(dir, "test.zip")
+	archive, err := debos.NewArchive(file)
+	assert.NoError(t, err)
+	assert.EqualError(t, archive.AddOption("threads", 2), "option 'threads' is not supported for zip archive type")
+	assert.EqualError(t, archive.AddOption("numericowner", true), "option 'numericowner' is not supported for zip archive type")
+	assert.NoError(t, archive.AddOption("sort", true))
+	assert.NoError(t, archive.AddOption("compressionlevel", 9))
+	mtime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.NoError(t, archive.AddOption("mtime", mtime))
+	assert.NoError(t, archive.Pack(source))
+
+	zr, err := zip.OpenReader(file)
+	assert.NoError(t, err)
+	defer zr.Close()
+	names := []string{}
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+		assert.False(t, f.Modified.After(mtime))
+	}
+	assert.Equal(t, []string{"a", "b/", "b/c/", "b/c/file", "link"}, names)
+
+	dest := path.Join(dir, "dest")
+	assert.NoError(t, archive.Unpack(dest))
+	data, err := os.ReadFile(path.Join(dest, "link"))
+	assert.NoError(t, err)
+	assert.Equal(t, "content", string(data))
+}
+
+func TestCpio(t *testing.T) {
+	for _, file := range []string{"initrd.cpio", "initramfs.CPIO.gz", "initrd.cpio.zst"} {
+		archive, err := debos.NewArchive(file)
+		assert.NoError(t, err)
+		assert.Equal(t, debos.Cpio, archive.Type())
+	}
+
+	archive, err := debos.NewArchive("initrd.cpio")
+	assert.NoError(t, err)
+	assert.EqualError(t, archive.AddOption("compression", "fake"), "compression 'fake' is not supported")
+	assert.EqualError(t, archive.AddOption("compression", "lzma"), "compression 'lzma' is not supported")
+	assert.NoError(t, archive.AddOption("compression", "bzip2"))
+	assert.Equal(t, []string{"auto", "gz", "none", "xz", "zstd"}, debos.CpioCompressions())
+	assert.EqualError(t, archive.AddOption("taroptions", []string{}), "option 'taroptions' is not supported for cpio archive type")
+	err = archive.Unpack("/tmp/test")
+	assert.EqualError(t, err, "open initrd.cpio: no such file or directory")
+}
+
+func TestCpio_pack(t *testing.T) {
+	dir := t.TempDir()
+	source := path.Join(dir, "source")
+	assert.NoError(t, os.MkdirAll(path.Join(source, "usr/bin"), 0755))
+	assert.NoError(t, os.WriteFile(path.Join(source, "usr/bin/tool"), []byte("binary"), 0755))
+	assert.NoError(t, os.Link(path.Join(source, "usr/bin/tool"), path.Join(source, "usr/bin/alias")))
+	assert.NoError(t, os.Symlink("usr/bin/tool", path.Join(source, "init")))
+
+	for _, compression := range []string{"none", "gz", "xz", "zstd"} {
+		file := path.Join(dir, "initrd-"+compression+".cpio")
+		archive, err := debos.NewArchive(file)
+		assert.NoError(t, err)
+		assert.NoError(t, archive.AddOption("compression", compression))
+		assert.NoError(t, archive.Pack(source))
+
+		// Compression is detected on unpack
+		archive, err = debos.NewArchive(file)
+		assert.NoError(t, err)
+		dest := path.Join(dir, "dest-"+compression)
+		assert.NoError(t, archive.Unpack(dest))
+
+		data, err := os.ReadFile(path.Join(dest, "init"))
+		assert.NoError(t, err)
+		assert.Equal(t, "binary", string(data))
+		tool, err := os.Stat(path.Join(dest, "usr/bin/tool"))
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0755), tool.Mode().Perm())
+		alias, err := os.Stat(path.Join(dest, "usr/bin/alias"))
+		assert.NoError(t, err)
+		assert.True(t, os.SameFile(tool, alias))
+	}
+
+	// The compression is guessed from known extensions only
+	for file, compression := range map[string]string{"initrd.cpio": "", "initrd.cpio.gz": "gz"} {
+		archive, err := debos.NewArchive(path.Join(dir, file))
+		assert.NoError(t, err)
+		assert.NoError(t, archive.AddOption("compression", "auto"))
+		assert.NoError(t, archive.Pack(source))
+		data, err := os.ReadFile(path.Join(dir, file))
+		assert.NoError(t, err)
+		assert.Equal(t, compression == "gz", data[0] == 0x1f && data[1] == 0x8b)
+	}
+	archive, err := debos.NewArchive(path.Join(dir, "initrd.cpio.bz2"), debos.Cpio)
+	assert.NoError(t, err)
+	assert.NoError(t, archive.AddOption("compression", "auto"))
+	assert.EqualError(t, archive.Pack(source), "can't guess the compression of '"+path.Join(dir, "initrd.cpio.bz2")+"' from its extension")
+	assert.NoFileExists(t, path.Join(dir, "initrd.cpio.bz2"))
+}
+
+func TestDetectArchive(t *testing.T) {
+	dir := t.TempDir()
+
+	// Compressed tarball without meaningful extension
+	tarball := path.Join(dir, "download")
+	writeTestTar(t, tarball, []testEntry{{name: "etc/hostname", typeflag: tar.TypeReg, mode: 0644, body: "debos"}})
+	atype, compression, err := debos.DetectArchive(tarball)
+	assert.NoError(t, err)
+	assert.Equal(t, debos.Tar, atype)
+	assert.Equal(t, "gz", compression)
+
+	archive, err := debos.NewArchive(tarball)
+	assert.NoError(t, err)
+	assert.Equal(t, debos.Tar, archive.Type())
+
+	// Zip whatever the extension
+	zipfile := path.Join(dir, "archive.tar")
+	f, err := os.Create(zipfile)
+	assert.NoError(t, err)
+	zw := zip.NewWriter(f)
+	_, err = zw.Create("file")
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+	f.Close()
+	archive, err = debos.NewArchive(zipfile)
+	assert.NoError(t, err)
+	assert.Equal(t, debos.Zip, archive.Type())
+
+	// Compressed disk image
+	image := path.Join(dir, "disk.img.gz")
+	f, err = os.Create(image)
+	assert.NoError(t, err)
+	gz := gzip.NewWriter(f)
+	_, err = gz.Write(make([]byte, 4096))
+	assert.NoError(t, err)
+	assert.NoError(t, gz.Close())
+	f.Close()
+	_, err = debos.NewArchive(image)
+	assert.EqualError(t, err, "'"+image+"' is a gz compressed file but not a supported archive")
+
+	// Inconclusive content: guess from the file name
+	empty := path.Join(dir, "empty.cpio")
+	assert.NoError(t, os.WriteFile(empty, make([]byte, 10240), 0644))
+	atype, compression, err = debos.DetectArchive(empty)
+	assert.NoError(t, err)
+	assert.Equal(t, debos.Cpio, atype)
+	assert.Equal(t, "", compression)
+
+	for _, name := range []string{"empty.tar.gz", "empty.tgz"} {
+		empty = path.Join(dir, name)
+		writeTestTar(t, empty, []testEntry{})
+		atype, compression, err = debos.DetectArchive(empty)
+		assert.NoError(t, err)
+		assert.Equal(t, debos.Tar, atype)
+		assert.Equal(t, "gz", compression)
+	}
+
+	// Missing file: guess from the extension
+	archive, err = debos.NewArchive(path.Join(dir, "missing.deb"))
+	assert.NoError(t, err)
+	assert.Equal(t, debos.Deb, archive.Type())
+}
+
+func TestTar_native_filter(t *testing.T) {
+	dir := t.TempDir()
+	file := path.Join(dir, "vendor.tar.gz")
+	writeTestTar(t, file, []testEntry{
+		{"vendor-1.0/", tar.TypeDir, 0755, "", ""},
+		{"vendor-1.0/README", tar.TypeReg, 0644, "readme", ""},
+		{"vendor-1.0/lib/firmware/wifi.bin", tar.TypeReg, 0644, "wifi", ""},
+		{"vendor-1.0/lib/firmware/wifi.txt", tar.TypeReg, 0644, "config", ""},
+		{"vendor-1.0/lib/firmware/bt.bin", tar.TypeLink, 0, "", "vendor-1.0/lib/firmware/wifi.bin"},
+		{"vendor-1.0/lib/modules/6.1/wifi.ko", tar.TypeReg, 0644, "module", ""},
+	})
+
+	archive, err := debos.NewArchive(file)
+	assert.NoError(t, err)
+	assert.NoError(t, archive.AddOption("stripcomponents", 1))
+	assert.NoError(t, archive.AddOption("include", []string{"lib/firmware"}))
+	assert.NoError(t, archive.AddOption("exclude", []string{"*.txt"}))
+	assert.EqualError(t, archive.AddOption("exclude", []string{"[a-"}), "incorrect pattern '[a-': syntax error in pattern")
+	assert.EqualError(t, archive.AddOption("stripcomponents", -1), "option 'stripcomponents' can't be negative")
+
+	dest := path.Join(dir, "dest")
+	assert.NoError(t, archive.Unpack(dest))
+
+	assert.FileExists(t, path.Join(dest, "lib/firmware/wifi.bin"))
+	assert.FileExists(t, path.Join(dest, "lib/firmware/bt.bin"))
+	assert.NoFileExists(t, path.Join(dest, "lib/firmware/wifi.txt"))
+	assert.NoFileExists(t, path.Join(dest, "README"))
+	assert.NoDirExists(t, path.Join(dest, "lib/modules"))
+	assert.NoDirExists(t, path.Join(dest, "vendor-1.0"))
+
+	// Hardlinks to stripped files can't be created
+	stripped := path.Join(dir, "stripped.tar.gz")
+	writeTestTar(t, stripped, []testEntry{
+		{"README", tar.TypeReg, 0644, "readme", ""},
+		{"docs/README", tar.TypeLink, 0, "", "README"},
+	})
+	strippedArchive, err := debos.NewArchive(stripped)
+	assert.NoError(t, err)
+	assert.NoError(t, strippedArchive.AddOption("stripcomponents", 1))
+	assert.EqualError(t, strippedArchive.Unpack(path.Join(dir, "stripped")),
+		"hardlink target 'README' of 'docs/README' stripped by strip-components")
+
+	// The external tool can't apply filters
+	assert.NoError(t, archive.AddOption("unpacker", "external"))
+	assert.EqualError(t, archive.Unpack(dest), "include, exclude and strip-components are not supported by the external unpacker for '"+file+"'")
+}
@@ -0,0 +1,169 @@
+package debos
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+/*
+DownloadCache is a persistent directory keeping downloaded files across
+builds. Files are stored by their sha256 sum in 'blobs/sha256/', while
+'urls/' maps the sha256 of each URL to the sum of its last download, so
+files only known by another checksum can be found by their URL.
+*/
+type DownloadCache struct {
+	Dir string
+}
+
+func NewDownloadCache(dir string) (*DownloadCache, error) {
+	for _, d := range []string{"blobs/sha256", "urls"} {
+		if err := os.MkdirAll(path.Join(dir, d), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create download cache: %w", err)
+		}
+	}
+	return &DownloadCache{Dir: dir}, nil
+}
+
+func (c *DownloadCache) blob(sha256sum string) string {
+	return path.Join(c.Dir, "blobs/sha256", strings.ToLower(sha256sum))
+}
+
+func (c *DownloadCache) urlEntry(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return path.Join(c.Dir, "urls", hex.EncodeToString(sum[:]))
+}
+
+func fileSum(file string, hasher hash.Hash) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// Compute the sha256 sum of a file as hexadecimal string
+func FileSha256(file string) (string, error) {
+	return fileSum(file, sha256.New())
+}
+
+// Compute the sha512 sum of a file as hexadecimal string
+func FileSha512(file string) (string, error) {
+	return fileSum(file, sha512.New())
+}
+
+/*
+Fetch copies the cached file with the given sha256 sum to filename. It
+returns false if the file is not cached; corrupted entries are dropped.
+*/
+func (c *DownloadCache) Fetch(sha256sum, filename string) (bool, error) {
+	blob := c.blob(sha256sum)
+	if _, err := os.Stat(blob); os.IsNotExist(err) {
+		return false, nil
+	}
+
+	actual, err := FileSha256(blob)
+	if err != nil {
+		return false, err
+	}
+	if actual != strings.ToLower(sha256sum) {
+		return false, os.Remove(blob)
+	}
+
+	if err := CopyFile(blob, filename, 0644); err != nil {
+		return false, err
+	}
+
+	// The modification time tracks the last use for pruning
+	now := time.Now()
+	return true, os.Chtimes(blob, now, now)
+}
+
+// Store adds the file downloaded from url to the cache
+func (c *DownloadCache) Store(url, filename, sha256sum string) error {
+	blob := c.blob(sha256sum)
+	if _, err := os.Stat(blob); os.IsNotExist(err) {
+		if err := CopyFile(filename, blob, 0644); err != nil {
+			return err
+		}
+	}
+
+	entry := c.urlEntry(url)
+	return os.WriteFile(entry, []byte(strings.ToLower(sha256sum)+"\n"+url+"\n"), 0644)
+}
+
+// Lookup returns the sha256 sum of the last download from url, if any
+func (c *DownloadCache) Lookup(url string) string {
+	data, err := os.ReadFile(c.urlEntry(url))
+	if err != nil {
+		return ""
+	}
+	sha256sum, cachedURL, _ := strings.Cut(string(data), "\n")
+	if strings.TrimSuffix(cachedURL, "\n") != url {
+		return ""
+	}
+	return sha256sum
+}
+
+/*
+Prune removes the cached files not used for maxAge, all files if maxAge
+is zero, and the URL entries referring to removed files. It returns the
+number of removed files and the freed space in bytes.
+*/
+func (c *DownloadCache) Prune(maxAge time.Duration) (int, int64, error) {
+	removed := 0
+	var freed int64
+
+	blobsDir := path.Join(c.Dir, "blobs/sha256")
+	blobs, err := os.ReadDir(blobsDir)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, b := range blobs {
+		info, err := b.Info()
+		if err != nil {
+			return removed, freed, err
+		}
+		if maxAge > 0 && time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+		if err := os.Remove(path.Join(blobsDir, b.Name())); err != nil {
+			return removed, freed, err
+		}
+		removed++
+		freed += info.Size()
+	}
+
+	urlsDir := path.Join(c.Dir, "urls")
+	urls, err := os.ReadDir(urlsDir)
+	if err != nil {
+		return removed, freed, err
+	}
+	for _, u := range urls {
+		entry := path.Join(urlsDir, u.Name())
+		data, err := os.ReadFile(entry)
+		if err != nil {
+			return removed, freed, err
+		}
+		sha256sum, _, _ := strings.Cut(string(data), "\n")
+		if _, err := os.Stat(c.blob(sha256sum)); os.IsNotExist(err) {
+			if err := os.Remove(entry); err != nil {
+				return removed, freed, err
+			}
+		}
+	}
+
+	return removed, freed, nil
+}
@@ -0,0 +1,42 @@
+package debos_test
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadCache(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := debos.NewDownloadCache(path.Join(dir, "cache"))
+	assert.NoError(t, err)
+
+	file := path.Join(dir, "file")
+	assert.NoError(t, os.WriteFile(file, []byte("content"), 0644))
+	sum, err := debos.FileSha256(file)
+	assert.NoError(t, err)
+
+	url := "https://example.org/file"
+	assert.Equal(t, "", cache.Lookup(url))
+	assert.NoError(t, cache.Store(url, file, sum))
+	assert.Equal(t, sum, cache.Lookup(url))
+	assert.Equal(t, "", cache.Lookup(url+".sig"))
+
+	cached, err := cache.Fetch(sum, path.Join(dir, "copy"))
+	assert.NoError(t, err)
+	assert.True(t, cached)
+	assert.FileExists(t, path.Join(dir, "copy"))
+
+	removed, freed, err := cache.Prune(0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	assert.Equal(t, int64(len("content")), freed)
+	assert.Equal(t, "", cache.Lookup(url))
+
+	cached, err = cache.Fetch(sum, path.Join(dir, "copy"))
+	assert.NoError(t, err)
+	assert.False(t, cached)
+}
@@ -0,0 +1,120 @@
+package debos
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+/*
+Checksum of a file, the algorithm is "sha256" or "sha512" and the sum a
+lower case hexadecimal string.
+*/
+type Checksum struct {
+	Algorithm string
+	Sum       string
+}
+
+// Guess the algorithm from the length of a hexadecimal sum
+func checksumAlgorithm(sum string) string {
+	if _, err := hex.DecodeString(sum); err != nil {
+		return ""
+	}
+	switch len(sum) {
+	case 64:
+		return "sha256"
+	case 128:
+		return "sha512"
+	default:
+		return ""
+	}
+}
+
+/*
+FindChecksum looks up the checksum of name in a SHA256SUMS or SHA512SUMS
+style file, as written by sha256sum(1) (also in binary or BSD mode). Only
+the base name of the listed files is compared.
+*/
+func FindChecksum(sumsFile, name string) (Checksum, error) {
+	f, err := os.Open(sumsFile)
+	if err != nil {
+		return Checksum{}, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		var sum, file string
+
+		if tag, rest, ok := strings.Cut(line, " ("); ok && !strings.Contains(tag, " ") {
+			// BSD style: 'SHA256 (file) = sum'
+			var found bool
+			file, sum, found = strings.Cut(rest, ") = ")
+			if !found {
+				continue
+			}
+		} else {
+			var found bool
+			sum, file, found = strings.Cut(line, " ")
+			if !found {
+				continue
+			}
+			file = strings.TrimPrefix(strings.TrimPrefix(file, " "), "*")
+		}
+
+		if path.Base(file) != name {
+			continue
+		}
+		sum = strings.ToLower(sum)
+		algorithm := checksumAlgorithm(sum)
+		if algorithm == "" {
+			return Checksum{}, fmt.Errorf("invalid checksum for '%s' in %s", name, path.Base(sumsFile))
+		}
+		return Checksum{Algorithm: algorithm, Sum: sum}, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return Checksum{}, err
+	}
+
+	return Checksum{}, fmt.Errorf("no checksum for '%s' in %s", name, path.Base(sumsFile))
+}
+
+// Check compares the checksum of file
+func (c Checksum) Check(file string) error {
+	var actual string
+	var err error
+	switch c.Algorithm {
+	case "sha256":
+		actual, err = FileSha256(file)
+	case "sha512":
+		actual, err = FileSha512(file)
+	default:
+		return fmt.Errorf("unsupported checksum algorithm '%s'", c.Algorithm)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to hash file %s: %w", file, err)
+	}
+
+	if actual != strings.ToLower(c.Sum) {
+		return fmt.Errorf("%s sum mismatch for %s. Expected %s but got %s",
+			strings.ToUpper(c.Algorithm), file, c.Sum, actual)
+	}
+	return nil
+}
+
+/*
+VerifySignature checks the detached OpenPGP signature of data with gpgv,
+only trusting the keys of the given keyring. No keyserver is contacted.
+*/
+func VerifySignature(keyring, signature, data string) error {
+	out, err := exec.Command("gpgv", "--keyring", keyring, signature, data).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("signature verification of %s failed: %w\n%s", path.Base(data), err, out)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package debos_test
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindChecksum(t *testing.T) {
+	sha256sum := strings.Repeat("ab", 32)
+	sha512sum := strings.Repeat("CD", 64)
+	sums := path.Join(t.TempDir(), "SHA256SUMS")
+	assert.NoError(t, os.WriteFile(sums, []byte(
+		sha256sum+"  images/disk.img\n"+
+			"SHA512 (rootfs.tar.gz) = "+sha512sum+"\n"+
+			"1234 *broken.bin\n"), 0644))
+
+	c, err := debos.FindChecksum(sums, "disk.img")
+	assert.NoError(t, err)
+	assert.Equal(t, debos.Checksum{Algorithm: "sha256", Sum: sha256sum}, c)
+
+	c, err = debos.FindChecksum(sums, "rootfs.tar.gz")
+	assert.NoError(t, err)
+	assert.Equal(t, debos.Checksum{Algorithm: "sha512", Sum: strings.ToLower(sha512sum)}, c)
+
+	_, err = debos.FindChecksum(sums, "broken.bin")
+	assert.EqualError(t, err, "invalid checksum for 'broken.bin' in SHA256SUMS")
+
+	_, err = debos.FindChecksum(sums, "missing.bin")
+	assert.EqualError(t, err, "no checksum for 'missing.bin' in SHA256SUMS")
+}
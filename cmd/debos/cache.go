@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/go-debos/debos"
+	"github.com/jessevdk/go-flags"
+)
+
+type cachePruneCommand struct {
+	MaxAge   time.Duration `long:"max-age" description:"Only remove files not used for this duration, e.g. 720h (default: remove all files)"`
+	cacheDir *string
+}
+
+func (c *cachePruneCommand) Execute(_ []string) error {
+	if *c.cacheDir == "" {
+		return errors.New("the required flag `--cache-dir' was not specified")
+	}
+	dir := debos.CleanPath(*c.cacheDir)
+	if _, err := os.Stat(dir); err != nil {
+		return err
+	}
+
+	cache, err := debos.NewDownloadCache(dir)
+	if err != nil {
+		return err
+	}
+
+	removed, freed, err := cache.Prune(c.MaxAge)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Removed %d cached files, freed %s\n", removed, units.HumanSize(float64(freed)))
+	return nil
+}
+
+// Register 'debos cache <command>', using the --cache-dir option of the parser
+func addCacheCommand(parser *flags.Parser, cacheDir *string) error {
+	cache, err := parser.AddCommand("cache", "Manage the download cache",
+		"Manage the download cache given with --cache-dir.", &struct{}{})
+	if err != nil {
+		return err
+	}
+
+	_, err = cache.AddCommand("prune", "Remove files from the download cache",
+		"Remove the files of the download cache not used recently, or all of them.",
+		&cachePruneCommand{cacheDir: cacheDir})
+	return err
+}
@@ -8,6 +8,7 @@ import (
 	"path"
 	"runtime/debug"
 	"strings"
+	"time"
 
 	"github.com/docker/go-units"
 	"github.com/go-debos/debos"
@@ -62,8 +63,17 @@ func handleError(context *debos.Context, err error, a debos.Action, stage string
 	return true
 }
 
-func doRun(r actions.Recipe, context *debos.Context) bool {
-	for _, a := range r.Actions {
+func doRun(r actions.Recipe, context *debos.Context) (ok bool) {
+	defer debos.StopActionLog()
+	// Cleanup methods can fail the recipe too, e.g. when assembling the image
+	defer func() {
+		ok = ok && context.State != debos.Failed
+	}()
+
+	for i, a := range r.Actions {
+		if err := debos.StartActionLog(i, a); err != nil {
+			log.Printf("Couldn't create log file: %v\n", err)
+		}
 		log.Printf("==== %s ====\n", a)
 		err := a.Run(context)
 
@@ -113,11 +123,21 @@ func main() {
 		Memory             string            `short:"m" long:"memory" description:"Amount of memory for build VM (parsed with human-readable suffix; assumed bytes if no suffix)" default:"2Gb"`
 		ShowBoot           bool              `long:"show-boot" description:"Show boot/console messages from the fakemachine"`
 		EnvironVars        map[string]string `short:"e" long:"environ-var" description:"Environment variables (use -e VARIABLE:VALUE syntax)"`
+		SecretEnvironVars  map[string]string `long:"secret-env" description:"Environment variables masked in the output (use --secret-env VARIABLE:VALUE syntax)"`
+		SecretTemplateVars map[string]string `long:"secret-var" description:"Template variables masked in the output (use --secret-var VARIABLE:VALUE syntax)"`
 		Verbose            bool              `short:"v" long:"verbose" description:"Verbose output"`
 		PrintRecipe        bool              `long:"print-recipe" description:"Print the final recipe"`
 		DryRun             bool              `long:"dry-run" description:"Check the final recipe and verify all actions without executing them"`
 		DisableFakeMachine bool              `long:"disable-fakemachine" description:"Do not use fakemachine"`
 		Version            bool              `long:"version" description:"Print debos version"`
+		LogDir             string            `long:"log-dir" description:"Directory for log files of each action and command"`
+		CacheDir           string            `long:"cache-dir" description:"Directory keeping downloaded files across builds"`
+		URLRewrites        []string          `long:"url-rewrite" description:"Rewrite URLs starting with a prefix to use a mirror (use --url-rewrite FROM=TO syntax)"`
+		Netrc              string            `long:"netrc" description:"Netrc file with download credentials (default: $NETRC or ~/.netrc)"`
+		Credentials        string            `long:"download-credentials" description:"File with download headers per host (use HOST HEADER: VALUE lines)"`
+		DownloadRetries    int               `long:"download-retries" description:"Number of retries of failed downloads, 0 disables retries" default:"5"`
+		ConnectTimeout     time.Duration     `long:"download-connect-timeout" description:"Timeout for connecting to download servers" default:"30s"`
+		ReadTimeout        time.Duration     `long:"download-read-timeout" description:"Abort downloads not receiving data for this duration" default:"60s"`
 	}
 
 	// These are the environment variables that will be detected on the
@@ -143,6 +163,14 @@ func main() {
 	fakemachineBackends := parser.FindOptionByLongName("fakemachine-backend")
 	fakemachineBackends.Choices = fakemachine.BackendNames()
 
+	// Subcommand for managing the download cache, building recipes otherwise
+	parser.SubcommandsOptional = true
+	if err := addCacheCommand(parser, &options.CacheDir); err != nil {
+		log.Println(err)
+		context.State = debos.Failed
+		return
+	}
+
 	args, err := parser.Parse()
 	if err != nil {
 		var flagsErr *flags.Error
@@ -152,6 +180,42 @@ func main() {
 		context.State = debos.Failed
 		return
 	}
+	if parser.Active != nil {
+		// The subcommand ran already
+		return
+	}
+
+	// Secrets are never printed, whatever part of debos logs them
+	log.SetOutput(debos.NewSecretMasker(debos.NewLogWriter(os.Stderr)))
+
+	if options.LogDir != "" {
+		options.LogDir = debos.CleanPath(options.LogDir)
+		// The main log of the fake machine doesn't replace the one of the host
+		name := "debos.log"
+		if fakemachine.InMachine() {
+			name = "fakemachine.log"
+		}
+		if err := debos.SetLogDir(options.LogDir, name); err != nil {
+			log.Println(err)
+			context.State = debos.Failed
+			return
+		}
+	}
+
+	// Secrets passed by the debos instance starting the fake machine
+	secrets, err := debos.SecretsFromEnviron()
+	if err != nil {
+		log.Printf("Couldn't decode secrets: %v\n", err)
+		context.State = debos.Failed
+		return
+	}
+	secrets.EnvironVars = mergeVars(secrets.EnvironVars, options.SecretEnvironVars)
+	secrets.TemplateVars = mergeVars(secrets.TemplateVars, options.SecretTemplateVars)
+	for _, vars := range []map[string]string{secrets.EnvironVars, secrets.TemplateVars} {
+		for _, v := range vars {
+			debos.AddSecret(v)
+		}
+	}
 
 	if options.Version {
 		// Use the injected Version from build system if set.
@@ -197,7 +261,8 @@ func main() {
 		context.State = debos.Failed
 		return
 	}
-	if err := r.Parse(file, options.PrintRecipe, options.Verbose, options.TemplateVars); err != nil {
+	templateVars := mergeVars(options.TemplateVars, secrets.TemplateVars)
+	if err := r.Parse(file, options.PrintRecipe, options.Verbose, templateVars); err != nil {
 		log.Println(err)
 		context.State = debos.Failed
 		return
@@ -260,6 +325,58 @@ func main() {
 
 	context.Architecture = r.Architecture
 	context.SectorSize = r.SectorSize
+	context.ServicesMethod, _ = debos.ParseServicesMethod(r.Services)
+	context.Network, _ = debos.ParseNetworkConfig(r.Network.Policy, r.Network.Nameservers)
+
+	if options.CacheDir != "" {
+		context.Downloaddir = debos.CleanPath(options.CacheDir)
+		if _, err := debos.NewDownloadCache(context.Downloaddir); err != nil {
+			log.Println(err)
+			context.State = debos.Failed
+			return
+		}
+	}
+
+	for _, rule := range options.URLRewrites {
+		rewrite, err := debos.ParseURLRewrite(rule)
+		if err != nil {
+			log.Println(err)
+			context.State = debos.Failed
+			return
+		}
+		context.URLRewrites = append(context.URLRewrites, rewrite)
+	}
+
+	context.Download = debos.DownloadConfig{
+		ConnectTimeout: options.ConnectTimeout,
+		ReadTimeout:    options.ReadTimeout,
+		Retries:        options.DownloadRetries,
+	}
+	if options.DownloadRetries <= 0 {
+		// Zero retries in DownloadConfig selects the default, disable them instead
+		context.Download.Retries = -1
+	}
+
+	if options.Netrc == "" {
+		options.Netrc = debos.DefaultNetrc()
+	}
+	if options.Netrc != "" {
+		options.Netrc = debos.CleanPath(options.Netrc)
+	}
+	if options.Credentials != "" {
+		options.Credentials = debos.CleanPath(options.Credentials)
+	}
+	if options.Netrc != "" || options.Credentials != "" {
+		context.Download.Credentials, err = debos.LoadCredentials(options.Netrc, options.Credentials)
+		if err != nil {
+			log.Println(err)
+			context.State = debos.Failed
+			return
+		}
+		for _, v := range context.Download.Credentials.Secrets() {
+			debos.AddSecret(v)
+		}
+	}
 
 	context.State = debos.Success
 
@@ -291,6 +408,11 @@ func main() {
 		}
 	}
 
+	// Secret variables are not listed on the command line of the fake machine
+	for k, v := range secrets.EnvironVars {
+		context.EnvironVars[k] = v
+	}
+
 	for _, a := range r.Actions {
 		err = a.Verify(&context)
 		if handleError(&context, err, a, "Verify") {
@@ -343,9 +465,25 @@ func main() {
 		if context.EnvironVars != nil {
 			EnvironString := []string{}
 			for k, v := range context.EnvironVars {
+				if _, secret := secrets.EnvironVars[k]; secret {
+					continue
+				}
 				warnLocalhost(k, v)
 				EnvironString = append(EnvironString, fmt.Sprintf("%s=%s", k, v))
 			}
+			if len(secrets.EnvironVars) > 0 || len(secrets.TemplateVars) > 0 {
+				environ, err := secrets.Environ()
+				if err != nil {
+					log.Printf("Couldn't encode secrets: %v\n", err)
+					context.State = debos.Failed
+					return
+				}
+				EnvironString = append(EnvironString, environ)
+			}
+			// Secrets referenced by the credentials file, not added to the args
+			if context.Download.Credentials != nil {
+				EnvironString = append(EnvironString, context.Download.Credentials.Environ()...)
+			}
 			m.SetEnviron(EnvironString) // And save the resulting environ vars on m
 		}
 
@@ -360,6 +498,16 @@ func main() {
 			args = append(args, "--environ-var", fmt.Sprintf("%s:%s", k, v))
 		}
 
+		if options.LogDir != "" {
+			m.AddVolume(options.LogDir)
+			args = append(args, "--log-dir", options.LogDir)
+		}
+
+		if context.Downloaddir != "" {
+			m.AddVolume(context.Downloaddir)
+			args = append(args, "--cache-dir", context.Downloaddir)
+		}
+
 		m.AddVolume(context.RecipeDir)
 		args = append(args, file)
 
@@ -372,6 +520,42 @@ func main() {
 			args = append(args, "--verbose")
 		}
 
+		for _, rule := range options.URLRewrites {
+			args = append(args, "--url-rewrite", rule)
+		}
+
+		// Only the credential files are shared, not the directories holding them
+		if options.Netrc != "" || options.Credentials != "" {
+			credentialsDir, err := os.MkdirTemp("", "debos-credentials-")
+			if err != nil {
+				log.Println(err)
+				context.State = debos.Failed
+				return
+			}
+			defer os.RemoveAll(credentialsDir)
+			m.AddVolume(credentialsDir)
+
+			for _, f := range []struct{ option, file, name string }{
+				{"--netrc", options.Netrc, "netrc"},
+				{"--download-credentials", options.Credentials, "credentials"},
+			} {
+				if f.file == "" {
+					continue
+				}
+				copied := path.Join(credentialsDir, f.name)
+				if err := debos.CopyFile(f.file, copied, 0600); err != nil {
+					log.Printf("Couldn't copy %s: %v\n", f.file, err)
+					context.State = debos.Failed
+					return
+				}
+				args = append(args, f.option, copied)
+			}
+		}
+
+		args = append(args, "--download-retries", fmt.Sprint(options.DownloadRetries))
+		args = append(args, "--download-connect-timeout", options.ConnectTimeout.String())
+		args = append(args, "--download-read-timeout", options.ReadTimeout.String())
+
 		for _, a := range r.Actions {
 			// Stack PostMachineCleanup methods
 			defer func(action debos.Action) {
@@ -449,3 +633,14 @@ func main() {
 		log.Printf("==== Recipe done ====")
 	}
 }
+
+// Merge variable maps, values of the later maps take precedence
+func mergeVars(maps ...map[string]string) map[string]string {
+	merged := map[string]string{}
+	for _, m := range maps {
+		for k, v := range m {
+			merged[k] = v
+		}
+	}
+	return merged
+}
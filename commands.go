@@ -7,9 +7,11 @@ import (
 	"io"
 	"log"
 	"math/rand"
+	"net"
 	"os"
 	"os/exec"
 	"path"
+	"syscall"
 )
 
 type ChrootEnterMethod int
@@ -20,11 +22,73 @@ const (
 	ChrootMethodChroot                          // use chroot to create the chroot environment
 )
 
+type NetworkPolicy int
+
+// DNS/network access policy for commands running in the chroot
+const (
+	NetworkPolicyHost        NetworkPolicy = iota // Copy the host resolv.conf into the chroot
+	NetworkPolicyNameservers                      // Generate resolv.conf from a list of nameservers
+	NetworkPolicyBind                             // Bind-mount the host resolv.conf read-only
+	NetworkPolicyNone                             // No network access at all
+)
+
+type NetworkConfig struct {
+	Policy      NetworkPolicy
+	Nameservers []string // Used with NetworkPolicyNameservers
+}
+
+var networkPolicies = map[string]NetworkPolicy{
+	"host":        NetworkPolicyHost,
+	"nameservers": NetworkPolicyNameservers,
+	"bind":        NetworkPolicyBind,
+	"none":        NetworkPolicyNone,
+}
+
+/*
+ParseNetworkConfig maps the recipe 'network' property to a NetworkConfig.
+If the policy is omitted it defaults to 'nameservers' when a list of
+nameservers is given, 'host' otherwise.
+*/
+func ParseNetworkConfig(policy string, nameservers []string) (NetworkConfig, error) {
+	var config NetworkConfig
+
+	if policy == "" {
+		policy = "host"
+		if len(nameservers) > 0 {
+			policy = "nameservers"
+		}
+	}
+
+	p, ok := networkPolicies[policy]
+	if !ok {
+		return config, fmt.Errorf("unsupported network policy '%s'", policy)
+	}
+
+	if p == NetworkPolicyNameservers && len(nameservers) == 0 {
+		return config, fmt.Errorf("network policy 'nameservers' requires at least one nameserver")
+	}
+	if p != NetworkPolicyNameservers && len(nameservers) > 0 {
+		return config, fmt.Errorf("nameservers can't be used with network policy '%s'", policy)
+	}
+
+	for _, ns := range nameservers {
+		if net.ParseIP(ns) == nil {
+			return config, fmt.Errorf("incorrect nameserver address '%s'", ns)
+		}
+	}
+
+	config.Policy = p
+	config.Nameservers = nameservers
+	return config, nil
+}
+
 type Command struct {
 	Architecture string            // Architecture of the chroot, nil if same as host
 	Dir          string            // Working dir to run command in
 	Chroot       string            // Run in the chroot at path
 	ChrootMethod ChrootEnterMethod // Method to enter the chroot
+	Services     ServicesMethod    // Method to prevent services start in the chroot
+	Network      NetworkConfig     // DNS/network access policy in the chroot
 
 	bindMounts []string /// Items to bind mount
 	extraEnv   []string // Extra environment variables to set
@@ -45,10 +109,12 @@ func (w commandWrapper) out(atEOF bool) {
 		s, err := w.buffer.ReadString('\n')
 		if err == nil {
 			log.Printf("%s | %v", w.label, s)
+			writeCommandLog(w.label, s)
 		} else {
 			if len(s) > 0 {
 				if atEOF && err == io.EOF {
 					log.Printf("%s | %v\n", w.label, s)
+					writeCommandLog(w.label, s)
 				} else {
 					w.buffer.WriteString(s)
 				}
@@ -69,7 +135,8 @@ func (w *commandWrapper) flush() {
 }
 
 func NewChrootCommandForContext(context Context) Command {
-	c := Command{Architecture: context.Architecture, Chroot: context.Rootdir, ChrootMethod: ChrootMethodNspawn}
+	c := Command{Architecture: context.Architecture, Chroot: context.Rootdir, ChrootMethod: ChrootMethodNspawn,
+		Services: context.ServicesMethod, Network: context.Network}
 
 	if context.EnvironVars != nil {
 		for k, v := range context.EnvironVars {
@@ -117,6 +184,20 @@ func (cmd *Command) AddBindMount(source, target string) {
 	cmd.bindMounts = append(cmd.bindMounts, mount)
 }
 
+// Content of the resolv.conf to be used in the chroot
+func (cmd *Command) resolvConf() ([]byte, error) {
+	if cmd.Network.Policy == NetworkPolicyNameservers {
+		var b bytes.Buffer
+		for _, ns := range cmd.Network.Nameservers {
+			fmt.Fprintf(&b, "nameserver %s\n", ns)
+		}
+		return b.Bytes(), nil
+	}
+
+	/* Expect a relatively small file here */
+	return os.ReadFile("/etc/resolv.conf")
+}
+
 func (cmd *Command) saveResolvConf() (*[sha256.Size]byte, error) {
 	hostconf := "/etc/resolv.conf"
 	chrootedconf := path.Join(cmd.Chroot, hostconf)
@@ -127,6 +208,12 @@ func (cmd *Command) saveResolvConf() (*[sha256.Size]byte, error) {
 		return nil, nil
 	}
 
+	switch cmd.Network.Policy {
+	case NetworkPolicyNone, NetworkPolicyBind:
+		// No copy of the resolv.conf is needed
+		return nil, nil
+	}
+
 	// There may not be an existing resolv.conf
 	if _, err := os.Lstat(chrootedconf); !os.IsNotExist(err) {
 		if err = os.Rename(chrootedconf, savedconf); err != nil {
@@ -134,8 +221,7 @@ func (cmd *Command) saveResolvConf() (*[sha256.Size]byte, error) {
 		}
 	}
 
-	/* Expect a relatively small file here */
-	data, err := os.ReadFile(hostconf)
+	data, err := cmd.resolvConf()
 	if err != nil {
 		return nil, err
 	}
@@ -210,12 +296,91 @@ func (cmd *Command) restoreResolvConf(sum *[sha256.Size]byte) error {
 	return nil
 }
 
+/*
+bindResolvConf bind-mounts the host resolv.conf read-only over the one in
+the chroot. The original file (or symlink) is moved aside meanwhile.
+*/
+func (cmd *Command) bindResolvConf() (bool, error) {
+	hostconf := "/etc/resolv.conf"
+	chrootedconf := path.Join(cmd.Chroot, hostconf)
+	savedconf := chrootedconf + ".debos"
+
+	if cmd.ChrootMethod == ChrootMethodNone || cmd.Network.Policy != NetworkPolicyBind {
+		return false, nil
+	}
+
+	hostpath, err := RealPath(hostconf)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := os.Lstat(chrootedconf); !os.IsNotExist(err) {
+		if err = os.Rename(chrootedconf, savedconf); err != nil {
+			return false, err
+		}
+	}
+
+	if err := os.WriteFile(chrootedconf, nil, 0644); err != nil {
+		return true, err
+	}
+
+	if err := syscall.Mount(hostpath, chrootedconf, "", syscall.MS_BIND, ""); err != nil {
+		return true, fmt.Errorf("failed to bind mount %s: %w", hostconf, err)
+	}
+
+	err = syscall.Mount("", chrootedconf, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, "")
+	if err != nil {
+		return true, fmt.Errorf("failed to remount %s read-only: %w", hostconf, err)
+	}
+
+	return true, nil
+}
+
+func (cmd *Command) unbindResolvConf() error {
+	hostconf := "/etc/resolv.conf"
+	chrootedconf := path.Join(cmd.Chroot, hostconf)
+	savedconf := chrootedconf + ".debos"
+
+	// The mount may be missing if bindResolvConf failed half-way
+	_ = syscall.Unmount(chrootedconf, 0)
+
+	if err := os.Remove(chrootedconf); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if _, err := os.Lstat(savedconf); !os.IsNotExist(err) {
+		// Restore the original version
+		if err = os.Rename(savedconf, chrootedconf); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (cmd Command) Run(label string, cmdline ...string) error {
 	var options []string
+	env := cmd.extraEnv
+
+	// Disable services start/stop for commands running in chroot
+	if cmd.ChrootMethod != ChrootMethodNone {
+		services := NewServicesManager(cmd.Services, cmd.Chroot)
+		if err := services.Deny(); err != nil {
+			return err
+		}
+		defer func() {
+			_ = services.Allow()
+		}()
+		env = append(append([]string{}, cmd.extraEnv...), services.Environ()...)
+	}
+
 	switch cmd.ChrootMethod {
 	case ChrootMethodNone:
 		options = cmdline
 	case ChrootMethodChroot:
+		if cmd.Network.Policy == NetworkPolicyNone {
+			options = append(options, "unshare", "--net")
+		}
 		options = append(options, "chroot")
 		options = append(options, cmd.Chroot)
 		options = append(options, cmdline...)
@@ -228,7 +393,10 @@ func (cmd Command) Run(label string, cmdline ...string) error {
 		options = append(options, fmt.Sprintf("--machine=debos-%d", rand.Int63()))
 		options = append(options, "--keep-unit")
 		options = append(options, "--console=pipe")
-		for _, e := range cmd.extraEnv {
+		if cmd.Network.Policy == NetworkPolicyNone {
+			options = append(options, "--private-network")
+		}
+		for _, e := range env {
 			options = append(options, "--setenv", e)
 		}
 		for _, b := range cmd.bindMounts {
@@ -247,20 +415,22 @@ func (cmd Command) Run(label string, cmdline ...string) error {
 
 	defer w.flush()
 
-	if len(cmd.extraEnv) > 0 && cmd.ChrootMethod != ChrootMethodNspawn {
-		exe.Env = append(os.Environ(), cmd.extraEnv...)
+	if len(env) > 0 && cmd.ChrootMethod != ChrootMethodNspawn {
+		exe.Env = append(os.Environ(), env...)
 	}
 
-	// Disable services start/stop for commands running in chroot
-	if cmd.ChrootMethod != ChrootMethodNone {
-		services := ServiceHelper{cmd.Chroot}
-		if err := services.Deny(); err != nil {
-			return err
-		}
+	// Bind mount the host resolv.conf if requested
+	bound, err := cmd.bindResolvConf()
+	if bound {
 		defer func() {
-			_ = services.Allow()
+			if err := cmd.unbindResolvConf(); err != nil {
+				log.Printf("Failed to restore /etc/resolv.conf: %v", err)
+			}
 		}()
 	}
+	if err != nil {
+		return err
+	}
 
 	// Save the original resolv.conf and copy version from host
 	resolvsum, err := cmd.saveResolvConf()
@@ -1,9 +1,62 @@
 package debos
 
 import (
+	"os"
+	"path"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestBasicCommand(_ *testing.T) {
 	_ = Command{}.Run("out", "ls", "-l")
 }
+
+func TestNetworkConfig(t *testing.T) {
+	config, err := ParseNetworkConfig("", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, NetworkPolicyHost, config.Policy)
+
+	config, err = ParseNetworkConfig("", []string{"192.0.2.53", "2001:db8::53"})
+	assert.NoError(t, err)
+	assert.Equal(t, NetworkPolicyNameservers, config.Policy)
+
+	_, err = ParseNetworkConfig("nameservers", nil)
+	assert.EqualError(t, err, "network policy 'nameservers' requires at least one nameserver")
+
+	_, err = ParseNetworkConfig("", []string{"dns.example.org"})
+	assert.EqualError(t, err, "incorrect nameserver address 'dns.example.org'")
+}
+
+func TestResolvConfNameservers(t *testing.T) {
+	rootdir := t.TempDir()
+	resolvconf := path.Join(rootdir, "etc/resolv.conf")
+	assert.NoError(t, os.MkdirAll(path.Dir(resolvconf), 0755))
+	assert.NoError(t, os.WriteFile(resolvconf, []byte("original\n"), 0644))
+
+	cmd := Command{
+		Chroot:       rootdir,
+		ChrootMethod: ChrootMethodChroot,
+		Network: NetworkConfig{
+			Policy:      NetworkPolicyNameservers,
+			Nameservers: []string{"192.0.2.53"},
+		},
+	}
+
+	sum, err := cmd.saveResolvConf()
+	assert.NoError(t, err)
+	data, err := os.ReadFile(resolvconf)
+	assert.NoError(t, err)
+	assert.Equal(t, "# Automatically generated by Debos\nnameserver 192.0.2.53\n", string(data))
+
+	assert.NoError(t, cmd.restoreResolvConf(sum))
+	data, err = os.ReadFile(resolvconf)
+	assert.NoError(t, err)
+	assert.Equal(t, "original\n", string(data))
+
+	// No resolv.conf handling without network
+	cmd.Network = NetworkConfig{Policy: NetworkPolicyNone}
+	sum, err = cmd.saveResolvConf()
+	assert.NoError(t, err)
+	assert.Nil(t, sum)
+}
@@ -0,0 +1,521 @@
+package debos
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Magic of the SVR4 portable ("newc") cpio format, with and without checksum
+const (
+	cpioNewcMagic = "070701"
+	cpioCrcMagic  = "070702"
+	cpioTrailer   = "TRAILER!!!"
+	cpioHeaderLen = 110
+)
+
+type cpioHeader struct {
+	ino      uint32
+	mode     uint32
+	uid      uint32
+	gid      uint32
+	nlink    uint32
+	mtime    uint32
+	size     uint32
+	devmajor uint32
+	devminor uint32
+	major    uint32 // of the device node
+	minor    uint32
+	check    uint32
+	name     string
+}
+
+// Number of padding bytes to align n on 4 bytes
+func cpioPad(n int64) int64 {
+	return (4 - n%4) % 4
+}
+
+func readCpioHeader(r *bufio.Reader) (*cpioHeader, error) {
+	buf := make([]byte, cpioHeaderLen)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("truncated cpio archive: %w", err)
+	}
+
+	magic := string(buf[:6])
+	if magic != cpioNewcMagic && magic != cpioCrcMagic {
+		return nil, fmt.Errorf("unsupported cpio format, only 'newc' is supported")
+	}
+
+	fields := make([]uint32, 13)
+	for i := range fields {
+		v, err := strconv.ParseUint(string(buf[6+8*i:14+8*i]), 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("corrupted cpio header")
+		}
+		fields[i] = uint32(v)
+	}
+
+	hdr := &cpioHeader{
+		ino: fields[0], mode: fields[1], uid: fields[2], gid: fields[3],
+		nlink: fields[4], mtime: fields[5], size: fields[6],
+		devmajor: fields[7], devminor: fields[8], major: fields[9], minor: fields[10],
+		check: fields[12],
+	}
+
+	namesize := int64(fields[11])
+	name := make([]byte, namesize+cpioPad(cpioHeaderLen+namesize))
+	if _, err := io.ReadFull(r, name); err != nil {
+		return nil, fmt.Errorf("truncated cpio archive: %w", err)
+	}
+	hdr.name = strings.TrimRight(string(name[:namesize]), "\x00")
+
+	return hdr, nil
+}
+
+// Convert the cpio header to a tar one, so entries go through the tar extractor
+func (c *cpioHeader) tarHeader() (*tar.Header, error) {
+	hdr := &tar.Header{
+		Name:     c.name,
+		Mode:     int64(c.mode & 07777),
+		Uid:      int(c.uid),
+		Gid:      int(c.gid),
+		Size:     int64(c.size),
+		ModTime:  time.Unix(int64(c.mtime), 0),
+		Devmajor: int64(c.major),
+		Devminor: int64(c.minor),
+	}
+
+	switch c.mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		hdr.Typeflag = tar.TypeDir
+	case syscall.S_IFREG:
+		hdr.Typeflag = tar.TypeReg
+	case syscall.S_IFLNK:
+		hdr.Typeflag = tar.TypeSymlink
+	case syscall.S_IFCHR:
+		hdr.Typeflag = tar.TypeChar
+	case syscall.S_IFBLK:
+		hdr.Typeflag = tar.TypeBlock
+	case syscall.S_IFIFO:
+		hdr.Typeflag = tar.TypeFifo
+	default:
+		return nil, fmt.Errorf("unsupported mode %o for cpio entry %s", c.mode, c.name)
+	}
+
+	return hdr, nil
+}
+
+/*
+extractCpio extracts a newc cpio stream. Hard links are matched by inode
+number; the content may be stored with any of the links.
+*/
+func (e *extractor) extractCpio(r io.Reader) error {
+	br := bufio.NewReader(r)
+	links := map[[3]uint32]string{}
+
+	for {
+		c, err := readCpioHeader(br)
+		if err != nil {
+			return err
+		}
+		if c.name == cpioTrailer {
+			break
+		}
+
+		hdr, err := c.tarHeader()
+		if err != nil {
+			return err
+		}
+		data := io.LimitReader(br, int64(c.size))
+
+		ok, err := e.filterTarHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			if err := discardCpioData(br, c.size); err != nil {
+				return err
+			}
+			continue
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeSymlink:
+			link, err := io.ReadAll(data)
+			if err != nil {
+				return err
+			}
+			hdr.Linkname = string(link)
+			hdr.Size = 0
+		case tar.TypeReg:
+			key := [3]uint32{c.devmajor, c.devminor, c.ino}
+			first, seen := links[key]
+			if c.nlink > 1 && !seen {
+				links[key] = hdr.Name
+			}
+			if seen {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+			}
+		}
+
+		if err := e.extractTarEntry(hdr, data); err != nil {
+			return err
+		}
+
+		// Content stored with a later link
+		if hdr.Typeflag == tar.TypeLink && c.size > 0 {
+			name, err := cleanEntryName(hdr.Name)
+			if err != nil {
+				return err
+			}
+			target, err := resolveInRoot(e.destination, name)
+			if err != nil {
+				return err
+			}
+			if err := writeLinkedFile(target, data); err != nil {
+				return err
+			}
+		}
+
+		if _, err := io.Copy(io.Discard, data); err != nil {
+			return err
+		}
+		if _, err := br.Discard(int(cpioPad(int64(c.size)))); err != nil {
+			return err
+		}
+	}
+
+	return e.finish()
+}
+
+// Skip the content of an entry, padding included
+func discardCpioData(r *bufio.Reader, size uint32) error {
+	_, err := r.Discard(int(int64(size) + cpioPad(int64(size))))
+	return err
+}
+
+// Replace the content of an existing file, keeping its inode
+func writeLinkedFile(target string, r io.Reader) error {
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+type cpioWriter struct {
+	w      io.Writer
+	inodes map[[2]uint64]uint32 // Host device and inode to archive inode
+	next   uint32
+}
+
+func (cw *cpioWriter) writeHeader(c *cpioHeader) error {
+	namesize := int64(len(c.name) + 1)
+	fields := []uint32{
+		c.ino, c.mode, c.uid, c.gid, c.nlink, c.mtime, c.size,
+		c.devmajor, c.devminor, c.major, c.minor, uint32(namesize), 0,
+	}
+
+	var b strings.Builder
+	b.WriteString(cpioNewcMagic)
+	for _, f := range fields {
+		fmt.Fprintf(&b, "%08X", f)
+	}
+	b.WriteString(c.name)
+	b.WriteString(strings.Repeat("\x00", int(1+cpioPad(cpioHeaderLen+namesize))))
+
+	_, err := io.WriteString(cw.w, b.String())
+	return err
+}
+
+func (cw *cpioWriter) writeData(r io.Reader, size int64) error {
+	if _, err := io.CopyN(cw.w, r, size); err != nil {
+		return err
+	}
+	_, err := cw.w.Write(make([]byte, cpioPad(size)))
+	return err
+}
+
+// Add the file p of the source directory as name
+func (cw *cpioWriter) add(p, name string, info os.FileInfo, mtime time.Time) error {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("can't stat %s", p)
+	}
+
+	c := &cpioHeader{
+		mode:  st.Mode,
+		uid:   st.Uid,
+		gid:   st.Gid,
+		nlink: 1,
+		mtime: uint32(info.ModTime().Unix()),
+		major: uint32(((st.Rdev >> 8) & 0xfff) | ((st.Rdev >> 32) &^ 0xfff)),
+		minor: uint32((st.Rdev & 0xff) | ((st.Rdev >> 12) &^ 0xff)),
+		name:  name,
+	}
+	if !mtime.IsZero() && info.ModTime().After(mtime) {
+		c.mtime = uint32(mtime.Unix())
+	}
+
+	// Inodes are renumbered to keep the archive reproducible, hard links
+	// keep their content with the first link only
+	key := [2]uint64{uint64(st.Dev), st.Ino}
+	ino, seen := cw.inodes[key]
+	if !seen {
+		cw.next++
+		ino = cw.next
+		if info.Mode().IsRegular() && st.Nlink > 1 {
+			cw.inodes[key] = ino
+		}
+	}
+	c.ino = ino
+	if info.Mode().IsRegular() && st.Nlink > 1 {
+		c.nlink = uint32(st.Nlink)
+	}
+	if info.IsDir() {
+		c.nlink = 2
+	}
+
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		link, err := os.Readlink(p)
+		if err != nil {
+			return err
+		}
+		c.size = uint32(len(link))
+		if err := cw.writeHeader(c); err != nil {
+			return err
+		}
+		return cw.writeData(strings.NewReader(link), int64(len(link)))
+	case info.Mode().IsRegular() && !seen:
+		if info.Size() > 0xffffffff {
+			return fmt.Errorf("file %s is too big for cpio archive", p)
+		}
+		c.size = uint32(info.Size())
+		if err := cw.writeHeader(c); err != nil {
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return cw.writeData(f, info.Size())
+	default:
+		return cw.writeHeader(c)
+	}
+}
+
+/*
+packCpio writes the content of the source directory as newc cpio stream,
+in lexical order. Owners are always stored numerically.
+*/
+func packCpio(out io.Writer, source string, mtime time.Time) error {
+	cw := &cpioWriter{w: out, inodes: map[[2]uint64]uint32{}}
+
+	walker := func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(source, p)
+		if err != nil {
+			return err
+		}
+		return cw.add(p, filepath.ToSlash(name), info, mtime)
+	}
+
+	if err := filepath.Walk(source, walker); err != nil {
+		return err
+	}
+
+	return cw.writeHeader(&cpioHeader{nlink: 1, name: cpioTrailer})
+}
+
+// Compression types supported natively for writing
+var cpioCompressions = map[string]string{
+	".gz":  "gz",
+	".xz":  "xz",
+	".zst": "zstd",
+}
+
+/*
+CpioCompressions returns the compression types supported for packing cpio
+archives, 'none' and 'auto' (guess from the file extension) included.
+*/
+func CpioCompressions() []string {
+	types := []string{"auto", "none"}
+	for _, c := range cpioCompressions {
+		types = append(types, c)
+	}
+	sort.Strings(types)
+	return types
+}
+
+/*
+compressWriter wraps w with a compressor of the given type. Only the
+compression level of 'gz' and 'zstd' may be set, threads are supported
+by 'zstd' only.
+*/
+func compressWriter(w io.Writer, compression string, level, threads int) (io.WriteCloser, error) {
+	if threads > 0 && compression != "zstd" {
+		return nil, fmt.Errorf("threads are not supported with compression '%s'", compression)
+	}
+
+	switch compression {
+	case "", "none":
+		if level > 0 {
+			return nil, fmt.Errorf("compression level needs a compression type")
+		}
+		return nopWriteCloser{w}, nil
+	case "gz":
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case "xz":
+		if level > 0 {
+			return nil, fmt.Errorf("compression level is not supported with compression 'xz'")
+		}
+		return xz.NewWriter(w)
+	case "zstd":
+		options := []zstd.EOption{}
+		if level > 0 {
+			options = append(options, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		if threads > 0 {
+			options = append(options, zstd.WithEncoderConcurrency(threads))
+		}
+		return zstd.NewWriter(w, options...)
+	default:
+		return nil, fmt.Errorf("compression '%s' is not supported for writing", compression)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func (cpio *ArchiveCpio) compression() string {
+	compression, _ := cpio.options["compression"].(string)
+	if compression == "auto" {
+		ext := strings.ToLower(filepath.Ext(cpio.file))
+		if ext == ".cpio" {
+			return "none"
+		}
+		compression = cpioCompressions[ext]
+	}
+	return compression
+}
+
+/*
+Unpack extracts the cpio archive, the compression is detected from the
+content if not set.
+*/
+func (cpio *ArchiveCpio) Unpack(destination string) error {
+	return cpio.unpack(destination, false)
+}
+
+func (cpio *ArchiveCpio) RelaxedUnpack(destination string) error {
+	return cpio.unpack(destination, true)
+}
+
+func (cpio *ArchiveCpio) unpack(destination string, relaxed bool) error {
+	e, err := cpio.extractor(destination, relaxed)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(cpio.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := decompressReader(f, cpio.compression())
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return e.extractCpio(r)
+}
+
+// Pack creates the (compressed) newc cpio archive, e.g. for initramfs
+func (cpio *ArchiveCpio) Pack(source string) error {
+	compression := cpio.compression()
+	if compression == "" && cpio.options["compression"] == "auto" {
+		return fmt.Errorf("can't guess the compression of '%s' from its extension", cpio.file)
+	}
+
+	f, err := os.Create(cpio.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = func() error {
+		bw := bufio.NewWriter(f)
+		cw, err := compressWriter(bw, compression, cpio.intOption("compressionlevel"), cpio.intOption("threads"))
+		if err != nil {
+			return err
+		}
+		if err := packCpio(cw, source, cpio.mtimeOption()); err != nil {
+			return err
+		}
+		if err := cw.Close(); err != nil {
+			return err
+		}
+		return bw.Flush()
+	}()
+	if err != nil {
+		os.Remove(cpio.file)
+		return err
+	}
+
+	return f.Close()
+}
+
+func (cpio *ArchiveCpio) AddOption(key, value interface{}) error {
+	switch key {
+	case "compression":
+		compression, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("wrong type for value")
+		}
+		// bzip2 archives can only be unpacked
+		if !slices.Contains(CpioCompressions(), compression) && compression != "bzip2" {
+			return fmt.Errorf("compression '%s' is not supported", compression)
+		}
+		cpio.options["compression"] = compression
+
+	default:
+		if ok, err := cpio.addPackOption(key, value); ok {
+			return err
+		}
+		if ok, err := cpio.addUnpackOption(key, value); ok {
+			return err
+		}
+		return fmt.Errorf("option '%v' is not supported for cpio archive type", key)
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package debos
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+type netrcEntry struct {
+	login    string
+	password string
+}
+
+/*
+Credentials for the downloads, taken from a netrc file and from a file
+listing extra headers (e.g. bearer tokens) per host. They are only sent
+to the host they are configured for.
+*/
+type Credentials struct {
+	machines map[string]netrcEntry // Keyed by host name, "" for the default entry
+	headers  map[string]http.Header
+	environ  []string
+}
+
+/*
+LoadCredentials reads the netrc file and the headers file, both optional.
+Lines of the headers file have the form 'host Header-Name: value', where
+host is a host name optionally followed by a port. References to
+environment variables like ${TOKEN} are expanded in the values, so the
+secrets can be kept out of the file.
+*/
+func LoadCredentials(netrc, headersFile string) (*Credentials, error) {
+	c := &Credentials{
+		machines: map[string]netrcEntry{},
+		headers:  map[string]http.Header{},
+	}
+
+	if netrc != "" {
+		if err := c.loadNetrc(netrc); err != nil {
+			return nil, fmt.Errorf("failed to read netrc file %s: %w", netrc, err)
+		}
+	}
+
+	if headersFile != "" {
+		if err := c.loadHeaders(headersFile); err != nil {
+			return nil, fmt.Errorf("failed to read credentials file %s: %w", headersFile, err)
+		}
+	}
+
+	return c, nil
+}
+
+func (c *Credentials) loadNetrc(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	var machine *string
+	var entry netrcEntry
+	save := func() {
+		if machine != nil {
+			c.machines[*machine] = entry
+		}
+	}
+
+	lines := strings.Split(string(data), "\n")
+	for i := 0; i < len(lines); i++ {
+		fields := strings.Fields(lines[i])
+		for j := 0; j < len(fields); j++ {
+			value := func() string {
+				if j+1 < len(fields) {
+					j++
+					return fields[j]
+				}
+				return ""
+			}
+
+			switch fields[j] {
+			case "machine":
+				save()
+				name := value()
+				machine, entry = &name, netrcEntry{}
+			case "default":
+				save()
+				name := ""
+				machine, entry = &name, netrcEntry{}
+			case "login":
+				entry.login = value()
+			case "password":
+				entry.password = value()
+			case "account":
+				value()
+			case "macdef":
+				// Macro definitions run until the next empty line
+				for i+1 < len(lines) && strings.TrimSpace(lines[i+1]) != "" {
+					i++
+				}
+				j = len(fields)
+			default:
+				if strings.HasPrefix(fields[j], "#") {
+					j = len(fields)
+					continue
+				}
+				return fmt.Errorf("unexpected token '%s' on line %d", fields[j], i+1)
+			}
+		}
+	}
+	save()
+
+	return nil
+}
+
+func (c *Credentials) loadHeaders(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		host, header, _ := strings.Cut(line, " ")
+		name, value, ok := strings.Cut(strings.TrimSpace(header), ":")
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return fmt.Errorf("line %d: expected 'host Header-Name: value'", n)
+		}
+
+		var missing []string
+		value = os.Expand(strings.TrimSpace(value), func(v string) string {
+			val, ok := os.LookupEnv(v)
+			if !ok {
+				missing = append(missing, v)
+			} else if !slices.Contains(c.environ, v+"="+val) {
+				c.environ = append(c.environ, v+"="+val)
+			}
+			return val
+		})
+		if len(missing) > 0 {
+			return fmt.Errorf("line %d: environment variable '%s' is not set", n, missing[0])
+		}
+
+		if c.headers[host] == nil {
+			c.headers[host] = http.Header{}
+		}
+		c.headers[host].Add(name, value)
+	}
+
+	return scanner.Err()
+}
+
+/*
+Environ returns the environment variables referenced by the headers file
+in the format of os.Environ(), to be passed on to the fake machine.
+*/
+func (c *Credentials) Environ() []string {
+	return c.environ
+}
+
+// Secrets returns the passwords and header values, to be masked in the logs
+func (c *Credentials) Secrets() []string {
+	var secrets []string
+	for _, entry := range c.machines {
+		if entry.password != "" {
+			secrets = append(secrets, entry.password)
+		}
+	}
+	for _, headers := range c.headers {
+		for _, values := range headers {
+			secrets = append(secrets, values...)
+		}
+	}
+	return secrets
+}
+
+/*
+apply sets the credentials for the host of the request, removing those
+of any other host, e.g. after a redirect. The netrc default entry is only
+used for the host of the original request, like curl does without
+--location-trusted.
+*/
+func (c *Credentials) apply(req *http.Request, originHost string) {
+	for _, headers := range c.headers {
+		for name := range headers {
+			req.Header.Del(name)
+		}
+	}
+	req.Header.Del("Authorization")
+
+	if headers, ok := c.headers[req.URL.Host]; ok {
+		for name, values := range headers {
+			req.Header[name] = slices.Clone(values)
+		}
+	} else if headers, ok := c.headers[req.URL.Hostname()]; ok {
+		for name, values := range headers {
+			req.Header[name] = slices.Clone(values)
+		}
+	}
+
+	// Credentials set in the URL or as header take precedence over netrc
+	if req.URL.User != nil || req.Header.Get("Authorization") != "" {
+		return
+	}
+	entry, ok := c.machines[req.URL.Hostname()]
+	if !ok && req.URL.Hostname() == originHost {
+		entry, ok = c.machines[""]
+	}
+	if ok && entry.login != "" {
+		req.SetBasicAuth(entry.login, entry.password)
+	}
+}
+
+// Remove the password of an URL for logging
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Redacted()
+}
+
+// Default netrc file: $NETRC or ~/.netrc if it exists
+func DefaultNetrc() string {
+	if netrc := os.Getenv("NETRC"); netrc != "" {
+		return netrc
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	netrc := path.Join(home, ".netrc")
+	if _, err := os.Stat(netrc); err != nil {
+		return ""
+	}
+	return netrc
+}
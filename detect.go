@@ -0,0 +1,142 @@
+package debos
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var archiveMagics = []struct {
+	atype  ArchiveType
+	offset int
+	magic  []byte
+}{
+	{Zip, 0, []byte("PK\x03\x04")},
+	{Zip, 0, []byte("PK\x05\x06")}, // Empty archive
+	{Deb, 0, []byte("!<arch>\ndebian-binary")},
+	{Cpio, 0, []byte(cpioNewcMagic)},
+	{Cpio, 0, []byte(cpioCrcMagic)},
+	{Squashfs, 0, []byte("hsqs")},
+	{Tar, 257, []byte("ustar")},
+}
+
+// Check the checksum of a tar header block, for archives without ustar magic
+func isTarHeader(block []byte) bool {
+	if len(block) < 512 || block[0] == 0 {
+		return false
+	}
+	stored, err := strconv.ParseInt(strings.Trim(string(block[148:156]), " \x00"), 8, 64)
+	if err != nil {
+		return false
+	}
+	var sum int64
+	for i, b := range block[:512] {
+		if i >= 148 && i < 156 {
+			b = ' '
+		}
+		sum += int64(b)
+	}
+	return sum == stored
+}
+
+// Guess the archive type from the first bytes of an uncompressed stream
+func detectArchiveType(r *bufio.Reader) (ArchiveType, bool) {
+	head, _ := r.Peek(512)
+	for _, m := range archiveMagics {
+		if len(head) >= m.offset+len(m.magic) &&
+			bytes.Equal(head[m.offset:m.offset+len(m.magic)], m.magic) {
+			return m.atype, true
+		}
+	}
+	if isTarHeader(head) {
+		return Tar, true
+	}
+	return 0, false
+}
+
+/*
+DetectArchive guesses the archive type and the compression of file from
+its content. The returned compression is empty for uncompressed archives.
+If the content is inconclusive, e.g. for an empty tarball, the type is
+guessed from the file name.
+*/
+func DetectArchive(file string) (ArchiveType, string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	compression := detectCompression(br)
+	if compression == "" {
+		if atype, ok := detectArchiveType(br); ok {
+			return atype, "", nil
+		}
+		return archiveTypeFromName(file), "", nil
+	}
+
+	r, err := decompressReader(br, compression)
+	if errors.Is(err, errNotNative) {
+		// Can't look inside, only tarballs are expected to use such compressions
+		return Tar, compression, nil
+	}
+	if err != nil {
+		return 0, "", fmt.Errorf("'%s': %w", file, err)
+	}
+	defer r.Close()
+
+	// Only a few archive types are expected to be compressed as a whole
+	inner := bufio.NewReaderSize(io.LimitReader(r, 512), 512)
+	if atype, ok := detectArchiveType(inner); ok && (atype == Tar || atype == Cpio) {
+		return atype, compression, nil
+	}
+	if atype, ok := compressedTypeFromName(file); ok {
+		return atype, compression, nil
+	}
+
+	return 0, "", fmt.Errorf("'%s' is a %s compressed file but not a supported archive", file, compression)
+}
+
+// Type of a compressed archive named after it, e.g. data.tar.gz or initrd.cpio.zst
+func compressedTypeFromName(file string) (ArchiveType, bool) {
+	name := strings.ToLower(file)
+	inner := filepath.Ext(strings.TrimSuffix(name, filepath.Ext(name)))
+	switch {
+	case inner == ".tar", slices.Contains([]string{".tgz", ".tbz", ".tbz2", ".txz", ".tzst"}, filepath.Ext(name)):
+		return Tar, true
+	case inner == ".cpio":
+		return Cpio, true
+	}
+	return 0, false
+}
+
+// Guess the archive type from the file extension
+func archiveTypeFromName(file string) ArchiveType {
+	ext := strings.ToLower(filepath.Ext(file))
+	// Compressed cpio archives, e.g. initramfs.cpio.gz
+	if _, ok := cpioCompressions[ext]; ok && strings.ToLower(filepath.Ext(strings.TrimSuffix(file, filepath.Ext(file)))) == ".cpio" {
+		ext = ".cpio"
+	}
+
+	switch ext {
+	case ".deb":
+		return Deb
+	case ".zip":
+		return Zip
+	case ".cpio":
+		return Cpio
+	case ".squashfs", ".sqfs":
+		return Squashfs
+	default:
+		// Content is checked once the file exists
+		return Tar
+	}
+}
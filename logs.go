@@ -0,0 +1,213 @@
+package debos
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Log files written with --log-dir: the main log of the run, one log per
+action and, in a directory next to it, one log per command label of the
+action.
+*/
+var logFiles struct {
+	sync.Mutex
+	dir       string
+	main      *os.File
+	action    *os.File
+	actionDir string
+	commands  map[string]*os.File
+}
+
+// Turn an action description or a command label into a file name
+func logFileName(name string) string {
+	name = MaskSecrets(name)
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		default:
+			return '-'
+		}
+	}, strings.TrimSpace(name))
+	name = strings.Trim(name, "-.")
+	if name == "" {
+		return "unnamed"
+	}
+	return name
+}
+
+/*
+SetLogDir starts writing the log output to files in dir, the main log being
+written to the file called name.
+*/
+func SetLogDir(dir, name string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create log directory: %w", err)
+	}
+	main, err := os.Create(path.Join(dir, name))
+	if err != nil {
+		return err
+	}
+
+	logFiles.Lock()
+	defer logFiles.Unlock()
+	logFiles.dir = dir
+	logFiles.main = main
+	return nil
+}
+
+func closeActionLog() {
+	if logFiles.action != nil {
+		logFiles.action.Close()
+		logFiles.action = nil
+	}
+	for _, f := range logFiles.commands {
+		f.Close()
+	}
+	logFiles.commands = nil
+	logFiles.actionDir = ""
+}
+
+/*
+StartActionLog opens the log file of the action with the given position
+in the recipe, closing the one of the previous action. It is a no-op
+without log directory.
+*/
+func StartActionLog(index int, action Action) error {
+	logFiles.Lock()
+	defer logFiles.Unlock()
+	if logFiles.dir == "" {
+		return nil
+	}
+	closeActionLog()
+
+	name := fmt.Sprintf("%02d-%s", index+1, logFileName(action.String()))
+	f, err := os.Create(path.Join(logFiles.dir, name+".log"))
+	if err != nil {
+		return err
+	}
+	logFiles.action = f
+	logFiles.actionDir = path.Join(logFiles.dir, name)
+	logFiles.commands = map[string]*os.File{}
+	return nil
+}
+
+// StopActionLog closes the log files of the current action
+func StopActionLog() {
+	logFiles.Lock()
+	defer logFiles.Unlock()
+	closeActionLog()
+}
+
+// Write a line of command output to the log of the command label
+func writeCommandLog(label, line string) {
+	logFiles.Lock()
+	defer logFiles.Unlock()
+	if logFiles.actionDir == "" {
+		return
+	}
+
+	f, ok := logFiles.commands[label]
+	if !ok {
+		if err := os.MkdirAll(logFiles.actionDir, 0755); err != nil {
+			return
+		}
+		var err error
+		f, err = os.OpenFile(path.Join(logFiles.actionDir, logFileName(label)+".log"),
+			os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return
+		}
+		logFiles.commands[label] = f
+	}
+
+	line = strings.TrimSuffix(line, "\n")
+	fmt.Fprintf(f, "%s %s\n", time.Now().Format("2006/01/02 15:04:05"), MaskSecrets(line))
+}
+
+/*
+KeepLogs tells if the logs of the current action are written to the log
+directory, so tools that remove their log file once done have to keep it.
+*/
+func KeepLogs() bool {
+	logFiles.Lock()
+	defer logFiles.Unlock()
+	return logFiles.actionDir != ""
+}
+
+/*
+SaveLog copies the log file of a tool (e.g. debootstrap.log) to the log
+directory of the current action, if any, masking the secrets.
+*/
+func SaveLog(name, file string) {
+	logFiles.Lock()
+	dir := logFiles.actionDir
+	logFiles.Unlock()
+	if dir == "" {
+		return
+	}
+
+	in, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+	out, err := os.OpenFile(path.Join(dir, logFileName(name)), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return
+	}
+	defer out.Close()
+
+	// The masker expects complete lines
+	masker := NewSecretMasker(out)
+	r := bufio.NewReader(in)
+	for {
+		line, err := r.ReadString('\n')
+		if len(line) > 0 {
+			if _, err := io.WriteString(masker, line); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+type logTee struct {
+	w io.Writer
+}
+
+/*
+NewLogWriter returns a writer for the log output, also writing to the log
+files if a log directory is set.
+*/
+func NewLogWriter(w io.Writer) io.Writer {
+	return &logTee{w}
+}
+
+func (t *logTee) Write(p []byte) (int, error) {
+	logFiles.Lock()
+	for _, f := range []*os.File{logFiles.main, logFiles.action} {
+		if f != nil {
+			_, _ = f.Write(p)
+		}
+	}
+	logFiles.Unlock()
+
+	return t.w.Write(p)
+}
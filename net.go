@@ -1,49 +1,324 @@
 package debos
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
-// Function for downloading single file object with http(s) protocol
-func DownloadHTTPURL(url, filename string) error {
-	log.Printf("Download started: '%s' -> '%s'\n", url, filename)
+// Settings of the HTTP downloader, zero values select the defaults
+type DownloadConfig struct {
+	ConnectTimeout time.Duration     // Timeout for establishing the connection and getting the response headers
+	ReadTimeout    time.Duration     // Maximum time without receiving any data
+	Retries        int               // Number of retries after a failed attempt, negative for none
+	Backoff        time.Duration     // Delay before the first retry, doubled for each further retry
+	MaxBackoff     time.Duration     // Upper limit for the delay between retries
+	Credentials    *Credentials      // Per host credentials, none if nil
+	Certificates   []tls.Certificate // TLS client certificates
+}
+
+const (
+	defaultConnectTimeout = 30 * time.Second
+	defaultReadTimeout    = 60 * time.Second
+	defaultRetries        = 5
+	defaultBackoff        = time.Second
+	defaultMaxBackoff     = time.Minute
+)
+
+/*
+Downloader fetches files over http(s). Proxies are used as configured by
+the http_proxy, https_proxy and no_proxy environment variables (and their
+upper case variants).
+*/
+type Downloader struct {
+	DownloadConfig
+	client *http.Client
+}
+
+func NewDownloader(config DownloadConfig) *Downloader {
+	if config.ConnectTimeout == 0 {
+		config.ConnectTimeout = defaultConnectTimeout
+	}
+	if config.ReadTimeout == 0 {
+		config.ReadTimeout = defaultReadTimeout
+	}
+	if config.Retries < 0 {
+		config.Retries = 0
+	} else if config.Retries == 0 {
+		config.Retries = defaultRetries
+	}
+	if config.Backoff == 0 {
+		config.Backoff = defaultBackoff
+	}
+	if config.MaxBackoff == 0 {
+		config.MaxBackoff = defaultMaxBackoff
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   config.ConnectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       &tls.Config{Certificates: config.Certificates},
+		TLSHandshakeTimeout:   config.ConnectTimeout,
+		ResponseHeaderTimeout: config.ConnectTimeout,
+		ForceAttemptHTTP2:     true,
+	}
+
+	client := &http.Client{Transport: transport}
+	if config.Credentials != nil {
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			// Don't leak the credentials to other hosts
+			config.Credentials.apply(req, via[0].URL.Hostname())
+			return nil
+		}
+	}
+
+	return &Downloader{
+		DownloadConfig: config,
+		client:         client,
+	}
+}
 
-	// TODO: Proxy support?
+// Error which is not worth retrying, e.g. a 404 status
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+/*
+idleReader cancels the request if no data has been received for the
+read timeout.
+*/
+type idleReader struct {
+	r       io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (i *idleReader) Read(p []byte) (int, error) {
+	n, err := i.r.Read(p)
+	i.timer.Reset(i.timeout)
+	return n, err
+}
+
+/*
+Download fetches url to filename. Data is written to a temporary file next
+to filename which is renamed once complete, so an interrupted download
+never looks complete. Failed attempts are retried with an exponential
+backoff, resuming the transfer with a Range request if the server allows.
+*/
+func (d *Downloader) Download(url, filename string) error {
+	log.Printf("Download started: '%s' -> '%s'\n", redactURL(url), filename)
 
 	// Check if file object already exists.
 	fi, err := os.Stat(filename)
 	if err == nil {
 		if !fi.Mode().IsRegular() {
-			return fmt.Errorf("failed to download '%s': '%s' exists and it is not a regular file", url, filename)
+			return fmt.Errorf("failed to download '%s': '%s' exists and it is not a regular file", redactURL(url), filename)
 		}
 	} else if !os.IsNotExist(err) {
 		return fmt.Errorf("failed to stat '%s': %w", filename, err)
 	}
 
-	resp, err := http.Get(url)
-	if err != nil {
+	partial := filename + ".part"
+	// A leftover from another run may come from a different version of the file
+	if err := os.Remove(partial); err != nil && !os.IsNotExist(err) {
 		return err
 	}
+
+	var validator string
+	delay := d.Backoff
+	for attempt := 0; ; attempt++ {
+		validator, err = d.fetch(url, partial, validator)
+		if err == nil {
+			break
+		}
+
+		var permanent *permanentError
+		if errors.As(err, &permanent) || attempt >= d.Retries {
+			os.Remove(partial)
+			return err
+		}
+
+		log.Printf("Download of '%s' failed: %v; retrying in %v\n", redactURL(url), err, delay)
+		time.Sleep(delay)
+		delay = min(delay*2, d.MaxBackoff)
+	}
+
+	return os.Rename(partial, filename)
+}
+
+/*
+fetch runs a single download attempt, appending to the partial file if
+the previous attempt returned the validator (ETag or Last-Modified) to
+resume from. It returns the validator of the response.
+*/
+func (d *Downloader) fetch(url, partial, validator string) (string, error) {
+	var offset int64
+	if fi, err := os.Stat(partial); err == nil && len(validator) > 0 {
+		offset = fi.Size()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", &permanentError{err}
+	}
+	if d.Credentials != nil {
+		d.Credentials.apply(req, req.URL.Hostname())
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", validator)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return "", err
+	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("url '%s' returned status code %d (%s)", url, resp.StatusCode, http.StatusText(resp.StatusCode))
+	flags := os.O_WRONLY | os.O_CREATE
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		if start := contentRangeStart(resp.Header.Get("Content-Range")); start != offset {
+			return "", fmt.Errorf("url '%s' returned an unexpected range '%s'", redactURL(url), resp.Header.Get("Content-Range"))
+		}
+		log.Printf("Resuming download of '%s' at %d bytes\n", redactURL(url), offset)
+		flags |= os.O_APPEND
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// The partial file may already hold the whole content, start over
+		log.Printf("Can't resume download of '%s' at %d bytes, restarting\n", redactURL(url), offset)
+		resp.Body.Close()
+		if err := os.Remove(partial); err != nil {
+			return "", &permanentError{err}
+		}
+		return d.fetch(url, partial, "")
+	case resp.StatusCode == http.StatusOK:
+		// Full content, also if the file changed since the previous attempt
+		flags |= os.O_TRUNC
+	default:
+		err := fmt.Errorf("url '%s' returned status code %d (%s)", redactURL(url), resp.StatusCode, http.StatusText(resp.StatusCode))
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests ||
+			resp.StatusCode == http.StatusRequestTimeout {
+			return "", err
+		}
+		return "", &permanentError{err}
 	}
 
-	// Output file
-	output, err := os.Create(filename)
+	// Weak ETags can't be used for range requests
+	validator = resp.Header.Get("ETag")
+	if strings.HasPrefix(validator, "W/") {
+		validator = ""
+	}
+	if len(validator) == 0 {
+		validator = resp.Header.Get("Last-Modified")
+	}
+	if resp.Header.Get("Accept-Ranges") == "none" {
+		validator = ""
+	}
+
+	output, err := os.OpenFile(partial, flags, 0644)
 	if err != nil {
-		return err
+		return "", &permanentError{err}
 	}
 	defer output.Close()
 
-	if _, err := io.Copy(output, resp.Body); err != nil {
-		return err
+	timer := time.AfterFunc(d.ReadTimeout, cancel)
+	defer timer.Stop()
+	body := &idleReader{r: resp.Body, timer: timer, timeout: d.ReadTimeout}
+
+	if _, err := io.Copy(output, body); err != nil {
+		if ctx.Err() != nil {
+			err = fmt.Errorf("no data received for %v", d.ReadTimeout)
+		}
+		return validator, err
+	}
+
+	if err := output.Close(); err != nil {
+		return "", &permanentError{err}
+	}
+
+	return validator, nil
+}
+
+// Parse the first byte position of a 'bytes start-end/size' header
+func contentRangeStart(contentRange string) int64 {
+	spec, ok := strings.CutPrefix(contentRange, "bytes ")
+	if !ok {
+		return -1
+	}
+	start, _, _ := strings.Cut(spec, "-")
+	v, err := strconv.ParseInt(start, 10, 64)
+	if err != nil {
+		return -1
 	}
+	return v
+}
+
+// Function for downloading single file object with http(s) protocol
+func DownloadHTTPURL(url, filename string) error {
+	return NewDownloader(DownloadConfig{}).Download(url, filename)
+}
+
+// URLRewrite replaces the From prefix of URLs by To, e.g. to use a local mirror
+type URLRewrite struct {
+	From string
+	To   string
+}
 
-	return nil
+// ParseURLRewrite parses a 'from=to' rewrite rule
+func ParseURLRewrite(rule string) (URLRewrite, error) {
+	from, to, ok := strings.Cut(rule, "=")
+	if !ok || len(from) == 0 || len(to) == 0 {
+		return URLRewrite{}, fmt.Errorf("incorrect URL rewrite rule '%s', expected 'from=to'", rule)
+	}
+	return URLRewrite{From: from, To: to}, nil
+}
+
+/*
+RewriteURL applies the rewrite rule with the longest matching prefix to
+url, which is returned unchanged if no rule matches.
+*/
+func (c *CommonContext) RewriteURL(url string) string {
+	var match *URLRewrite
+	for i, r := range c.URLRewrites {
+		if strings.HasPrefix(url, r.From) && (match == nil || len(r.From) > len(match.From)) {
+			match = &c.URLRewrites[i]
+		}
+	}
+	if match == nil {
+		return url
+	}
+
+	rewritten := match.To + strings.TrimPrefix(url, match.From)
+	log.Printf("Rewriting URL '%s' to '%s'\n", url, rewritten)
+	return rewritten
+}
+
+// RewriteURLsIn rewrites the URLs in a space separated list, e.g. a sources.list entry
+func (c *CommonContext) RewriteURLsIn(line string) string {
+	fields := strings.Fields(line)
+	for i, f := range fields {
+		fields[i] = c.RewriteURL(f)
+	}
+	return strings.Join(fields, " ")
 }
@@ -0,0 +1,195 @@
+package debos_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloaderResume(t *testing.T) {
+	content := strings.Repeat("debos", 1000)
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("ETag", `"v1"`)
+		switch requests {
+		case 1:
+			// Server error before sending anything
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			// Connection drops in the middle of the transfer
+			w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+			_, _ = w.Write([]byte(content[:1000]))
+			w.(http.Flusher).Flush()
+			hj, _ := w.(http.Hijacker)
+			conn, _, _ := hj.Hijack()
+			conn.Close()
+		default:
+			assert.Equal(t, "bytes=1000-", r.Header.Get("Range"))
+			assert.Equal(t, `"v1"`, r.Header.Get("If-Range"))
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 1000-%d/%d", len(content)-1, len(content)))
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write([]byte(content[1000:]))
+		}
+	}))
+	defer ts.Close()
+
+	filename := path.Join(t.TempDir(), "file")
+	downloader := debos.NewDownloader(debos.DownloadConfig{Backoff: time.Millisecond})
+	assert.NoError(t, downloader.Download(ts.URL, filename))
+	assert.Equal(t, 3, requests)
+
+	data, err := os.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, content, string(data))
+	assert.NoFileExists(t, filename+".part")
+}
+
+func TestDownloaderResumeComplete(t *testing.T) {
+	content := strings.Repeat("debos", 1000)
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("ETag", `"v1"`)
+		switch requests {
+		case 1:
+			// The whole content is received but the transfer isn't completed
+			w.Header().Set("Content-Length", fmt.Sprint(len(content)+1))
+			_, _ = w.Write([]byte(content))
+			w.(http.Flusher).Flush()
+			hj, _ := w.(http.Hijacker)
+			conn, _, _ := hj.Hijack()
+			conn.Close()
+		case 2:
+			assert.Equal(t, fmt.Sprintf("bytes=%d-", len(content)), r.Header.Get("Range"))
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", len(content)))
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		default:
+			assert.Empty(t, r.Header.Get("Range"))
+			_, _ = w.Write([]byte(content))
+		}
+	}))
+	defer ts.Close()
+
+	filename := path.Join(t.TempDir(), "file")
+	downloader := debos.NewDownloader(debos.DownloadConfig{Backoff: time.Millisecond})
+	assert.NoError(t, downloader.Download(ts.URL, filename))
+	assert.Equal(t, 3, requests)
+
+	data, err := os.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, content, string(data))
+	assert.NoFileExists(t, filename+".part")
+}
+
+func TestDownloaderErrors(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path == "/slow" {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			time.Sleep(200 * time.Millisecond)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	filename := path.Join(t.TempDir(), "file")
+
+	// Client errors are not retried
+	downloader := debos.NewDownloader(debos.DownloadConfig{Backoff: time.Millisecond})
+	err := downloader.Download(ts.URL+"/missing", filename)
+	assert.EqualError(t, err, fmt.Sprintf("url '%s/missing' returned status code 404 (Not Found)", ts.URL))
+	assert.Equal(t, 1, requests)
+	assert.NoFileExists(t, filename)
+
+	// Stalled transfers are aborted
+	downloader = debos.NewDownloader(debos.DownloadConfig{Retries: -1, ReadTimeout: 50 * time.Millisecond})
+	err = downloader.Download(ts.URL+"/slow", filename)
+	assert.EqualError(t, err, "no data received for 50ms")
+	assert.NoFileExists(t, filename)
+	assert.NoFileExists(t, filename+".part")
+}
+
+func TestRewriteURL(t *testing.T) {
+	_, err := debos.ParseURLRewrite("http://deb.debian.org/")
+	assert.EqualError(t, err, "incorrect URL rewrite rule 'http://deb.debian.org/', expected 'from=to'")
+
+	rule, err := debos.ParseURLRewrite("http://deb.debian.org/=http://mirror.lab/?a=b")
+	assert.NoError(t, err)
+	assert.Equal(t, debos.URLRewrite{From: "http://deb.debian.org/", To: "http://mirror.lab/?a=b"}, rule)
+
+	c := &debos.CommonContext{URLRewrites: []debos.URLRewrite{
+		{From: "http://deb.debian.org/", To: "http://mirror.lab/"},
+		{From: "http://deb.debian.org/debian-security", To: "http://security.lab/debian"},
+	}}
+	assert.Equal(t, "http://mirror.lab/debian", c.RewriteURL("http://deb.debian.org/debian"))
+	assert.Equal(t, "http://security.lab/debian/pool", c.RewriteURL("http://deb.debian.org/debian-security/pool"))
+	assert.Equal(t, "https://example.org/", c.RewriteURL("https://example.org/"))
+	assert.Equal(t, "deb [trusted=yes] http://mirror.lab/debian trixie main",
+		c.RewriteURLsIn("deb  [trusted=yes] http://deb.debian.org/debian trixie main"))
+}
+
+func TestDownloaderCredentials(t *testing.T) {
+	// Requests redirected to this server must not carry the credentials
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" || r.Header.Get("Private-Token") != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte("public"))
+	}))
+	defer other.Close()
+
+	var auth []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = append(auth, r.Header.Get("Authorization")+"|"+r.Header.Get("Private-Token"))
+		if r.URL.Path == "/redirect" {
+			// Different host name, netrc entries don't depend on the port
+			http.Redirect(w, r, strings.Replace(other.URL, "127.0.0.1", "localhost", 1)+"/file", http.StatusFound)
+			return
+		}
+		_, _ = w.Write([]byte("private"))
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	host := strings.TrimPrefix(ts.URL, "http://")
+	netrc := path.Join(dir, "netrc")
+	assert.NoError(t, os.WriteFile(netrc, []byte("machine 127.0.0.1\n  login user\n  password secret\n"), 0600))
+	headers := path.Join(dir, "credentials")
+	assert.NoError(t, os.WriteFile(headers, []byte("# comment\n"+host+" Private-Token: ${DEBOS_TEST_TOKEN}\n"), 0600))
+
+	_, err := debos.LoadCredentials(netrc, headers)
+	assert.EqualError(t, err, "failed to read credentials file "+headers+": line 2: environment variable 'DEBOS_TEST_TOKEN' is not set")
+
+	t.Setenv("DEBOS_TEST_TOKEN", "token")
+	credentials, err := debos.LoadCredentials(netrc, headers)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"DEBOS_TEST_TOKEN=token"}, credentials.Environ())
+	assert.ElementsMatch(t, []string{"secret", "token"}, credentials.Secrets())
+
+	downloader := debos.NewDownloader(debos.DownloadConfig{Retries: -1, Credentials: credentials})
+	assert.NoError(t, downloader.Download(ts.URL+"/file", path.Join(dir, "private")))
+	assert.NoError(t, downloader.Download(ts.URL+"/redirect", path.Join(dir, "public")))
+	assert.Equal(t, []string{"Basic dXNlcjpzZWNyZXQ=|token", "Basic dXNlcjpzZWNyZXQ=|token"}, auth)
+
+	// The default entry isn't sent to the host of a redirect either
+	assert.NoError(t, os.WriteFile(netrc, []byte("default\n  login user\n  password secret\n"), 0600))
+	credentials, err = debos.LoadCredentials(netrc, "")
+	assert.NoError(t, err)
+	downloader = debos.NewDownloader(debos.DownloadConfig{Retries: -1, Credentials: credentials})
+	auth = nil
+	assert.NoError(t, downloader.Download(ts.URL+"/redirect", path.Join(dir, "public-default")))
+	assert.Equal(t, []string{"Basic dXNlcjpzZWNyZXQ=|"}, auth)
+}
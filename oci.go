@@ -0,0 +1,293 @@
+package debos
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	ociRefAnnotation = "org.opencontainers.image.ref.name"
+	ociWhiteout      = ".wh."
+	ociOpaque        = ".wh..wh..opq"
+)
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations"`
+	Platform    *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+		Variant      string `json:"variant"`
+	} `json:"platform"`
+}
+
+// Image index, manifest list or image manifest, depending on the media type
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Manifests []ociDescriptor `json:"manifests"`
+	Layers    []ociDescriptor `json:"layers"`
+}
+
+// Map Debian architectures to the OCI platform architecture and variant
+var ociArchitectures = map[string][2]string{
+	"amd64":    {"amd64", ""},
+	"arm64":    {"arm64", ""},
+	"armhf":    {"arm", "v7"},
+	"armel":    {"arm", "v5"},
+	"i386":     {"386", ""},
+	"mips64el": {"mips64le", ""},
+	"ppc64el":  {"ppc64le", ""},
+	"riscv64":  {"riscv64", ""},
+	"s390x":    {"s390x", ""},
+}
+
+/*
+ParseOCILayoutRef splits 'path:tag' into the layout directory and the tag,
+the tag is empty if omitted.
+*/
+func ParseOCILayoutRef(ref string) (string, string) {
+	i := strings.LastIndex(ref, ":")
+	if i < 0 || strings.Contains(ref[i:], "/") {
+		return ref, ""
+	}
+	return ref[:i], ref[i+1:]
+}
+
+type ociLayout struct {
+	dir string
+}
+
+func (l *ociLayout) blobPath(digest string) (string, error) {
+	alg, encoded, ok := strings.Cut(digest, ":")
+	if !ok || alg != "sha256" || len(encoded) != 64 {
+		return "", fmt.Errorf("unsupported digest '%s'", digest)
+	}
+	if _, err := hex.DecodeString(encoded); err != nil {
+		return "", fmt.Errorf("unsupported digest '%s'", digest)
+	}
+	return path.Join(l.dir, "blobs", alg, encoded), nil
+}
+
+// Check the digest while reading a blob
+type digestReader struct {
+	r      io.Reader
+	hasher hash.Hash
+	digest string
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.hasher.Write(p[:n])
+	if errors.Is(err, io.EOF) && "sha256:"+hex.EncodeToString(d.hasher.Sum(nil)) != d.digest {
+		return n, fmt.Errorf("digest mismatch for blob %s", d.digest)
+	}
+	return n, err
+}
+
+func (l *ociLayout) openBlob(digest string) (io.ReadCloser, error) {
+	p, err := l.blobPath(digest)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{&digestReader{f, sha256.New(), digest}, f}, nil
+}
+
+func (l *ociLayout) readManifest(digest string) (*ociManifest, error) {
+	var r io.ReadCloser
+	var err error
+	if digest == "" {
+		r, err = os.Open(path.Join(l.dir, "index.json"))
+	} else {
+		r, err = l.openBlob(digest)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	m := &ociManifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %s: %w", digest, err)
+	}
+	return m, nil
+}
+
+// Find the image manifest for the tag and the architecture
+func (l *ociLayout) resolve(tag, architecture string) (*ociManifest, error) {
+	index, err := l.readManifest("")
+	if err != nil {
+		return nil, err
+	}
+
+	var selected *ociDescriptor
+	for i, d := range index.Manifests {
+		name := d.Annotations[ociRefAnnotation]
+		if tag == "" || name == tag || strings.HasSuffix(name, ":"+tag) {
+			if selected != nil {
+				return nil, fmt.Errorf("several images match '%s' in OCI layout %s", tag, l.dir)
+			}
+			selected = &index.Manifests[i]
+		}
+	}
+	if selected == nil {
+		return nil, fmt.Errorf("no image '%s' in OCI layout %s", tag, l.dir)
+	}
+
+	for depth := 0; depth < 8; depth++ {
+		m, err := l.readManifest(selected.Digest)
+		if err != nil {
+			return nil, err
+		}
+		if len(m.Manifests) == 0 {
+			return m, nil
+		}
+
+		// Multi-platform image
+		platform, ok := ociArchitectures[architecture]
+		if !ok {
+			return nil, fmt.Errorf("unsupported architecture '%s' for OCI images", architecture)
+		}
+		selected = nil
+		for i, d := range m.Manifests {
+			p := d.Platform
+			if p != nil && p.OS == "linux" && p.Architecture == platform[0] &&
+				(p.Variant == "" || platform[1] == "" || p.Variant == platform[1]) {
+				selected = &m.Manifests[i]
+				break
+			}
+		}
+		if selected == nil {
+			return nil, fmt.Errorf("no image for architecture '%s' in OCI layout %s", architecture, l.dir)
+		}
+	}
+
+	return nil, fmt.Errorf("too many nested image indexes in OCI layout %s", l.dir)
+}
+
+/*
+extractLayer applies an image layer on top of the destination, handling
+the whiteout files removing content of the lower layers.
+*/
+func (e *extractor) extractLayer(r io.Reader) error {
+	layer := map[string]bool{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		name, err := cleanEntryName(hdr.Name)
+		if err != nil {
+			return err
+		}
+		dir, base := path.Split(name)
+
+		switch {
+		case base == ociOpaque:
+			// Only the content of this layer is kept
+			target, err := resolveInRoot(e.destination, name)
+			if err != nil {
+				return err
+			}
+			entries, err := os.ReadDir(path.Dir(target))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			for _, entry := range entries {
+				if !layer[path.Join(dir, entry.Name())] {
+					if err := os.RemoveAll(path.Join(path.Dir(target), entry.Name())); err != nil {
+						return err
+					}
+				}
+			}
+		case strings.HasPrefix(base, ociWhiteout):
+			target, err := resolveInRoot(e.destination, path.Join(dir, strings.TrimPrefix(base, ociWhiteout)))
+			if err != nil {
+				return err
+			}
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		default:
+			layer[name] = true
+			if err := e.extractTarEntry(hdr, tr); err != nil {
+				return err
+			}
+		}
+	}
+
+	return e.finish()
+}
+
+/*
+UnpackOCILayout extracts the flattened root filesystem of an image stored
+in an OCI image layout directory. The image is selected by its tag (the
+only image of the layout if empty) and, for multi-platform images, by the
+Debian architecture.
+*/
+func UnpackOCILayout(layoutDir, tag, architecture, destination string) error {
+	layout := &ociLayout{dir: layoutDir}
+	manifest, err := layout.resolve(tag, architecture)
+	if err != nil {
+		return err
+	}
+
+	e, err := newExtractor(destination, false)
+	if err != nil {
+		return err
+	}
+
+	for _, l := range manifest.Layers {
+		if err := layout.extractBlob(e, l.Digest); err != nil {
+			return fmt.Errorf("failed to extract layer %s: %w", l.Digest, err)
+		}
+	}
+	return nil
+}
+
+func (l *ociLayout) extractBlob(e *extractor, digest string) error {
+	blob, err := l.openBlob(digest)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	r, err := decompressReader(blob, "")
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if err := e.extractLayer(r); err != nil {
+		return err
+	}
+
+	// Read the padding to check the digest
+	_, err = io.Copy(io.Discard, blob)
+	return err
+}
@@ -0,0 +1,106 @@
+package debos_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+// Store a blob in the OCI layout, returning its digest
+func writeBlob(t *testing.T, layout string, data []byte) string {
+	sum := sha256.Sum256(data)
+	encoded := hex.EncodeToString(sum[:])
+	assert.NoError(t, os.MkdirAll(path.Join(layout, "blobs/sha256"), 0755))
+	assert.NoError(t, os.WriteFile(path.Join(layout, "blobs/sha256", encoded), data, 0644))
+	return "sha256:" + encoded
+}
+
+func writeLayer(t *testing.T, layout string, entries []testEntry) string {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		assert.NoError(t, tw.WriteHeader(&tar.Header{
+			Name: e.name, Typeflag: e.typeflag, Mode: e.mode, Size: int64(len(e.body)),
+		}))
+		_, err := tw.Write([]byte(e.body))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, tw.Close())
+	return writeBlob(t, layout, buf.Bytes())
+}
+
+func writeJSON(t *testing.T, v interface{}) []byte {
+	data, err := json.Marshal(v)
+	assert.NoError(t, err)
+	return data
+}
+
+func TestUnpackOCILayout(t *testing.T) {
+	dir := t.TempDir()
+	layout := path.Join(dir, "layout")
+
+	base := writeLayer(t, layout, []testEntry{
+		{"etc/", tar.TypeDir, 0755, "", ""},
+		{"etc/hostname", tar.TypeReg, 0644, "base", ""},
+		{"etc/motd", tar.TypeReg, 0644, "welcome", ""},
+		{"var/cache/", tar.TypeDir, 0755, "", ""},
+		{"var/cache/old", tar.TypeReg, 0644, "old", ""},
+	})
+	top := writeLayer(t, layout, []testEntry{
+		{"etc/.wh.motd", tar.TypeReg, 0644, "", ""},
+		{"etc/hostname", tar.TypeReg, 0644, "top", ""},
+		{"var/cache/new", tar.TypeReg, 0644, "new", ""},
+		{"var/cache/.wh..wh..opq", tar.TypeReg, 0644, "", ""},
+	})
+	manifest := writeBlob(t, layout, writeJSON(t, map[string]interface{}{
+		"mediaType": "application/vnd.oci.image.manifest.v1+json",
+		"layers":    []map[string]string{{"digest": base}, {"digest": top}},
+	}))
+	other := writeBlob(t, layout, writeJSON(t, map[string]interface{}{
+		"layers": []map[string]string{},
+	}))
+	platforms := writeBlob(t, layout, writeJSON(t, map[string]interface{}{
+		"mediaType": "application/vnd.oci.image.index.v1+json",
+		"manifests": []map[string]interface{}{
+			{"digest": other, "platform": map[string]string{"os": "linux", "architecture": "amd64"}},
+			{"digest": manifest, "platform": map[string]string{"os": "linux", "architecture": "arm", "variant": "v7"}},
+		},
+	}))
+	assert.NoError(t, os.WriteFile(path.Join(layout, "index.json"), writeJSON(t, map[string]interface{}{
+		"manifests": []map[string]interface{}{
+			{"digest": platforms, "annotations": map[string]string{"org.opencontainers.image.ref.name": "stable"}},
+		},
+	}), 0644))
+
+	layoutDir, tag := debos.ParseOCILayoutRef(layout + ":stable")
+	assert.Equal(t, layout, layoutDir)
+	assert.Equal(t, "stable", tag)
+
+	dest := path.Join(dir, "rootfs")
+	assert.NoError(t, debos.UnpackOCILayout(layoutDir, tag, "armhf", dest))
+
+	data, err := os.ReadFile(path.Join(dest, "etc/hostname"))
+	assert.NoError(t, err)
+	assert.Equal(t, "top", string(data))
+	assert.NoFileExists(t, path.Join(dest, "etc/motd"))
+	assert.NoFileExists(t, path.Join(dest, "var/cache/old"))
+	assert.FileExists(t, path.Join(dest, "var/cache/new"))
+
+	assert.EqualError(t, debos.UnpackOCILayout(layout, "testing", "armhf", dest),
+		"no image 'testing' in OCI layout "+layout)
+	assert.EqualError(t, debos.UnpackOCILayout(layout, "", "arm64", dest),
+		"no image for architecture 'arm64' in OCI layout "+layout)
+
+	// Corrupted layer
+	encoded := top[len("sha256:"):]
+	assert.NoError(t, os.WriteFile(path.Join(layout, "blobs/sha256", encoded), []byte("corrupted"), 0644))
+	assert.Error(t, debos.UnpackOCILayout(layout, "stable", "armhf", path.Join(dir, "other")))
+}
@@ -1,6 +1,7 @@
 package debos
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"path"
@@ -8,18 +9,72 @@ import (
 
 const debianPolicyHelper = "/usr/sbin/policy-rc.d"
 
-/*
-ServiceHelper is used to manage services.
-Currently supports only debian-based family.
-*/
+type ServicesMethod int
 
-type ServiceHelper struct {
-	Rootdir string
+// Strategies to prevent maintainer scripts from starting services in the chroot
+const (
+	ServicesMethodAuto            ServicesMethod = iota // Detect suitable strategies from the rootfs contents
+	ServicesMethodNone                                  // Do not prevent services from starting
+	ServicesMethodPolicyRcd                             // Debian /usr/sbin/policy-rc.d helper
+	ServicesMethodSystemdOffline                        // Set SYSTEMD_OFFLINE=1 in the environment
+	ServicesMethodSystemctl                             // Divert systemctl to a wrapper ignoring start/stop requests
+	ServicesMethodStartStopDaemon                       // Divert start-stop-daemon to a no-op
+)
+
+var servicesMethods = map[string]ServicesMethod{
+	"":                  ServicesMethodAuto,
+	"auto":              ServicesMethodAuto,
+	"none":              ServicesMethodNone,
+	"policy-rc.d":       ServicesMethodPolicyRcd,
+	"systemd-offline":   ServicesMethodSystemdOffline,
+	"systemctl":         ServicesMethodSystemctl,
+	"start-stop-daemon": ServicesMethodStartStopDaemon,
+}
+
+// ParseServicesMethod maps the recipe 'services' property to a ServicesMethod
+func ParseServicesMethod(name string) (ServicesMethod, error) {
+	method, ok := servicesMethods[name]
+	if !ok {
+		return ServicesMethodAuto, fmt.Errorf("unsupported services method '%s'", name)
+	}
+	return method, nil
 }
 
 type ServicesManager interface {
 	Allow() error
 	Deny() error
+	// Environ returns extra environment variables to set for the command
+	Environ() []string
+}
+
+/*
+NewServicesManager returns the services manager implementing method for
+the rootfs at rootdir.
+*/
+func NewServicesManager(method ServicesMethod, rootdir string) ServicesManager {
+	switch method {
+	case ServicesMethodNone:
+		return &servicesGroup{}
+	case ServicesMethodPolicyRcd:
+		return &ServiceHelper{rootdir}
+	case ServicesMethodSystemdOffline:
+		return &SystemdOfflineHelper{}
+	case ServicesMethodSystemctl:
+		return NewSystemctlDiversion(rootdir)
+	case ServicesMethodStartStopDaemon:
+		return NewStartStopDaemonDiversion(rootdir)
+	default:
+		return &AutoServicesHelper{Rootdir: rootdir}
+	}
+}
+
+/*
+ServiceHelper is used to manage services.
+Supports debian-based family via the policy-rc.d helper.
+*/
+
+type ServiceHelper struct {
+	Rootdir string
 }
 
 /*
@@ -69,3 +124,216 @@ exit 101
 
 	return nil
 }
+
+func (s *ServiceHelper) Environ() []string { return nil }
+
+/*
+SystemdOfflineHelper asks systemctl to operate in offline mode, so
+units may be enabled or disabled but never started or stopped.
+*/
+type SystemdOfflineHelper struct{}
+
+func (s *SystemdOfflineHelper) Allow() error { return nil }
+func (s *SystemdOfflineHelper) Deny() error  { return nil }
+func (s *SystemdOfflineHelper) Environ() []string {
+	return []string{"SYSTEMD_OFFLINE=1"}
+}
+
+/*
+DiversionHelper temporarily replaces binaries in the rootfs by a wrapper
+script. The original binary is moved aside and restored by Allow(), unless
+it has been replaced (e.g. by a package upgrade) while diverted.
+*/
+type DiversionHelper struct {
+	Rootdir  string
+	Binaries []string // Absolute paths inside the rootfs, the first existing one is diverted
+	Wrapper  string   // Wrapper script; %[1]s is replaced by the path of the original binary
+	diverted string
+}
+
+const systemctlWrapper = `#!/bin/sh
+# Automatically generated by Debos
+for arg; do
+	case "$arg" in
+	-*) ;;
+	start|stop|restart|reload|try-restart|reload-or-restart|try-reload-or-restart|condrestart|force-reload|kill|isolate)
+		echo "Warning: not running 'systemctl $*' during the build" >&2
+		exit 0
+		;;
+	*) break ;;
+	esac
+done
+exec %[1]s "$@"
+`
+
+const startStopDaemonWrapper = `#!/bin/sh
+# Automatically generated by Debos
+echo "Warning: fake start-stop-daemon called, doing nothing" >&2
+exit 0
+`
+
+func NewSystemctlDiversion(rootdir string) *DiversionHelper {
+	return &DiversionHelper{
+		Rootdir:  rootdir,
+		Binaries: []string{"/usr/bin/systemctl", "/bin/systemctl"},
+		Wrapper:  systemctlWrapper,
+	}
+}
+
+func NewStartStopDaemonDiversion(rootdir string) *DiversionHelper {
+	return &DiversionHelper{
+		Rootdir:  rootdir,
+		Binaries: []string{"/usr/sbin/start-stop-daemon", "/sbin/start-stop-daemon"},
+		Wrapper:  startStopDaemonWrapper,
+	}
+}
+
+// Find the first regular file out of the binaries inside the rootfs
+func (d *DiversionHelper) find() string {
+	for _, b := range d.Binaries {
+		fi, err := os.Lstat(path.Join(d.Rootdir, b))
+		if err == nil && fi.Mode().IsRegular() {
+			return b
+		}
+	}
+	return ""
+}
+
+func (d *DiversionHelper) wrapper() []byte {
+	if d.diverted == "" {
+		return nil
+	}
+	return []byte(fmt.Sprintf(d.Wrapper, d.diverted+".debos"))
+}
+
+/*
+Deny() replaces the binary by the wrapper.
+*/
+func (d *DiversionHelper) Deny() error {
+	binary := d.find()
+	if binary == "" {
+		// Nothing to divert in this rootfs
+		return nil
+	}
+
+	original := path.Join(d.Rootdir, binary)
+	saved := original + ".debos"
+	if _, err := os.Lstat(saved); err == nil {
+		return fmt.Errorf("diverted file '%s' exists already", binary+".debos")
+	}
+	if err := os.Rename(original, saved); err != nil {
+		return err
+	}
+
+	d.diverted = binary
+	if err := os.WriteFile(original, d.wrapper(), 0755); err != nil {
+		_ = os.Rename(saved, original)
+		d.diverted = ""
+		return err
+	}
+
+	return nil
+}
+
+/*
+Allow() restores the original binary.
+*/
+func (d *DiversionHelper) Allow() error {
+	if d.diverted == "" {
+		return nil
+	}
+
+	original := path.Join(d.Rootdir, d.diverted)
+	saved := original + ".debos"
+	wrapper := d.wrapper()
+	d.diverted = ""
+
+	data, err := os.ReadFile(original)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err == nil && !bytes.Equal(data, wrapper) {
+		// The binary was replaced while diverted, keep the new version
+		return os.Remove(saved)
+	}
+
+	return os.Rename(saved, original)
+}
+
+func (d *DiversionHelper) Environ() []string { return nil }
+
+// servicesGroup combines several strategies
+type servicesGroup struct {
+	managers []ServicesManager
+	denied   int
+}
+
+func (g *servicesGroup) Deny() error {
+	for _, m := range g.managers {
+		if err := m.Deny(); err != nil {
+			// Roll back the strategies already applied
+			_ = g.Allow()
+			return err
+		}
+		g.denied++
+	}
+	return nil
+}
+
+func (g *servicesGroup) Allow() error {
+	var firstErr error
+	for ; g.denied > 0; g.denied-- {
+		if err := g.managers[g.denied-1].Allow(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (g *servicesGroup) Environ() []string {
+	var env []string
+	for _, m := range g.managers {
+		env = append(env, m.Environ()...)
+	}
+	return env
+}
+
+/*
+AutoServicesHelper selects the strategies depending on the rootfs contents:
+the policy-rc.d helper is always installed, which is enough for Debian
+rootfs. For rootfs without invoke-rc.d (e.g. non-Debian or systemd-only),
+systemctl is run in offline mode if present, and systemctl and
+start-stop-daemon get diverted.
+*/
+type AutoServicesHelper struct {
+	Rootdir string
+	servicesGroup
+}
+
+func (a *AutoServicesHelper) exists(files ...string) bool {
+	for _, f := range files {
+		if _, err := os.Stat(path.Join(a.Rootdir, f)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *AutoServicesHelper) Deny() error {
+	a.managers = []ServicesManager{&ServiceHelper{a.Rootdir}}
+
+	// Debian rootfs honour policy-rc.d, keep their behaviour unchanged
+	if a.exists("/usr/sbin/invoke-rc.d", "/sbin/invoke-rc.d") {
+		return a.servicesGroup.Deny()
+	}
+
+	if a.exists("/usr/bin/systemctl", "/bin/systemctl") {
+		a.managers = append(a.managers, &SystemdOfflineHelper{})
+	}
+	a.managers = append(a.managers,
+		NewSystemctlDiversion(a.Rootdir),
+		NewStartStopDaemonDiversion(a.Rootdir))
+
+	return a.servicesGroup.Deny()
+}
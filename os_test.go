@@ -0,0 +1,87 @@
+package debos_test
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServicesMethod(t *testing.T) {
+	method, err := debos.ParseServicesMethod("")
+	assert.NoError(t, err)
+	assert.Equal(t, debos.ServicesMethodAuto, method)
+
+	method, err = debos.ParseServicesMethod("systemctl")
+	assert.NoError(t, err)
+	assert.Equal(t, debos.ServicesMethodSystemctl, method)
+
+	_, err = debos.ParseServicesMethod("upstart")
+	assert.EqualError(t, err, "unsupported services method 'upstart'")
+}
+
+func TestSystemctlDiversion(t *testing.T) {
+	rootdir := t.TempDir()
+	systemctl := path.Join(rootdir, "usr/bin/systemctl")
+	assert.NoError(t, os.MkdirAll(path.Dir(systemctl), 0755))
+	assert.NoError(t, os.WriteFile(systemctl, []byte("original"), 0755))
+
+	diversion := debos.NewSystemctlDiversion(rootdir)
+	assert.NoError(t, diversion.Deny())
+
+	data, err := os.ReadFile(systemctl)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "exec /usr/bin/systemctl.debos")
+
+	// Diverting twice must fail
+	assert.Error(t, debos.NewSystemctlDiversion(rootdir).Deny())
+
+	assert.NoError(t, diversion.Allow())
+	data, err = os.ReadFile(systemctl)
+	assert.NoError(t, err)
+	assert.Equal(t, "original", string(data))
+	_, err = os.Stat(systemctl + ".debos")
+	assert.True(t, os.IsNotExist(err))
+
+	// Binary replaced while diverted (e.g. package upgrade) is kept
+	assert.NoError(t, diversion.Deny())
+	assert.NoError(t, os.WriteFile(systemctl, []byte("upgraded"), 0755))
+	assert.NoError(t, diversion.Allow())
+	data, err = os.ReadFile(systemctl)
+	assert.NoError(t, err)
+	assert.Equal(t, "upgraded", string(data))
+	_, err = os.Stat(systemctl + ".debos")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestAutoServicesHelper(t *testing.T) {
+	rootdir := t.TempDir()
+	for _, f := range []string{"usr/bin/systemctl", "usr/sbin/start-stop-daemon"} {
+		assert.NoError(t, os.MkdirAll(path.Join(rootdir, path.Dir(f)), 0755))
+		assert.NoError(t, os.WriteFile(path.Join(rootdir, f), []byte("original"), 0755))
+	}
+
+	// No invoke-rc.d: everything gets diverted
+	services := debos.NewServicesManager(debos.ServicesMethodAuto, rootdir)
+	assert.NoError(t, services.Deny())
+	assert.Equal(t, []string{"SYSTEMD_OFFLINE=1"}, services.Environ())
+	assert.FileExists(t, path.Join(rootdir, "usr/sbin/policy-rc.d"))
+	assert.FileExists(t, path.Join(rootdir, "usr/bin/systemctl.debos"))
+	assert.FileExists(t, path.Join(rootdir, "usr/sbin/start-stop-daemon.debos"))
+
+	assert.NoError(t, services.Allow())
+	assert.NoFileExists(t, path.Join(rootdir, "usr/sbin/policy-rc.d"))
+	assert.NoFileExists(t, path.Join(rootdir, "usr/bin/systemctl.debos"))
+	assert.NoFileExists(t, path.Join(rootdir, "usr/sbin/start-stop-daemon.debos"))
+
+	// Debian rootfs: policy-rc.d is honoured, no diversion
+	assert.NoError(t, os.WriteFile(path.Join(rootdir, "usr/sbin/invoke-rc.d"), nil, 0755))
+	services = debos.NewServicesManager(debos.ServicesMethodAuto, rootdir)
+	assert.NoError(t, services.Deny())
+	assert.Empty(t, services.Environ())
+	assert.FileExists(t, path.Join(rootdir, "usr/sbin/policy-rc.d"))
+	assert.NoFileExists(t, path.Join(rootdir, "usr/bin/systemctl.debos"))
+	assert.NoError(t, services.Allow())
+}
@@ -0,0 +1,273 @@
+package debos
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Compression tools used for tarballs if a level or a thread count is set
+var compressPrograms = map[string]string{
+	"bzip2": "bzip2",
+	"gz":    "gzip",
+	"lzip":  "lzip",
+	"lz4":   "lz4",
+	"lzma":  "lzma",
+	"lzop":  "lzop",
+	"xz":    "xz",
+	"zstd":  "zstd",
+}
+
+/*
+TarCompressions returns the compression types supported for packing
+tarballs, 'none' and 'auto' (guess from the file extension) included.
+*/
+func TarCompressions() []string {
+	types := []string{"auto", "none"}
+	for c := range compressPrograms {
+		types = append(types, c)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// Helper function for options common to all packers
+func (arc *ArchiveBase) addPackOption(key, value interface{}) (bool, error) {
+	switch key {
+	case "compressionlevel", "threads":
+		v, ok := value.(int)
+		if !ok {
+			return true, fmt.Errorf("wrong type for value")
+		}
+		if v < 0 {
+			return true, fmt.Errorf("option '%v' can't be negative", key)
+		}
+	case "numericowner", "sort":
+		if _, ok := value.(bool); !ok {
+			return true, fmt.Errorf("wrong type for value")
+		}
+	case "mtime":
+		if _, ok := value.(time.Time); !ok {
+			return true, fmt.Errorf("wrong type for value")
+		}
+	default:
+		return false, nil
+	}
+
+	arc.options[key] = value
+	return true, nil
+}
+
+func (arc *ArchiveBase) intOption(key string) int {
+	v, _ := arc.options[key].(int)
+	return v
+}
+
+func (arc *ArchiveBase) boolOption(key string) bool {
+	v, _ := arc.options[key].(bool)
+	return v
+}
+
+// Return the mtime clamp, zero time if unset
+func (arc *ArchiveBase) mtimeOption() time.Time {
+	v, _ := arc.options["mtime"].(time.Time)
+	return v
+}
+
+// Pack is not supported by default
+func (arc *ArchiveBase) Pack(_ string) error {
+	return fmt.Errorf("Pack is not supported for '%s'", arc.file)
+}
+
+/* Check the compression options once the compression type is known, so the
+ * errors are reported when the options are set rather than when packing */
+func (tar *ArchiveTar) checkCompression() error {
+	if _, ok := tar.options["tarcompression"]; !ok {
+		return nil
+	}
+	_, err := tar.compressionArgs()
+	return err
+}
+
+// Build the tar arguments selecting the compression program
+func (tar *ArchiveTar) compressionArgs() ([]string, error) {
+	compression, _ := tar.options["tarcompression"].(string)
+	level := tar.intOption("compressionlevel")
+	threads := tar.intOption("threads")
+
+	_, pigzErr := exec.LookPath("pigz")
+	usePigz := compression == "gz" && pigzErr == nil
+
+	switch compression {
+	case "", "none":
+		if level > 0 || threads > 0 {
+			return nil, fmt.Errorf("compression level and threads need a compression type")
+		}
+		return nil, nil
+	case "auto":
+		if level > 0 || threads > 0 {
+			return nil, fmt.Errorf("compression level and threads are not supported with 'auto' compression")
+		}
+		return []string{"--auto-compress"}, nil
+	}
+
+	if level == 0 && threads == 0 {
+		if usePigz {
+			return []string{"--use-compress-program=pigz"}, nil
+		}
+		return []string{tarOptions(compression)}, nil
+	}
+
+	tool := compressPrograms[compression]
+	if usePigz {
+		tool = "pigz"
+	}
+	program := tool
+	if level > 0 {
+		program += " -" + strconv.Itoa(level)
+	}
+	if threads > 0 {
+		switch tool {
+		case "pigz":
+			program += " -p " + strconv.Itoa(threads)
+		case "xz", "zstd":
+			program += " -T" + strconv.Itoa(threads)
+		case "gzip":
+			return nil, fmt.Errorf("threads with compression 'gz' need pigz")
+		default:
+			return nil, fmt.Errorf("threads are not supported with compression '%s'", compression)
+		}
+	}
+
+	return []string{"--use-compress-program=" + program}, nil
+}
+
+/*
+Pack creates the tarball from the content of the source directory with
+the tar tool, keeping extended attributes.
+*/
+func (tar *ArchiveTar) Pack(source string) error {
+	compression, err := tar.compressionArgs()
+	if err != nil {
+		return err
+	}
+
+	command := []string{"tar"}
+	command = append(command, "cf")
+	command = append(command, tar.file)
+	command = append(command, "--xattrs")
+	command = append(command, "--xattrs-include=*.*")
+	command = append(command, compression...)
+
+	if tar.boolOption("numericowner") {
+		command = append(command, "--numeric-owner")
+	}
+	if tar.boolOption("sort") {
+		command = append(command, "--sort=name")
+	}
+	if mtime := tar.mtimeOption(); !mtime.IsZero() {
+		command = append(command, fmt.Sprintf("--mtime=@%d", mtime.Unix()), "--clamp-mtime")
+		// Drop timestamps which can't be clamped
+		command = append(command, "--pax-option=exthdr.name=%d/PaxHeaders/%f,delete=atime,delete=ctime")
+	}
+
+	command = append(command, "-C", source)
+	command = append(command, ".")
+
+	return Command{}.Run("Packing", command...)
+}
+
+/*
+Pack creates the zip archive from the content of the source directory.
+Ownership and special files can't be stored in zip archives.
+*/
+func (zip *ArchiveZip) Pack(source string) error {
+	f, err := os.Create(zip.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := packZip(f, source, zip.intOption("compressionlevel"), zip.mtimeOption()); err != nil {
+		os.Remove(zip.file)
+		return err
+	}
+
+	return f.Close()
+}
+
+func packZip(out io.Writer, source string, level int, mtime time.Time) error {
+	zw := zip.NewWriter(out)
+	if level > 0 {
+		zw.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(w, level)
+		})
+	}
+
+	// filepath.Walk visits the files in lexical order
+	walker := func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		name, err := filepath.Rel(source, p)
+		if err != nil || name == "." {
+			return err
+		}
+
+		hdr, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(name)
+		if !mtime.IsZero() && hdr.Modified.After(mtime) {
+			hdr.Modified = mtime
+		}
+
+		switch info.Mode() & os.ModeType {
+		case os.ModeDir:
+			hdr.Name += "/"
+			_, err := zw.CreateHeader(hdr)
+			return err
+		case os.ModeSymlink:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			w, err := zw.CreateHeader(hdr)
+			if err != nil {
+				return err
+			}
+			_, err = io.WriteString(w, link)
+			return err
+		case 0:
+			hdr.Method = zip.Deflate
+			w, err := zw.CreateHeader(hdr)
+			if err != nil {
+				return err
+			}
+			in, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+			_, err = io.Copy(w, in)
+			return err
+		default:
+			return fmt.Errorf("file %s with mode %v can't be stored in zip archive", p, info.Mode())
+		}
+	}
+
+	if err := filepath.Walk(source, walker); err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
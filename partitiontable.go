@@ -0,0 +1,410 @@
+package debos
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/google/uuid"
+)
+
+const (
+	gptEntrySize      = 128
+	gptHeaderSize     = 92
+	gptDefaultEntries = 128
+	gptNameLength     = 36
+	mbrMaxSectors     = 1<<32 - 1
+)
+
+// MBR partition types used for the extended partition and the GPT protective MBR
+const (
+	mbrTypeExtendedLBA = 0x0f
+	mbrTypeExtended    = 0x05
+	mbrTypeProtective  = 0xee
+)
+
+// Entry of a partition table, positions are in sectors
+type PartitionTableEntry struct {
+	Start      int64  // First sector
+	End        int64  // Last sector, inclusive
+	Type       string // Type GUID for GPT, hexadecimal byte for MBR
+	UUID       string // GPT partition GUID, random if empty
+	Name       string // GPT partition name
+	Attributes uint64 // GPT attribute bits
+	Bootable   bool   // MBR active flag
+	Extended   bool   // MBR extended partition, the following partitions being logical ones
+}
+
+/*
+PartitionTable writes GPT and MBR (msdos) partition tables, including
+MBR extended and logical partitions.
+*/
+type PartitionTable struct {
+	Type            string // "gpt" or "msdos"
+	SectorSize      int64
+	Sectors         int64  // Size of the disk
+	DiskID          string // GUID for GPT, 32 bits hexadecimal number for MBR, random if empty
+	GPTEntries      int    // Number of GPT partition entries, 128 by default
+	GPTEntriesStart int64  // Sector of the primary GPT partition entries, right after the header by default
+	Partitions      []PartitionTableEntry
+}
+
+func (t *PartitionTable) gptEntries() int {
+	if t.GPTEntries == 0 {
+		return gptDefaultEntries
+	}
+	return t.GPTEntries
+}
+
+func (t *PartitionTable) gptEntriesStart() int64 {
+	if t.GPTEntriesStart == 0 {
+		return 2
+	}
+	return t.GPTEntriesStart
+}
+
+func (t *PartitionTable) gptEntriesSectors() int64 {
+	size := int64(t.gptEntries() * gptEntrySize)
+	return (size + t.SectorSize - 1) / t.SectorSize
+}
+
+// FirstUsableSector returns the first sector available for partitions
+func (t *PartitionTable) FirstUsableSector() int64 {
+	if t.Type == "gpt" {
+		return t.gptEntriesStart() + t.gptEntriesSectors()
+	}
+	return 1
+}
+
+// LastUsableSector returns the last sector available for partitions
+func (t *PartitionTable) LastUsableSector() int64 {
+	if t.Type == "gpt" {
+		// Backup entries followed by the backup header
+		return t.Sectors - t.gptEntriesSectors() - 2
+	}
+	return t.Sectors - 1
+}
+
+// Validate checks the partitions fit on the disk without overlapping
+func (t *PartitionTable) Validate() error {
+	if t.SectorSize < 512 || t.SectorSize&(t.SectorSize-1) != 0 {
+		return fmt.Errorf("invalid sector size %d", t.SectorSize)
+	}
+
+	switch t.Type {
+	case "gpt":
+		if t.gptEntries() < len(t.Partitions) {
+			return fmt.Errorf("%d partitions don't fit in %d GPT entries", len(t.Partitions), t.gptEntries())
+		}
+		if t.gptEntriesStart() < 2 {
+			return fmt.Errorf("GPT partition entries can't start before sector 2")
+		}
+	case "msdos":
+		if t.Sectors > mbrMaxSectors {
+			return fmt.Errorf("disk of %d sectors is too large for a msdos partition table", t.Sectors)
+		}
+	default:
+		return fmt.Errorf("unsupported partition table type '%s'", t.Type)
+	}
+
+	first, last := t.FirstUsableSector(), t.LastUsableSector()
+	if first > last {
+		return fmt.Errorf("disk too small for the partition table")
+	}
+
+	var toplevel []int
+	var extended *PartitionTableEntry
+	var previous *PartitionTableEntry
+	for i := range t.Partitions {
+		p := &t.Partitions[i]
+		if p.Start > p.End {
+			return fmt.Errorf("partition %d ends before it starts", i+1)
+		}
+		if p.Start < first || p.End > last {
+			return fmt.Errorf("partition %d (sectors %d-%d) is outside of the usable sectors %d-%d",
+				i+1, p.Start, p.End, first, last)
+		}
+		if len(utf16.Encode([]rune(p.Name))) > gptNameLength {
+			return fmt.Errorf("partition name '%s' is too long, at most %d characters are supported", p.Name, gptNameLength)
+		}
+
+		if extended == nil {
+			toplevel = append(toplevel, i)
+			if p.Extended {
+				if t.Type != "msdos" {
+					return fmt.Errorf("extended partitions are only supported by msdos partition tables")
+				}
+				extended = p
+			}
+			continue
+		}
+
+		// Logical partitions need a sector for their extended boot record before them
+		if p.Extended {
+			return fmt.Errorf("only one extended partition is supported")
+		}
+		boundary := extended.Start
+		if previous != nil {
+			boundary = previous.End + 1
+		}
+		if p.Start <= boundary || p.End > extended.End {
+			return fmt.Errorf("logical partition %d (sectors %d-%d) needs to be inside the extended partition, after a free sector",
+				i+1, p.Start, p.End)
+		}
+		previous = p
+	}
+
+	if t.Type == "msdos" && len(toplevel) > 4 {
+		return fmt.Errorf("more than 4 primary partitions need an extended partition")
+	}
+
+	for i, a := range toplevel {
+		for _, b := range toplevel[:i] {
+			pa, pb := &t.Partitions[a], &t.Partitions[b]
+			if pa.Start <= pb.End && pb.Start <= pa.End {
+				return fmt.Errorf("partitions %d and %d overlap", b+1, a+1)
+			}
+		}
+	}
+
+	return nil
+}
+
+/*
+Write the partition table to the disk. Only the sectors of the partition
+table are written, the content of the partitions is left untouched.
+*/
+func (t *PartitionTable) Write(w io.WriterAt) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+
+	if t.Type == "gpt" {
+		return t.writeGPT(w)
+	}
+	return t.writeMBR(w)
+}
+
+// Encode a GUID with the mixed endianness used by GPT
+func gptGUID(s string) ([16]byte, error) {
+	var b [16]byte
+	u, err := uuid.Parse(s)
+	if err != nil {
+		return b, fmt.Errorf("incorrect GUID '%s'", s)
+	}
+	copy(b[:], u[:])
+	// The first three fields are little endian
+	b[0], b[1], b[2], b[3] = u[3], u[2], u[1], u[0]
+	b[4], b[5] = u[5], u[4]
+	b[6], b[7] = u[7], u[6]
+	return b, nil
+}
+
+// Cylinder/head/sector address of a sector, for legacy MBR fields
+func chsAddress(lba int64) [3]byte {
+	const heads, sectors = 255, 63
+	cylinder := lba / (heads * sectors)
+	if cylinder > 1023 {
+		return [3]byte{0xfe, 0xff, 0xff}
+	}
+	head := (lba / sectors) % heads
+	sector := lba%sectors + 1
+	return [3]byte{byte(head), byte(sector) | byte((cylinder>>2)&0xc0), byte(cylinder)}
+}
+
+// Encode a MBR partition entry
+func mbrEntry(entry []byte, bootable bool, ptype byte, start, size int64) {
+	if bootable {
+		entry[0] = 0x80
+	}
+	first := chsAddress(start)
+	last := chsAddress(start + size - 1)
+	copy(entry[1:4], first[:])
+	entry[4] = ptype
+	copy(entry[5:8], last[:])
+	binary.LittleEndian.PutUint32(entry[8:12], uint32(start))
+	binary.LittleEndian.PutUint32(entry[12:16], uint32(size))
+}
+
+func (t *PartitionTable) writeSector(w io.WriterAt, lba int64, data []byte) error {
+	_, err := w.WriteAt(data, lba*t.SectorSize)
+	return err
+}
+
+// MBR type byte of a partition
+func mbrType(p *PartitionTableEntry) (byte, error) {
+	if p.Type == "" {
+		if p.Extended {
+			return mbrTypeExtendedLBA, nil
+		}
+		return 0x83, nil
+	}
+	v, err := strconv.ParseUint(strings.TrimPrefix(p.Type, "0x"), 16, 8)
+	if err != nil {
+		return 0, fmt.Errorf("incorrect msdos partition type '%s'", p.Type)
+	}
+	return byte(v), nil
+}
+
+func (t *PartitionTable) writeMBR(w io.WriterAt) error {
+	mbr := make([]byte, 512)
+
+	diskID := t.DiskID
+	if diskID == "" {
+		u := uuid.New()
+		diskID = hex.EncodeToString(u[:4])
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(diskID, "0x"), 16, 32)
+	if err != nil {
+		return fmt.Errorf("incorrect disk ID '%s'", t.DiskID)
+	}
+	binary.LittleEndian.PutUint32(mbr[440:444], uint32(id))
+
+	var extended *PartitionTableEntry
+	var logical []*PartitionTableEntry
+	primary := 0
+	for i := range t.Partitions {
+		p := &t.Partitions[i]
+		if extended != nil {
+			logical = append(logical, p)
+			continue
+		}
+		ptype, err := mbrType(p)
+		if err != nil {
+			return err
+		}
+		mbrEntry(mbr[446+16*primary:], p.Bootable, ptype, p.Start, p.End-p.Start+1)
+		primary++
+		if p.Extended {
+			extended = p
+		}
+	}
+	mbr[510], mbr[511] = 0x55, 0xaa
+	if err := t.writeSector(w, 0, mbr); err != nil {
+		return err
+	}
+
+	if extended == nil {
+		return nil
+	}
+
+	/* Chain of extended boot records, the first one at the start of the
+	 * extended partition and the following ones right after the previous
+	 * logical partition */
+	ebrSector := extended.Start
+	for i, p := range logical {
+		ebr := make([]byte, 512)
+		ptype, err := mbrType(p)
+		if err != nil {
+			return err
+		}
+		mbrEntry(ebr[446:], p.Bootable, ptype, p.Start-ebrSector, p.End-p.Start+1)
+
+		next := p.End + 1
+		if i+1 < len(logical) {
+			n := logical[i+1]
+			mbrEntry(ebr[462:], false, mbrTypeExtended, next-extended.Start, n.End-next+1)
+		}
+		ebr[510], ebr[511] = 0x55, 0xaa
+		if err := t.writeSector(w, ebrSector, ebr); err != nil {
+			return err
+		}
+		ebrSector = next
+	}
+
+	return nil
+}
+
+func (t *PartitionTable) gptHeader(current, backup, entriesStart int64, diskGUID [16]byte, entriesCRC uint32) []byte {
+	header := make([]byte, t.SectorSize)
+	copy(header[0:8], "EFI PART")
+	binary.LittleEndian.PutUint32(header[8:12], 0x00010000)
+	binary.LittleEndian.PutUint32(header[12:16], gptHeaderSize)
+	binary.LittleEndian.PutUint64(header[24:32], uint64(current))
+	binary.LittleEndian.PutUint64(header[32:40], uint64(backup))
+	binary.LittleEndian.PutUint64(header[40:48], uint64(t.FirstUsableSector()))
+	binary.LittleEndian.PutUint64(header[48:56], uint64(t.LastUsableSector()))
+	copy(header[56:72], diskGUID[:])
+	binary.LittleEndian.PutUint64(header[72:80], uint64(entriesStart))
+	binary.LittleEndian.PutUint32(header[80:84], uint32(t.gptEntries()))
+	binary.LittleEndian.PutUint32(header[84:88], gptEntrySize)
+	binary.LittleEndian.PutUint32(header[88:92], entriesCRC)
+	binary.LittleEndian.PutUint32(header[16:20], crc32.ChecksumIEEE(header[:gptHeaderSize]))
+	return header
+}
+
+func (t *PartitionTable) writeGPT(w io.WriterAt) error {
+	// Protective MBR covering the whole disk
+	mbr := make([]byte, 512)
+	size := min(t.Sectors-1, mbrMaxSectors)
+	mbrEntry(mbr[446:], false, mbrTypeProtective, 1, size)
+	mbr[510], mbr[511] = 0x55, 0xaa
+	if err := t.writeSector(w, 0, mbr); err != nil {
+		return err
+	}
+
+	diskID := t.DiskID
+	if diskID == "" {
+		diskID = uuid.NewString()
+	}
+	diskGUID, err := gptGUID(diskID)
+	if err != nil {
+		return err
+	}
+
+	entries := make([]byte, t.gptEntriesSectors()*t.SectorSize)
+	for i, p := range t.Partitions {
+		entry := entries[i*gptEntrySize : (i+1)*gptEntrySize]
+
+		typeGUID, err := gptGUID(p.Type)
+		if err != nil {
+			return fmt.Errorf("partition %d: %w", i+1, err)
+		}
+		copy(entry[0:16], typeGUID[:])
+
+		partUUID := p.UUID
+		if partUUID == "" {
+			partUUID = uuid.NewString()
+		}
+		partGUID, err := gptGUID(partUUID)
+		if err != nil {
+			return fmt.Errorf("partition %d: %w", i+1, err)
+		}
+		copy(entry[16:32], partGUID[:])
+
+		binary.LittleEndian.PutUint64(entry[32:40], uint64(p.Start))
+		binary.LittleEndian.PutUint64(entry[40:48], uint64(p.End))
+		binary.LittleEndian.PutUint64(entry[48:56], p.Attributes)
+
+		name := utf16.Encode([]rune(p.Name))
+		for j, c := range name {
+			binary.LittleEndian.PutUint16(entry[56+2*j:], c)
+		}
+	}
+	entriesCRC := crc32.ChecksumIEEE(entries[:t.gptEntries()*gptEntrySize])
+
+	lastSector := t.Sectors - 1
+	backupEntries := lastSector - t.gptEntriesSectors()
+	if err := t.writeSector(w, t.gptEntriesStart(), entries); err != nil {
+		return err
+	}
+	if err := t.writeSector(w, backupEntries, entries); err != nil {
+		return err
+	}
+
+	primary := t.gptHeader(1, lastSector, t.gptEntriesStart(), diskGUID, entriesCRC)
+	if err := t.writeSector(w, 1, primary); err != nil {
+		return err
+	}
+	backup := t.gptHeader(lastSector, 1, backupEntries, diskGUID, entriesCRC)
+	if err := t.writeSector(w, lastSector, backup); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,199 @@
+package debos_test
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+func readDisk(t *testing.T, table *debos.PartitionTable) []byte {
+	file := path.Join(t.TempDir(), "disk.img")
+	f, err := os.Create(file)
+	assert.NoError(t, err)
+	defer f.Close()
+	assert.NoError(t, f.Truncate(table.Sectors*table.SectorSize))
+
+	assert.NoError(t, table.Write(f))
+
+	data, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	return data
+}
+
+func checkGPTHeader(t *testing.T, data []byte, lba, backup, entries int64) {
+	header := data[lba*512 : lba*512+512]
+	assert.Equal(t, "EFI PART", string(header[0:8]))
+
+	crc := binary.LittleEndian.Uint32(header[16:20])
+	check := make([]byte, 92)
+	copy(check, header[:92])
+	binary.LittleEndian.PutUint32(check[16:20], 0)
+	assert.Equal(t, crc32.ChecksumIEEE(check), crc)
+
+	assert.Equal(t, uint64(lba), binary.LittleEndian.Uint64(header[24:32]))
+	assert.Equal(t, uint64(backup), binary.LittleEndian.Uint64(header[32:40]))
+	assert.Equal(t, uint64(entries), binary.LittleEndian.Uint64(header[72:80]))
+
+	count := binary.LittleEndian.Uint32(header[80:84])
+	array := data[entries*512 : entries*512+int64(count)*128]
+	assert.Equal(t, crc32.ChecksumIEEE(array), binary.LittleEndian.Uint32(header[88:92]))
+}
+
+func TestPartitionTableGPT(t *testing.T) {
+	table := &debos.PartitionTable{
+		Type:       "gpt",
+		SectorSize: 512,
+		Sectors:    8192,
+		DiskID:     "12345678-1234-1234-1234-123456789012",
+		Partitions: []debos.PartitionTableEntry{
+			{
+				Start:      2048,
+				End:        4095,
+				Type:       "C12A7328-F81F-11D2-BA4B-00A0C93EC93B",
+				UUID:       "7BA1B99D-7942-450A-921B-F394A0A065AF",
+				Name:       "efi",
+				Attributes: 1<<2 | 1<<56,
+			},
+			{
+				Start: 4096,
+				End:   8158,
+				Type:  "0FC63DAF-8483-4772-8E79-3D69D8477DE4",
+				Name:  "root",
+			},
+		},
+	}
+	assert.Equal(t, int64(34), table.FirstUsableSector())
+	assert.Equal(t, int64(8158), table.LastUsableSector())
+
+	data := readDisk(t, table)
+
+	// Protective MBR
+	assert.Equal(t, byte(0xee), data[446+4])
+	assert.Equal(t, []byte{0x55, 0xaa}, data[510:512])
+
+	checkGPTHeader(t, data, 1, 8191, 2)
+	checkGPTHeader(t, data, 8191, 1, 8159)
+	assert.Equal(t, data[2*512:34*512], data[8159*512:8191*512])
+
+	assert.Equal(t, []byte{0x78, 0x56, 0x34, 0x12, 0x34, 0x12, 0x34, 0x12, 0x12, 0x34},
+		data[512+56:512+66])
+
+	entry := data[2*512 : 2*512+128]
+	assert.Equal(t, []byte{0x28, 0x73, 0x2a, 0xc1, 0x1f, 0xf8, 0xd2, 0x11, 0xba, 0x4b},
+		entry[0:10])
+	assert.Equal(t, []byte{0x9d, 0xb9, 0xa1, 0x7b, 0x42, 0x79, 0x0a, 0x45, 0x92, 0x1b},
+		entry[16:26])
+	assert.Equal(t, uint64(2048), binary.LittleEndian.Uint64(entry[32:40]))
+	assert.Equal(t, uint64(4095), binary.LittleEndian.Uint64(entry[40:48]))
+	assert.Equal(t, uint64(1<<2|1<<56), binary.LittleEndian.Uint64(entry[48:56]))
+	assert.Equal(t, []byte{'e', 0, 'f', 0, 'i', 0, 0, 0}, entry[56:64])
+
+	entry = data[2*512+128 : 2*512+256]
+	assert.Equal(t, uint64(4096), binary.LittleEndian.Uint64(entry[32:40]))
+	assert.Equal(t, uint64(8158), binary.LittleEndian.Uint64(entry[40:48]))
+	assert.NotEqual(t, make([]byte, 16), entry[16:32])
+}
+
+func TestPartitionTableGPTLayout(t *testing.T) {
+	table := &debos.PartitionTable{
+		Type:            "gpt",
+		SectorSize:      4096,
+		Sectors:         4096,
+		GPTEntries:      8,
+		GPTEntriesStart: 16,
+		Partitions: []debos.PartitionTableEntry{
+			{Start: 17, End: 4093, Type: "0FC63DAF-8483-4772-8E79-3D69D8477DE4"},
+		},
+	}
+	assert.Equal(t, int64(17), table.FirstUsableSector())
+	assert.Equal(t, int64(4093), table.LastUsableSector())
+	assert.NoError(t, table.Validate())
+
+	table.Partitions[0].Start = 16
+	assert.Error(t, table.Validate())
+
+	table.Partitions[0].Start = 17
+	table.Partitions[0].Name = "a name longer than the thirty-six characters"
+	assert.Error(t, table.Validate())
+}
+
+func TestPartitionTableMBR(t *testing.T) {
+	table := &debos.PartitionTable{
+		Type:       "msdos",
+		SectorSize: 512,
+		Sectors:    16384,
+		DiskID:     "0xdeadbeef",
+		Partitions: []debos.PartitionTableEntry{
+			{Start: 2048, End: 4095, Type: "0c", Bootable: true},
+			{Start: 4096, End: 6143},
+			{Start: 6144, End: 8191},
+			{Start: 8192, End: 16383, Extended: true},
+			{Start: 8193, End: 10239},
+			{Start: 10241, End: 16383, Type: "82"},
+		},
+	}
+
+	data := readDisk(t, table)
+
+	assert.Equal(t, uint32(0xdeadbeef), binary.LittleEndian.Uint32(data[440:444]))
+	assert.Equal(t, []byte{0x55, 0xaa}, data[510:512])
+
+	entry := func(sector int64, idx int) (byte, byte, uint32, uint32) {
+		e := data[sector*512+446+int64(idx)*16:]
+		return e[0], e[4], binary.LittleEndian.Uint32(e[8:12]), binary.LittleEndian.Uint32(e[12:16])
+	}
+
+	flag, ptype, start, size := entry(0, 0)
+	assert.Equal(t, []any{byte(0x80), byte(0x0c), uint32(2048), uint32(2048)}, []any{flag, ptype, start, size})
+	flag, ptype, start, size = entry(0, 1)
+	assert.Equal(t, []any{byte(0), byte(0x83), uint32(4096), uint32(2048)}, []any{flag, ptype, start, size})
+	_, ptype, start, size = entry(0, 3)
+	assert.Equal(t, []any{byte(0x0f), uint32(8192), uint32(8192)}, []any{ptype, start, size})
+
+	// First extended boot record, at the start of the extended partition
+	_, ptype, start, size = entry(8192, 0)
+	assert.Equal(t, []any{byte(0x83), uint32(1), uint32(2047)}, []any{ptype, start, size})
+	_, ptype, start, size = entry(8192, 1)
+	assert.Equal(t, []any{byte(0x05), uint32(2048), uint32(6144)}, []any{ptype, start, size})
+	assert.Equal(t, []byte{0x55, 0xaa}, data[8192*512+510:8192*512+512])
+
+	// Second one, right after the first logical partition
+	_, ptype, start, size = entry(10240, 0)
+	assert.Equal(t, []any{byte(0x82), uint32(1), uint32(6143)}, []any{ptype, start, size})
+	_, ptype, _, _ = entry(10240, 1)
+	assert.Equal(t, byte(0), ptype)
+}
+
+func TestPartitionTableMBRValidate(t *testing.T) {
+	table := &debos.PartitionTable{
+		Type:       "msdos",
+		SectorSize: 512,
+		Sectors:    16384,
+		Partitions: []debos.PartitionTableEntry{
+			{Start: 2048, End: 8191, Extended: true},
+			{Start: 2048, End: 4095},
+		},
+	}
+	// No room for the extended boot record
+	assert.Error(t, table.Validate())
+
+	table.Partitions[1].Start = 2049
+	assert.NoError(t, table.Validate())
+
+	table.Partitions = append(table.Partitions, debos.PartitionTableEntry{Start: 4000, End: 5000})
+	assert.Error(t, table.Validate())
+
+	table.Partitions = []debos.PartitionTableEntry{
+		{Start: 1, End: 100}, {Start: 101, End: 200}, {Start: 201, End: 300},
+		{Start: 301, End: 400}, {Start: 401, End: 500},
+	}
+	assert.Error(t, table.Validate())
+
+	table.Partitions = []debos.PartitionTableEntry{{Start: 1, End: 100}, {Start: 100, End: 200}}
+	assert.Error(t, table.Validate())
+}
@@ -0,0 +1,106 @@
+package debos
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const secretMask = "***"
+
+// Environment variable passing the secrets to the fake machine
+const secretsEnviron = "DEBOS_SECRETS"
+
+var secrets struct {
+	sync.Mutex
+	values []string
+}
+
+// AddSecret registers a value to be masked in all the log output
+func AddSecret(value string) {
+	if value == "" {
+		return
+	}
+
+	secrets.Lock()
+	defer secrets.Unlock()
+	if slices.Contains(secrets.values, value) {
+		return
+	}
+	secrets.values = append(secrets.values, value)
+	// Longest first, so secrets containing others are masked completely
+	slices.SortFunc(secrets.values, func(a, b string) int { return len(b) - len(a) })
+}
+
+// MaskSecrets replaces the registered secrets in s
+func MaskSecrets(s string) string {
+	secrets.Lock()
+	defer secrets.Unlock()
+	for _, v := range secrets.values {
+		s = strings.ReplaceAll(s, v, secretMask)
+	}
+	return s
+}
+
+type secretMasker struct {
+	w io.Writer
+}
+
+/*
+NewSecretMasker returns a writer masking the registered secrets, meant for
+the log output. Each write is expected to hold complete lines, as written
+by the log package.
+*/
+func NewSecretMasker(w io.Writer) io.Writer {
+	return &secretMasker{w}
+}
+
+func (m *secretMasker) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(m.w, MaskSecrets(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Secret environment and template variables
+type Secrets struct {
+	EnvironVars  map[string]string `json:"env,omitempty"`
+	TemplateVars map[string]string `json:"vars,omitempty"`
+}
+
+/*
+Environ encodes the secrets as environment variable for the fake machine,
+keeping them out of its command line. The value is base64 encoded so it
+can't be mangled by the unit file it ends up in.
+*/
+func (s Secrets) Environ() (string, error) {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	return secretsEnviron + "=" + base64.StdEncoding.EncodeToString(data), nil
+}
+
+/*
+SecretsFromEnviron decodes the secrets passed by Environ() and removes
+them from the environment of the process.
+*/
+func SecretsFromEnviron() (Secrets, error) {
+	var s Secrets
+	encoded, ok := os.LookupEnv(secretsEnviron)
+	if !ok {
+		return s, nil
+	}
+	os.Unsetenv(secretsEnviron)
+
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return s, err
+	}
+	err = json.Unmarshal(data, &s)
+	return s, err
+}
@@ -0,0 +1,41 @@
+package debos_test
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecretMasker(t *testing.T) {
+	debos.AddSecret("hunter2")
+	debos.AddSecret("hunter2-long")
+	debos.AddSecret("")
+
+	var out bytes.Buffer
+	logger := log.New(debos.NewSecretMasker(&out), "", 0)
+	logger.Printf("password=hunter2 token=hunter2-long")
+	assert.Equal(t, "password=*** token=***\n", out.String())
+}
+
+func TestSecretsEnviron(t *testing.T) {
+	secrets := debos.Secrets{
+		EnvironVars:  map[string]string{"TOKEN": "with spaces and %s"},
+		TemplateVars: map[string]string{"password": "p\"w"},
+	}
+	environ, err := secrets.Environ()
+	assert.NoError(t, err)
+	name, value, _ := strings.Cut(environ, "=")
+	assert.NotContains(t, environ, "spaces")
+
+	t.Setenv(name, value)
+	decoded, err := debos.SecretsFromEnviron()
+	assert.NoError(t, err)
+	assert.Equal(t, secrets, decoded)
+	_, set := os.LookupEnv(name)
+	assert.False(t, set)
+}
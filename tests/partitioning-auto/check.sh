@@ -0,0 +1,10 @@
+#!/bin/sh
+# Check the image built with imagesize auto was shrunk to its content with a
+# valid backup GPT header at its new end
+set -e
+
+size=$(stat -c %s test.img)
+echo "test.img: $size bytes"
+[ $size -lt $((256 << 20)) ]
+
+sfdisk --verify test.img
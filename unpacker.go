@@ -0,0 +1,582 @@
+package debos
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Returned if an archive can't be handled without external tools
+var errNotNative = errors.New("not supported natively")
+
+var compressionMagics = []struct {
+	compression string
+	magic       []byte
+}{
+	{"gz", []byte{0x1f, 0x8b}},
+	{"bzip2", []byte("BZh")},
+	{"xz", []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{"zstd", []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{"lzip", []byte("LZIP")},
+	{"lz4", []byte{0x04, 0x22, 0x4d, 0x18}},
+	{"lzop", []byte{0x89, 'L', 'Z', 'O', 0x00, 0x0d, 0x0a, 0x1a, 0x0a}},
+}
+
+// Guess the compression type from the first bytes of the stream
+func detectCompression(r *bufio.Reader) string {
+	for _, m := range compressionMagics {
+		if head, err := r.Peek(len(m.magic)); err == nil && bytes.Equal(head, m.magic) {
+			return m.compression
+		}
+	}
+	return ""
+}
+
+/*
+decompressReader wraps r with a decompressor for the given compression
+type, the type is detected from the stream content if empty.
+*/
+func decompressReader(r io.Reader, compression string) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	if compression == "" || compression == "none" || compression == "auto" {
+		compression = detectCompression(br)
+	}
+
+	switch compression {
+	case "":
+		return io.NopCloser(br), nil
+	case "gz":
+		return gzip.NewReader(br)
+	case "bzip2":
+		return io.NopCloser(bzip2.NewReader(br)), nil
+	case "xz":
+		xzr, err := xz.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(xzr), nil
+	case "zstd":
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("compression '%s': %w", compression, errNotNative)
+	}
+}
+
+/*
+extractor writes archive entries below its destination directory. Entries
+pointing outside of the destination are rejected and symlinks of already
+extracted directories are resolved as if the destination was the root
+filesystem, so no entry can be written outside of it.
+*/
+type extractor struct {
+	destination string
+	relaxed     bool // Do not preserve ownership and special permission bits
+	dirs        []dirMeta
+	filter      UnpackFilter
+}
+
+/*
+UnpackFilter selects the archive entries to extract. The leading path
+components are stripped first, then the patterns are matched against the
+remaining path of the entries and of their parent directories, so a
+directory pattern selects its whole content. Patterns without '/' match
+any path component, e.g. '*.ko'.
+*/
+type UnpackFilter struct {
+	Include         []string // Extract only entries matching one of the patterns
+	Exclude         []string // Skip entries matching one of the patterns
+	StripComponents int      // Number of leading path components to remove
+}
+
+// Check if the filter changes the set of extracted entries
+func (f UnpackFilter) active() bool {
+	return len(f.Include) > 0 || len(f.Exclude) > 0 || f.StripComponents > 0
+}
+
+func matchPattern(pattern, name string) bool {
+	pattern = strings.Trim(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "./")
+
+	if !strings.Contains(pattern, "/") {
+		for _, c := range strings.Split(name, "/") {
+			if ok, _ := path.Match(pattern, c); ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	for p := name; p != "." && p != "/"; p = path.Dir(p) {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if matchPattern(p, name) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+rename applies the filter to an entry name, returning the name to extract
+it as and false if the entry has to be skipped.
+*/
+func (f UnpackFilter) rename(name string) (string, bool) {
+	if !f.active() {
+		return name, true
+	}
+
+	components := []string{}
+	for _, c := range strings.Split(name, "/") {
+		if c != "" && c != "." {
+			components = append(components, c)
+		}
+	}
+	if len(components) <= f.StripComponents {
+		return "", false
+	}
+	name = strings.Join(components[f.StripComponents:], "/")
+
+	if len(f.Include) > 0 && !matchAny(f.Include, name) {
+		return "", false
+	}
+	if matchAny(f.Exclude, name) {
+		return "", false
+	}
+	return name, true
+}
+
+// Apply the filter to a tar header, false if the entry has to be skipped
+func (e *extractor) filterTarHeader(hdr *tar.Header) (bool, error) {
+	name, ok := e.filter.rename(hdr.Name)
+	if !ok {
+		return false, nil
+	}
+
+	if hdr.Typeflag == tar.TypeLink && e.filter.StripComponents > 0 {
+		target, ok := UnpackFilter{StripComponents: e.filter.StripComponents}.rename(hdr.Linkname)
+		if !ok {
+			return false, fmt.Errorf("hardlink target '%s' of '%s' stripped by strip-components", hdr.Linkname, hdr.Name)
+		}
+		hdr.Linkname = target
+	}
+	hdr.Name = name
+	return true, nil
+}
+
+// Metadata of directories is applied at the end, so read-only directories
+// can still be populated
+type dirMeta struct {
+	path  string
+	mode  os.FileMode
+	mtime time.Time
+}
+
+func newExtractor(destination string, relaxed bool) (*extractor, error) {
+	if err := os.MkdirAll(destination, 0755); err != nil {
+		return nil, err
+	}
+	destination, err := filepath.Abs(destination)
+	if err != nil {
+		return nil, err
+	}
+	return &extractor{destination: destination, relaxed: relaxed}, nil
+}
+
+// Clean an archive entry name, rejecting names escaping the destination
+func cleanEntryName(name string) (string, error) {
+	for _, c := range strings.Split(name, "/") {
+		if c == ".." {
+			return "", fmt.Errorf("refusing to extract '%s': path traversal", name)
+		}
+	}
+	return path.Clean("/" + name), nil
+}
+
+/*
+resolveInRoot returns the host path for name inside root. Symlinks in the
+parent directories of name are followed as if root was the filesystem root;
+the last component is never followed.
+*/
+func resolveInRoot(root, name string) (string, error) {
+	parent, base := path.Split(path.Clean("/" + name))
+	todo := strings.Split(parent, "/")
+	current := "/"
+	links := 0
+
+	for len(todo) > 0 {
+		c := todo[0]
+		todo = todo[1:]
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			current = path.Dir(current)
+			continue
+		}
+
+		next := path.Join(current, c)
+		fi, err := os.Lstat(path.Join(root, next))
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+
+		links++
+		if links > 255 {
+			return "", fmt.Errorf("too many levels of symbolic links in '%s'", name)
+		}
+		link, err := os.Readlink(path.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(link) {
+			current = "/"
+		}
+		todo = append(strings.Split(link, "/"), todo...)
+	}
+
+	return path.Join(root, current, base), nil
+}
+
+// Prepare the target path of an entry: create parents and remove leftovers
+func (e *extractor) target(name string, isDir bool) (string, error) {
+	name, err := cleanEntryName(name)
+	if err != nil {
+		return "", err
+	}
+	if name == "/" {
+		return e.destination, nil
+	}
+
+	target, err := resolveInRoot(e.destination, name)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(path.Dir(target), 0755); err != nil {
+		return "", err
+	}
+
+	fi, err := os.Lstat(target)
+	switch {
+	case err != nil:
+	case isDir && fi.IsDir():
+	default:
+		if err := os.Remove(target); err != nil {
+			return "", err
+		}
+	}
+
+	return target, nil
+}
+
+func mkdev(major, minor int64) int {
+	return int((minor & 0xff) | ((major & 0xfff) << 8) |
+		((minor &^ 0xff) << 12) | ((major &^ 0xfff) << 32))
+}
+
+// Apply ownership, permissions and extended attributes
+func (e *extractor) setMeta(target string, hdr *tar.Header, isLink bool) error {
+	if !e.relaxed && os.Geteuid() == 0 {
+		if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+	}
+
+	if isLink {
+		return nil
+	}
+
+	mode := hdr.FileInfo().Mode()
+	if mode.IsDir() {
+		e.dirs = append(e.dirs, dirMeta{target, mode, hdr.ModTime})
+	} else if err := os.Chmod(target, e.perm(mode)); err != nil {
+		return err
+	}
+
+	// xattrs have to be set after chown as it drops e.g. security.capability
+	if err := e.setXattrs(target, hdr); err != nil {
+		return err
+	}
+
+	if mode.IsDir() {
+		return nil
+	}
+	return os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+}
+
+func (e *extractor) setXattrs(target string, hdr *tar.Header) error {
+	for k, v := range hdr.PAXRecords {
+		attr, ok := strings.CutPrefix(k, "SCHILY.xattr.")
+		if !ok {
+			continue
+		}
+		if err := syscall.Setxattr(target, attr, []byte(v), 0); err != nil && !e.relaxed {
+			return fmt.Errorf("failed to set xattr %s on %s: %w", attr, target, err)
+		}
+	}
+	return nil
+}
+
+// Permission bits applied to an entry, without the special ones in relaxed mode
+func (e *extractor) perm(mode os.FileMode) os.FileMode {
+	if e.relaxed {
+		return mode & os.ModePerm
+	}
+	return mode & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+}
+
+// Apply the deferred metadata of directories, deepest first
+func (e *extractor) finish() error {
+	sort.SliceStable(e.dirs, func(a, b int) bool {
+		return len(e.dirs[a].path) > len(e.dirs[b].path)
+	})
+	for _, d := range e.dirs {
+		if err := os.Chmod(d.path, e.perm(d.mode)); err != nil {
+			return err
+		}
+		if err := os.Chtimes(d.path, d.mtime, d.mtime); err != nil {
+			return err
+		}
+	}
+	e.dirs = nil
+	return nil
+}
+
+func writeFile(target string, r io.Reader) error {
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Extract a single tar entry
+func (e *extractor) extractTarEntry(hdr *tar.Header, r io.Reader) error {
+	target, err := e.target(hdr.Name, hdr.Typeflag == tar.TypeDir)
+	if err != nil {
+		return err
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(target, 0700); err != nil {
+			return err
+		}
+	case tar.TypeReg:
+		if err := writeFile(target, r); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, target); err != nil {
+			return err
+		}
+		return e.setMeta(target, hdr, true)
+	case tar.TypeLink:
+		name, err := cleanEntryName(hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		source, err := resolveInRoot(e.destination, name)
+		if err != nil {
+			return err
+		}
+		// Hard links share the metadata of their source
+		return os.Link(source, target)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		mode := uint32(hdr.Mode & 0777)
+		switch hdr.Typeflag {
+		case tar.TypeChar:
+			mode |= syscall.S_IFCHR
+		case tar.TypeBlock:
+			mode |= syscall.S_IFBLK
+		case tar.TypeFifo:
+			mode |= syscall.S_IFIFO
+		}
+		if err := syscall.Mknod(target, mode, mkdev(hdr.Devmajor, hdr.Devminor)); err != nil {
+			if e.relaxed {
+				return nil
+			}
+			return fmt.Errorf("failed to create device node %s: %w", hdr.Name, err)
+		}
+	case tar.TypeXGlobalHeader:
+		return nil
+	default:
+		return fmt.Errorf("unsupported type '%c' for tar entry %s", hdr.Typeflag, hdr.Name)
+	}
+
+	return e.setMeta(target, hdr, false)
+}
+
+// Extract a tar stream
+func (e *extractor) extractTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		ok, err := e.filterTarHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := e.extractTarEntry(hdr, tr); err != nil {
+			return err
+		}
+	}
+	return e.finish()
+}
+
+// Extract a zip archive, ownership is not recorded in zip files
+func (e *extractor) extractZip(file string) error {
+	zr, err := zip.OpenReader(file)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	for _, f := range zr.File {
+		name, ok := e.filter.rename(f.Name)
+		if !ok {
+			continue
+		}
+		mode := f.Mode()
+		target, err := e.target(name, mode.IsDir())
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case mode.IsDir():
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+			e.dirs = append(e.dirs, dirMeta{target, mode, f.Modified})
+			continue
+		case mode&os.ModeSymlink != 0:
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			link, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(string(link), target); err != nil {
+				return err
+			}
+			continue
+		case mode.IsRegular():
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			err = writeFile(target, rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported mode %v for zip entry %s", mode, f.Name)
+		}
+
+		if err := os.Chmod(target, e.perm(mode)); err != nil {
+			return err
+		}
+		if err := os.Chtimes(target, f.Modified, f.Modified); err != nil {
+			return err
+		}
+	}
+
+	return e.finish()
+}
+
+/*
+extractDeb extracts the data member of a Debian binary package, which is an
+ar archive containing a (compressed) tarball.
+*/
+func (e *extractor) extractDeb(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	magic := make([]byte, 8)
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != "!<arch>\n" {
+		return fmt.Errorf("'%s' is not a Debian package", file)
+	}
+
+	for {
+		hdr := make([]byte, 60)
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			return fmt.Errorf("no data member found in '%s'", file)
+		}
+		name := strings.TrimSuffix(strings.TrimSpace(string(hdr[0:16])), "/")
+		size, err := strconv.ParseInt(strings.TrimSpace(string(hdr[48:58])), 10, 64)
+		if err != nil {
+			return fmt.Errorf("corrupted member header in '%s'", file)
+		}
+
+		if strings.HasPrefix(name, "data.tar") {
+			compression := map[string]string{
+				".gz":   "gz",
+				".bz2":  "bzip2",
+				".xz":   "xz",
+				".zst":  "zstd",
+				".lzma": "lzma",
+			}[path.Ext(name)]
+			data, err := decompressReader(io.LimitReader(r, size), compression)
+			if err != nil {
+				return err
+			}
+			defer data.Close()
+			return e.extractTar(data)
+		}
+
+		// Members are 2-bytes aligned
+		if _, err := r.Discard(int(size + size%2)); err != nil {
+			return err
+		}
+	}
+}